@@ -1,15 +1,87 @@
 package cgroups
 
 import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
 	"./subsystems"
 	"github.com/sirupsen/logrus"
 )
 
+// Cgroup drivers
+const (
+	CgroupfsDriver = "cgroupfs"
+	SystemdDriver  = "systemd"
+)
+
+// Manager is what a cgroup driver does for a container
+type Manager interface {
+	Apply(pid int) error
+	Set(res *subsystems.ResourceConfig) error
+	Destroy() error
+	Freeze(state string) error
+	MemoryUsage() (uint64, uint64, error)
+	CpuUsage() (uint64, error)
+	IoUsage() (uint64, uint64, error)
+	NotifyOOM() (<-chan struct{}, error)
+	OOMKillCount() (uint64, bool)
+}
+
+// NewManager returns the manager of driver for the cgroup at path, an empty
+// driver is cgroupfs, the one of containers from before drivers were recorded
+func NewManager(driver string, path string) (Manager, error) {
+	switch driver {
+	case "", CgroupfsDriver:
+		manager := NewCgroupManager(path)
+		manager.PruneParents = true
+		return manager, nil
+	case SystemdDriver:
+		return NewSystemdManager(path), nil
+	}
+	return nil, fmt.Errorf("unknown cgroup driver %q, it must be cgroupfs or systemd", driver)
+}
+
+// DefaultParent holds the cgroups of the cgroupfs driver's containers
+const DefaultParent = "mydocker"
+
+// CleanParent checks a --cgroup-parent for driver and returns it cleaned up.
+// cgroupfs takes a path relative to the mount points, like tenants/a, systemd
+// a slice, like tenant-a.slice for a.slice in tenant.slice.
+func CleanParent(driver string, parent string) (string, error) {
+	if driver == SystemdDriver {
+		if parent == "" {
+			return DefaultSlice, nil
+		}
+		if strings.Contains(parent, "/") || !strings.HasSuffix(parent, ".slice") || parent == ".slice" {
+			return "", fmt.Errorf("cgroup parent %q of the systemd driver must be a slice, like tenant-a.slice", parent)
+		}
+		return parent, nil
+	}
+	if parent == "" {
+		return DefaultParent, nil
+	}
+	for _, name := range strings.Split(parent, "/") {
+		if name == ".." {
+			return "", fmt.Errorf("cgroup parent %q must not go up with ..", parent)
+		}
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+parent), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("cgroup parent %q is the root cgroup", parent)
+	}
+	return cleaned, nil
+}
+
 type CgroupManager struct {
 	// cgroup 在hierarchy 的绝对路径
 	Path string
 	// 资源配置
 	Resource *subsystems.ResourceConfig
+	// Destroy also removes the parents left empty, NewManager sets it for
+	// cgroupfs, systemd cleans up its own slices
+	PruneParents bool
 }
 
 func NewCgroupManager(path string) *CgroupManager {
@@ -19,7 +91,9 @@ func NewCgroupManager(path string) *CgroupManager {
 // traverse每一个资源限制处理链，将进程的pid加到每个cgroup中
 func (c *CgroupManager) Apply(pid int) error {
 	for _, subSysIns := range subsystems.SubsystemIns {
-		subSysIns.Apply(c.Path, pid)
+		if err := subSysIns.Apply(c.Path, pid); err != nil {
+			return fmt.Errorf("apply cgroup %s fail %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
@@ -27,18 +101,46 @@ func (c *CgroupManager) Apply(pid int) error {
 // 遍历每一个资源限制链，都调用Set设置资源限制
 func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
 	for _, subSysIns := range subsystems.SubsystemIns {
-		subSysIns.Set(c.Path, res)
+		if err := subSysIns.Set(c.Path, res); err != nil {
+			return fmt.Errorf("set cgroup %s fail %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
+// Freeze freezes or thaws every process of the cgroup, state is subsystems.Frozen or Thawed
+func (c *CgroupManager) Freeze(state string) error {
+	return (&subsystems.FreezerSubSystem{}).Freeze(c.Path, state)
+}
+
 //释放cgroup
+// Destroy kills what is left in the cgroup first, a cgroup with tasks can't
+// be removed. It fails with the directories it could not remove.
 func (c *CgroupManager) Destroy() error {
+	if err := c.KillTasks(); err != nil {
+		logrus.Warnf("kill tasks of cgroup %s fail %v", c.Path, err)
+	}
 	for _, subSysIns := range subsystems.SubsystemIns {
 		//logrus.Infof("[Destroy] c.Path %s", c.Path)
 		if err := subSysIns.Remove(c.Path); err != nil {
-			logrus.Warnf("remove cgroup fail %v", err)
+			logrus.Debugf("remove cgroup fail %v", err)
+		}
+	}
+	if c.PruneParents {
+		for _, subSysIns := range subsystems.SubsystemIns {
+			subsystems.RemoveEmptyParents(subsystems.FindCgroupMountpoint(subSysIns.Name()), c.Path)
 		}
+		// where freezer falls back to
+		subsystems.RemoveEmptyParents(subsystems.FindCgroup2Mountpoint(), c.Path)
+	}
+	var leftover []string
+	for _, root := range Hierarchies() {
+		if _, err := os.Stat(path.Join(root, c.Path)); err == nil {
+			leftover = append(leftover, path.Join(root, c.Path))
+		}
+	}
+	if len(leftover) > 0 {
+		return fmt.Errorf("cgroups left behind: %s", strings.Join(leftover, ", "))
 	}
 	return nil
 }
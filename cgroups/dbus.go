@@ -0,0 +1,378 @@
+package cgroups
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A minimal D-Bus client, just what SystemdManager needs to call systemd:
+// EXTERNAL authentication and method calls with the basic types, structs,
+// arrays and variants.
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+)
+
+// DBusError is an error reply, Name like org.freedesktop.systemd1.NoSuchUnit
+type DBusError struct {
+	Name    string
+	Message string
+}
+
+func (e *DBusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+// isDBusError tells if err is the error reply name
+func isDBusError(err error, name string) bool {
+	dbusErr, ok := err.(*DBusError)
+	return ok && dbusErr.Name == name
+}
+
+type dbusConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	serial uint32
+	bus    bool // false for peer to peer sockets like /run/systemd/private
+}
+
+// dialDBus connects to a unix socket, bus tells to say Hello to a bus daemon
+func dialDBus(socket string, bus bool) (*dbusConn, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{conn: conn, r: bufio.NewReader(conn), bus: bus}
+	if err := c.auth(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if bus {
+		if _, err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("dbus hello error %v", err)
+		}
+	}
+	return c, nil
+}
+
+// dbusSocketPath takes the path out of a unix:path=... address
+func dbusSocketPath(address string) (string, error) {
+	for _, part := range strings.Split(strings.TrimPrefix(address, "unix:"), ",") {
+		if strings.HasPrefix(part, "path=") {
+			return strings.TrimPrefix(part, "path="), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported dbus address %q, only unix:path= is", address)
+}
+
+func (c *dbusConn) auth() error {
+	// a nul byte, then the uid in hex of its decimal digits
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Geteuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("dbus auth error %v", err)
+	}
+	if !strings.HasPrefix(line, "OK") {
+		return fmt.Errorf("dbus auth rejected: %s", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(c.conn, "BEGIN\r\n")
+	return err
+}
+
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// call sends a method call and waits for its reply, skipping signals
+func (c *dbusConn) call(destination, path, iface, member, signature string, body func(*dbusEncoder)) (*dbusMessage, error) {
+	c.serial++
+	b := &dbusEncoder{}
+	if body != nil {
+		body(b)
+	}
+	h := &dbusEncoder{}
+	h.byte('l')
+	h.byte(dbusMethodCall)
+	h.byte(0)
+	h.byte(1)
+	h.uint32(uint32(len(b.buf)))
+	h.uint32(c.serial)
+	h.array(8, func() {
+		field := func(code byte, sig string, value string) {
+			h.align(8)
+			h.byte(code)
+			h.signature(sig)
+			if sig == "g" {
+				h.signature(value)
+			} else {
+				h.string(value)
+			}
+		}
+		field(dbusFieldPath, "o", path)
+		if iface != "" {
+			field(dbusFieldInterface, "s", iface)
+		}
+		field(dbusFieldMember, "s", member)
+		if c.bus {
+			field(dbusFieldDestination, "s", destination)
+		}
+		if signature != "" {
+			field(dbusFieldSignature, "g", signature)
+		}
+	})
+	h.align(8)
+	if _, err := c.conn.Write(append(h.buf, b.buf...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.replySerial != c.serial {
+			continue
+		}
+		if msg.kind == dbusError {
+			dbusErr := &DBusError{Name: msg.errorName}
+			if strings.HasPrefix(msg.signature, "s") {
+				d := &dbusDecoder{buf: msg.body, order: msg.order}
+				dbusErr.Message, _ = d.string()
+			}
+			return nil, dbusErr
+		}
+		return msg, nil
+	}
+}
+
+type dbusMessage struct {
+	kind        byte
+	order       binary.ByteOrder
+	replySerial uint32
+	errorName   string
+	signature   string
+	body        []byte
+}
+
+func (c *dbusConn) readMessage() (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, fixed); err != nil {
+		return nil, err
+	}
+	msg := &dbusMessage{kind: fixed[1], order: binary.LittleEndian}
+	if fixed[0] == 'B' {
+		msg.order = binary.BigEndian
+	}
+	bodyLen := msg.order.Uint32(fixed[4:8])
+	fieldsLen := msg.order.Uint32(fixed[12:16])
+	headerLen := (16 + fieldsLen + 7) &^ 7
+	rest := make([]byte, headerLen-16+bodyLen)
+	if _, err := io.ReadFull(c.r, rest); err != nil {
+		return nil, err
+	}
+	header := append(fixed, rest[:headerLen-16]...)
+	msg.body = rest[headerLen-16:]
+
+	d := &dbusDecoder{buf: header[:16+fieldsLen], pos: 16, order: msg.order}
+	for d.pos < len(d.buf) {
+		d.align(8)
+		code, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		sig, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		switch sig {
+		case "s", "o":
+			value, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if code == dbusFieldErrorName {
+				msg.errorName = value
+			}
+		case "g":
+			value, err := d.signature()
+			if err != nil {
+				return nil, err
+			}
+			if code == dbusFieldSignature {
+				msg.signature = value
+			}
+		case "u":
+			value, err := d.uint32()
+			if err != nil {
+				return nil, err
+			}
+			if code == dbusFieldReplySerial {
+				msg.replySerial = value
+			}
+		default:
+			return nil, fmt.Errorf("unexpected dbus header field type %q", sig)
+		}
+	}
+	return msg, nil
+}
+
+// dbusEncoder marshals little endian, aligned from the start of buf. The
+// header is padded to 8 bytes, so the body can be encoded on its own.
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *dbusEncoder) uint64(v uint64) {
+	e.align(8)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *dbusEncoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+// string also encodes object paths
+func (e *dbusEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) signature(s string) {
+	e.byte(byte(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// array writes the length of what elements encodes, after the padding to the first element
+func (e *dbusEncoder) array(elementAlign int, elements func()) {
+	e.align(4)
+	lengthAt := len(e.buf)
+	e.uint32(0)
+	e.align(elementAlign)
+	start := len(e.buf)
+	elements()
+	binary.LittleEndian.PutUint32(e.buf[lengthAt:], uint32(len(e.buf)-start))
+}
+
+// variant encodes the value types of UnitProperty
+func (e *dbusEncoder) variant(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		e.signature("s")
+		e.string(v)
+	case bool:
+		e.signature("b")
+		e.bool(v)
+	case uint64:
+		e.signature("t")
+		e.uint64(v)
+	case []uint32:
+		e.signature("au")
+		e.array(4, func() {
+			for _, n := range v {
+				e.uint32(n)
+			}
+		})
+	default:
+		return fmt.Errorf("unsupported dbus variant type %T", value)
+	}
+	return nil
+}
+
+type dbusDecoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *dbusDecoder) align(n int) {
+	d.pos = (d.pos + n - 1) / n * n
+}
+
+func (d *dbusDecoder) byte() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.pos++
+	return d.buf[d.pos-1], nil
+}
+
+func (d *dbusDecoder) uint32() (uint32, error) {
+	d.align(4)
+	if d.pos+4 > len(d.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	d.pos += 4
+	return d.order.Uint32(d.buf[d.pos-4:]), nil
+}
+
+func (d *dbusDecoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if d.pos+int(n)+1 > len(d.buf) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+func (d *dbusDecoder) signature() (string, error) {
+	n, err := d.byte()
+	if err != nil {
+		return "", err
+	}
+	if d.pos+int(n)+1 > len(d.buf) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
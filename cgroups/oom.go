@@ -0,0 +1,160 @@
+package cgroups
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"./subsystems"
+)
+
+// NotifyOOM sends on the channel each time the memory cgroup runs out of
+// memory, and closes it once the cgroup is removed. v1 registers an eventfd
+// on memory.oom_control, v2 watches memory.events.
+func (c *CgroupManager) NotifyOOM() (<-chan struct{}, error) {
+	if subsystems.FindCgroupMountpoint("memory") != "" {
+		return c.notifyOOMv1()
+	}
+	return c.notifyOOMv2()
+}
+
+// OOMKillCount is how many processes the OOM killer killed in the cgroup,
+// false when the kernel doesn't count them
+func (c *CgroupManager) OOMKillCount() (uint64, bool) {
+	file := ""
+	if subsystems.FindCgroupMountpoint("memory") != "" {
+		memoryPath, err := subsystems.GetCgroupPath("memory", c.Path, false)
+		if err != nil {
+			return 0, false
+		}
+		file = path.Join(memoryPath, "memory.oom_control")
+	} else {
+		file = path.Join(subsystems.FindCgroup2Mountpoint(), c.Path, "memory.events")
+	}
+	values, err := readFlatKeyed(file)
+	if err != nil {
+		return 0, false
+	}
+	count, ok := values["oom_kill"]
+	return count, ok
+}
+
+func (c *CgroupManager) notifyOOMv1() (<-chan struct{}, error) {
+	memoryPath, err := subsystems.GetCgroupPath("memory", c.Path, false)
+	if err != nil {
+		return nil, err
+	}
+	oomControl, err := os.Open(path.Join(memoryPath, "memory.oom_control"))
+	if err != nil {
+		return nil, err
+	}
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		oomControl.Close()
+		return nil, fmt.Errorf("eventfd error %v", errno)
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+	registration := fmt.Sprintf("%d %d", eventfd.Fd(), oomControl.Fd())
+	if err := ioutil.WriteFile(path.Join(memoryPath, "cgroup.event_control"), []byte(registration), 0644); err != nil {
+		eventfd.Close()
+		oomControl.Close()
+		return nil, fmt.Errorf("register oom notification error %v", err)
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		defer func() {
+			close(ch)
+			eventfd.Close()
+			oomControl.Close()
+		}()
+		buf := make([]byte, 8)
+		for {
+			if _, err := eventfd.Read(buf); err != nil {
+				return
+			}
+			// removing the cgroup signals the eventfd too
+			if _, err := os.Stat(path.Join(memoryPath, "cgroup.event_control")); os.IsNotExist(err) {
+				return
+			}
+			ch <- struct{}{}
+		}
+	}()
+	return ch, nil
+}
+
+func (c *CgroupManager) notifyOOMv2() (<-chan struct{}, error) {
+	root := subsystems.FindCgroup2Mountpoint()
+	if root == "" {
+		return nil, fmt.Errorf("no memory cgroup mounted")
+	}
+	events := path.Join(root, c.Path, "memory.events")
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init error %v", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, events, syscall.IN_MODIFY); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("watch %s error %v", events, err)
+	}
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	values, _ := readFlatKeyed(events)
+	last := values["oom"]
+
+	ch := make(chan struct{})
+	go func() {
+		defer func() {
+			close(ch)
+			inotify.Close()
+		}()
+		buf := make([]byte, syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)
+		for {
+			n, err := inotify.Read(buf)
+			if err != nil || n < syscall.SizeofInotifyEvent {
+				return
+			}
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+			// the watch goes away with the cgroup
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			values, err := readFlatKeyed(events)
+			if err != nil {
+				return
+			}
+			// memory.events changes for high and max too, only a new oom counts
+			if values["oom"] > last {
+				last = values["oom"]
+				ch <- struct{}{}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// readFlatKeyed reads "key value" lines like memory.oom_control and memory.events
+func readFlatKeyed(file string) (map[string]uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,127 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"./subsystems"
+)
+
+// MemoryUsage reads what the memory cgroup accounts, usage and limit in bytes.
+// No limit reads as a huge number, on v2 too.
+func (c *CgroupManager) MemoryUsage() (uint64, uint64, error) {
+	usageFile, limitFile := "memory.usage_in_bytes", "memory.limit_in_bytes"
+	if subsystems.FindCgroupMountpoint("memory") == "" {
+		usageFile, limitFile = "memory.current", "memory.max"
+	}
+	memoryPath, _, err := subsystems.SubsystemPath("memory", c.Path, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	usage, err := readUint(path.Join(memoryPath, usageFile))
+	if err != nil {
+		return 0, 0, err
+	}
+	content, err := ioutil.ReadFile(path.Join(memoryPath, limitFile))
+	if err != nil {
+		return 0, 0, err
+	}
+	if strings.TrimSpace(string(content)) == "max" {
+		return usage, math.MaxInt64, nil
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return usage, limit, nil
+}
+
+func readUint(file string) (uint64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// CpuUsage reads the cpu time the cgroup's tasks used, in nanoseconds, from
+// cpuacct.usage or the usage_usec of cpu.stat on v2
+func (c *CgroupManager) CpuUsage() (uint64, error) {
+	cpuPath, v2, err := subsystems.SubsystemPath("cpuacct", c.Path, false)
+	if err != nil {
+		return 0, err
+	}
+	if !v2 {
+		return readUint(path.Join(cpuPath, "cpuacct.usage"))
+	}
+	// cpu.stat is there without the cpu controller
+	stat, err := readFlatKeyed(path.Join(cpuPath, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+	usage, ok := stat["usage_usec"]
+	if !ok {
+		return 0, fmt.Errorf("no usage_usec in %s", path.Join(cpuPath, "cpu.stat"))
+	}
+	return usage * 1000, nil
+}
+
+// IoUsage reads the bytes the cgroup's tasks read from and wrote to block
+// devices, summed over the devices of blkio.throttle.io_service_bytes or io.stat
+func (c *CgroupManager) IoUsage() (uint64, uint64, error) {
+	ioPath, v2, err := subsystems.SubsystemPath("blkio", c.Path, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	file := path.Join(ioPath, "blkio.throttle.io_service_bytes")
+	if v2 {
+		file = path.Join(ioPath, "io.stat")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	var read, write uint64
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if v2 {
+			// 8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0
+			for _, field := range fields {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				value, err := strconv.ParseUint(kv[1], 10, 64)
+				if err != nil {
+					continue
+				}
+				switch kv[0] {
+				case "rbytes":
+					read += value
+				case "wbytes":
+					write += value
+				}
+			}
+			continue
+		}
+		// 8:0 Read 1, the devices end with a Total line of their own
+		if len(fields) != 3 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[1] {
+		case "Read":
+			read += value
+		case "Write":
+			write += value
+		}
+	}
+	return read, write, nil
+}
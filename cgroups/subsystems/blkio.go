@@ -0,0 +1,121 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type BlkioSubSystem struct {
+}
+
+func (s *BlkioSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if v2 {
+			return s.setV2(subsysCgroupPath, res)
+		}
+		if res.BlkioWeight != "" {
+			// kernels scheduling with bfq only have its own weight file
+			file := path.Join(subsysCgroupPath, "blkio.weight")
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				file = path.Join(subsysCgroupPath, "blkio.bfq.weight")
+			}
+			if err := ioutil.WriteFile(file, []byte(res.BlkioWeight), 0644); err != nil {
+				return fmt.Errorf("set cgroup blkio weight fail %v", err)
+			}
+		}
+		for file, rules := range map[string][]string{
+			"blkio.throttle.read_bps_device":   res.BlkioReadBps,
+			"blkio.throttle.write_bps_device":  res.BlkioWriteBps,
+			"blkio.throttle.read_iops_device":  res.BlkioReadIops,
+			"blkio.throttle.write_iops_device": res.BlkioWriteIops,
+		} {
+			// one "major:minor rate" per write
+			for _, rule := range rules {
+				if err := ioutil.WriteFile(path.Join(subsysCgroupPath, file), []byte(rule), 0644); err != nil {
+					return fmt.Errorf("set cgroup %s %q fail %v", file, rule, err)
+				}
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+// setV2 writes the limits to the files of the io controller: the weight to
+// io.bfq.weight or, scaled from 10..1000 to 1..10000, io.weight, and the
+// throttles of a device as "major:minor rbps=N" to io.max
+func (s *BlkioSubSystem) setV2(subsysCgroupPath string, res *ResourceConfig) error {
+	throttles := []struct {
+		key   string
+		rules []string
+	}{
+		{"rbps", res.BlkioReadBps},
+		{"wbps", res.BlkioWriteBps},
+		{"riops", res.BlkioReadIops},
+		{"wiops", res.BlkioWriteIops},
+	}
+	hasThrottles := false
+	for _, throttle := range throttles {
+		hasThrottles = hasThrottles || len(throttle.rules) > 0
+	}
+	if res.BlkioWeight == "" && !hasThrottles {
+		return nil
+	}
+	if err := checkController(subsysCgroupPath, "io"); err != nil {
+		return err
+	}
+	if res.BlkioWeight != "" {
+		file, value := path.Join(subsysCgroupPath, "io.bfq.weight"), res.BlkioWeight
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			weight, err := strconv.ParseUint(res.BlkioWeight, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid blkio weight %q", res.BlkioWeight)
+			}
+			file, value = path.Join(subsysCgroupPath, "io.weight"), "default "+strconv.FormatUint(1+(weight-10)*9999/990, 10)
+		}
+		if err := ioutil.WriteFile(file, []byte(value), 0644); err != nil {
+			return fmt.Errorf("set cgroup io weight fail %v", err)
+		}
+	}
+	for _, throttle := range throttles {
+		for _, rule := range throttle.rules {
+			fields := strings.Fields(rule)
+			if len(fields) != 2 {
+				return fmt.Errorf("invalid throttle rule %q", rule)
+			}
+			value := fields[0] + " " + throttle.key + "=" + fields[1]
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "io.max"), []byte(value), 0644); err != nil {
+				return fmt.Errorf("set cgroup io.max %q fail %v", value, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BlkioSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *BlkioSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+func (s *BlkioSubSystem) Name() string {
+	return "blkio"
+}
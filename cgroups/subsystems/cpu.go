@@ -3,38 +3,106 @@ package subsystems
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 type CpuSubSystem struct {
 }
 
 func (s *CpuSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if v2 {
+			return s.setV2(subsysCgroupPath, res)
+		}
 		if res.CpuShare != "" {
 			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.shares"), []byte(res.CpuShare), 0644); err != nil {
 				return fmt.Errorf("set cgroup cpu share fail %v", err)
 			}
 		}
+		// the quota is checked against the period, set that first
+		if res.CpuPeriod != "" {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.cfs_period_us"), []byte(res.CpuPeriod), 0644); err != nil {
+				return fmt.Errorf("set cgroup cpu period fail %v", err)
+			}
+		}
+		if res.CpuQuota != "" {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.cfs_quota_us"), []byte(res.CpuQuota), 0644); err != nil {
+				return fmt.Errorf("set cgroup cpu quota fail %v", err)
+			}
+		}
 		return nil
 	} else {
 		return err
 	}
 }
 
+// setV2 writes the limits to the v2 files: the shares become cpu.weight, the
+// quota and period go together in cpu.max
+func (s *CpuSubSystem) setV2(subsysCgroupPath string, res *ResourceConfig) error {
+	if res.CpuShare == "" && res.CpuPeriod == "" && res.CpuQuota == "" {
+		return nil
+	}
+	if err := checkController(subsysCgroupPath, s.Name()); err != nil {
+		return err
+	}
+	if res.CpuShare != "" {
+		shares, err := strconv.ParseUint(res.CpuShare, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cpu shares %q", res.CpuShare)
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.weight"), []byte(strconv.FormatUint(SharesToWeight(shares), 10)), 0644); err != nil {
+			return fmt.Errorf("set cgroup cpu weight fail %v", err)
+		}
+	}
+	if res.CpuPeriod == "" && res.CpuQuota == "" {
+		return nil
+	}
+	// "quota period", a quota alone keeps the period and a period needs the quota
+	quota := res.CpuQuota
+	if quota == "-1" {
+		quota = "max"
+	}
+	if quota == "" {
+		content, err := ioutil.ReadFile(path.Join(subsysCgroupPath, "cpu.max"))
+		if err != nil {
+			return err
+		}
+		quota = strings.Fields(string(content))[0]
+	}
+	value := quota
+	if res.CpuPeriod != "" {
+		value += " " + res.CpuPeriod
+	}
+	if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpu.max"), []byte(value), 0644); err != nil {
+		return fmt.Errorf("set cgroup cpu max fail %v", err)
+	}
+	return nil
+}
+
+// SharesToWeight maps cpu shares, 2 to 262144, onto cpu.weight, 1 to 10000
+func SharesToWeight(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + (shares-2)*9999/262142
+}
+
 func (s *CpuSubSystem) Remove(cgroupPath string) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
-		return os.RemoveAll(subsysCgroupPath)
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
 	} else {
 		return err
 	}
 }
 
 func (s *CpuSubSystem) Apply(cgroupPath string, pid int) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
-		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
 			return fmt.Errorf("set cgroup proc fail %v", err)
 		}
 		return nil
@@ -0,0 +1,41 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+// CpuacctSubSystem only accounts, stats reads the cpu time of the container
+// from it. Its hierarchy is mounted apart from cpu on some hosts.
+type CpuacctSubSystem struct {
+}
+
+// Set does nothing, cpuacct has no limits
+func (s *CpuacctSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	return nil
+}
+
+func (s *CpuacctSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *CpuacctSubSystem) Apply(cgroupPath string, pid int) error {
+	subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true)
+	if err != nil {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+	if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("set cgroup proc fail %v", err)
+	}
+	return nil
+}
+
+func (s *CpuacctSubSystem) Name() string {
+	return "cpuacct"
+}
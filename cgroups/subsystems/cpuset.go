@@ -3,16 +3,32 @@ package subsystems
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 type CpusetSubSystem struct {
 }
 
 func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if v2 {
+			// an empty cpuset.cpus of v2 uses the parent's
+			if res.CpuSet == "" {
+				return nil
+			}
+			if err := checkController(subsysCgroupPath, s.Name()); err != nil {
+				return err
+			}
+		} else {
+			// a new v1 cpuset has no cpus and mems, no task can join it until they are set
+			for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+				if err := inheritCpuset(subsysCgroupPath, file); err != nil {
+					return err
+				}
+			}
+		}
 		if res.CpuSet != "" {
 			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpuset.cpus"), []byte(res.CpuSet), 0644); err != nil {
 				return fmt.Errorf("set cgroup cpuset fail %v", err)
@@ -25,16 +41,16 @@ func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 }
 
 func (s *CpusetSubSystem) Remove(cgroupPath string) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
-		return os.RemoveAll(subsysCgroupPath)
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
 	} else {
 		return err
 	}
 }
 
 func (s *CpusetSubSystem) Apply(cgroupPath string, pid int) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
-		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
 			return fmt.Errorf("set cgroup proc fail %v", err)
 		}
 		return nil
@@ -46,3 +62,25 @@ func (s *CpusetSubSystem) Apply(cgroupPath string, pid int) error {
 func (s *CpusetSubSystem) Name() string {
 	return "cpuset"
 }
+
+// inheritCpuset copies file from the parent when it is empty, up from the root if needed
+func inheritCpuset(cgroupDir string, file string) error {
+	content, err := ioutil.ReadFile(path.Join(cgroupDir, file))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(content)) != "" {
+		return nil
+	}
+	parent := path.Dir(cgroupDir)
+	if err := inheritCpuset(parent, file); err != nil {
+		return err
+	}
+	if content, err = ioutil.ReadFile(path.Join(parent, file)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(cgroupDir, file), content, 0644); err != nil {
+		return fmt.Errorf("set cgroup %s fail %v", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+)
+
+type DevicesSubSystem struct {
+}
+
+// Set denies every device, then allows the rules one by one.
+// No rules leaves the cgroup as it is, allowing what its parent allows.
+func (s *DevicesSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if len(res.Devices) == 0 {
+		return nil
+	}
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		// v2 controls devices with an eBPF program attached to the cgroup.
+		// Programs add up, the rules are only set once, at run.
+		if v2 {
+			return setDeviceFilter(subsysCgroupPath, res.Devices)
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "devices.deny"), []byte("a"), 0644); err != nil {
+			return fmt.Errorf("set cgroup devices deny fail %v", err)
+		}
+		// the kernel takes one rule per write
+		for _, rule := range res.Devices {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "devices.allow"), []byte(rule), 0644); err != nil {
+				return fmt.Errorf("set cgroup devices allow %q fail %v", rule, err)
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (s *DevicesSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *DevicesSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+func (s *DevicesSubSystem) Name() string {
+	return "devices"
+}
@@ -0,0 +1,231 @@
+package subsystems
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// cgroup v2 has no devices.allow, a BPF_PROG_TYPE_CGROUP_DEVICE program
+// attached to the cgroup decides instead. It gets a bpf_cgroup_dev_ctx:
+// the access and device type in one word, then the major and the minor.
+
+const (
+	bpfProgLoad   = 5
+	bpfProgAttach = 8
+
+	bpfProgTypeCgroupDevice   = 15
+	bpfAttachTypeCgroupDevice = 6
+	// programs of the parents run too, systemd attaches its own with it
+	bpfFAllowMulti = 2
+
+	bpfDevcgDevBlock  = 1
+	bpfDevcgDevChar   = 2
+	bpfDevcgAccMknod  = 1
+	bpfDevcgAccRead   = 2
+	bpfDevcgAccWrite  = 4
+	bpfDevcgAccessAll = bpfDevcgAccMknod | bpfDevcgAccRead | bpfDevcgAccWrite
+
+	// eBPF opcodes
+	ebpfLdxMemW  = 0x61 // dst = *(u32 *)(src + off)
+	ebpfAndK     = 0x57
+	ebpfRshK     = 0x77
+	ebpfMovK     = 0xb7
+	ebpfMovX     = 0xbf
+	ebpfJneK     = 0x55
+	ebpfExit     = 0x95
+	ebpfRegCtx   = 1
+	ebpfRegRet   = 0
+	ebpfRegType  = 2
+	ebpfRegAcc   = 3
+	ebpfRegMajor = 4
+	ebpfRegMinor = 5
+	ebpfRegTmp   = 6
+)
+
+// ebpfInsn is struct bpf_insn
+type ebpfInsn struct {
+	Code uint8
+	Regs uint8 // dst in the low nibble, src in the high one
+	Off  int16
+	Imm  int32
+}
+
+func ebpf(code uint8, dst uint8, src uint8, off int16, imm int32) ebpfInsn {
+	return ebpfInsn{Code: code, Regs: dst | src<<4, Off: off, Imm: imm}
+}
+
+// deviceRule is a devices.allow line, -1 stands for a * major or minor
+type deviceRule struct {
+	kind   byte // a, b or c
+	major  int64
+	minor  int64
+	access int32
+}
+
+func parseDeviceRule(rule string) (deviceRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) == 1 && fields[0] == "a" {
+		return deviceRule{kind: 'a', major: -1, minor: -1, access: bpfDevcgAccessAll}, nil
+	}
+	if len(fields) != 3 || len(fields[0]) != 1 || !strings.Contains("abc", fields[0]) {
+		return deviceRule{}, fmt.Errorf("invalid device rule %q", rule)
+	}
+	parsed := deviceRule{kind: fields[0][0]}
+	numbers := strings.Split(fields[1], ":")
+	if len(numbers) != 2 {
+		return deviceRule{}, fmt.Errorf("invalid device rule %q", rule)
+	}
+	for i, to := range []*int64{&parsed.major, &parsed.minor} {
+		if numbers[i] == "*" {
+			*to = -1
+			continue
+		}
+		n, err := strconv.ParseInt(numbers[i], 10, 32)
+		if err != nil || n < 0 {
+			return deviceRule{}, fmt.Errorf("invalid device rule %q", rule)
+		}
+		*to = n
+	}
+	for _, c := range fields[2] {
+		switch c {
+		case 'm':
+			parsed.access |= bpfDevcgAccMknod
+		case 'r':
+			parsed.access |= bpfDevcgAccRead
+		case 'w':
+			parsed.access |= bpfDevcgAccWrite
+		default:
+			return deviceRule{}, fmt.Errorf("invalid device rule %q", rule)
+		}
+	}
+	return parsed, nil
+}
+
+// deviceFilter builds the program allowing what the rules allow and denying
+// everything else, like "a" in devices.deny followed by the rules
+func deviceFilter(rules []string) ([]ebpfInsn, error) {
+	insns := []ebpfInsn{
+		ebpf(ebpfLdxMemW, ebpfRegType, ebpfRegCtx, 0, 0),
+		ebpf(ebpfAndK, ebpfRegType, 0, 0, 0xffff),
+		ebpf(ebpfLdxMemW, ebpfRegAcc, ebpfRegCtx, 0, 0),
+		ebpf(ebpfRshK, ebpfRegAcc, 0, 0, 16),
+		ebpf(ebpfLdxMemW, ebpfRegMajor, ebpfRegCtx, 4, 0),
+		ebpf(ebpfLdxMemW, ebpfRegMinor, ebpfRegCtx, 8, 0),
+	}
+	for _, rule := range rules {
+		parsed, err := parseDeviceRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		// the checks jump past the block when they don't match, off is
+		// filled in once its length is known
+		var block []ebpfInsn
+		switch parsed.kind {
+		case 'b':
+			block = append(block, ebpf(ebpfJneK, ebpfRegType, 0, 0, bpfDevcgDevBlock))
+		case 'c':
+			block = append(block, ebpf(ebpfJneK, ebpfRegType, 0, 0, bpfDevcgDevChar))
+		}
+		if parsed.access != bpfDevcgAccessAll {
+			// all of the access asked for must be allowed
+			block = append(block,
+				ebpf(ebpfMovX, ebpfRegTmp, ebpfRegAcc, 0, 0),
+				ebpf(ebpfAndK, ebpfRegTmp, 0, 0, ^parsed.access&bpfDevcgAccessAll),
+				ebpf(ebpfJneK, ebpfRegTmp, 0, 0, 0))
+		}
+		if parsed.major >= 0 {
+			block = append(block, ebpf(ebpfJneK, ebpfRegMajor, 0, 0, int32(parsed.major)))
+		}
+		if parsed.minor >= 0 {
+			block = append(block, ebpf(ebpfJneK, ebpfRegMinor, 0, 0, int32(parsed.minor)))
+		}
+		block = append(block, ebpf(ebpfMovK, ebpfRegRet, 0, 0, 1), ebpf(ebpfExit, 0, 0, 0, 0))
+		for i := range block {
+			if block[i].Code == ebpfJneK {
+				block[i].Off = int16(len(block) - i - 1)
+			}
+		}
+		insns = append(insns, block...)
+	}
+	return append(insns, ebpf(ebpfMovK, ebpfRegRet, 0, 0, 0), ebpf(ebpfExit, 0, 0, 0, 0)), nil
+}
+
+// bpfProgLoadAttr is the start of union bpf_attr for BPF_PROG_LOAD, the
+// kernel takes the fields it knows
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	if sysBpf == 0 {
+		return 0, fmt.Errorf("bpf is not supported on %s", runtime.GOARCH)
+	}
+	fd, _, errno := syscall.Syscall(sysBpf, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return fd, nil
+}
+
+// setDeviceFilter attaches the program of the rules to the v2 cgroup at dir
+func setDeviceFilter(dir string, rules []string) error {
+	insns, err := deviceFilter(rules)
+	if err != nil {
+		return err
+	}
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+	loadAttr := bpfProgLoadAttr{
+		progType: bpfProgTypeCgroupDevice,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	progFd, err := bpf(bpfProgLoad, unsafe.Pointer(&loadAttr), unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		verifierLog := strings.TrimRight(string(logBuf), "\x00\n")
+		return fmt.Errorf("load device filter error %v %s", err, verifierLog)
+	}
+	defer syscall.Close(int(progFd))
+
+	cgroup, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer cgroup.Close()
+	attachAttr := bpfProgAttachAttr{
+		targetFd:    uint32(cgroup.Fd()),
+		attachBpfFd: uint32(progFd),
+		attachType:  bpfAttachTypeCgroupDevice,
+		attachFlags: bpfFAllowMulti,
+	}
+	if _, err := bpf(bpfProgAttach, unsafe.Pointer(&attachAttr), unsafe.Sizeof(attachAttr)); err != nil {
+		return fmt.Errorf("attach device filter to %s error %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+package subsystems
+
+// sysBpf is the number of bpf(2), the syscall package doesn't have it
+const sysBpf = 280
@@ -0,0 +1,9 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package subsystems
+
+// Device rules can't be enforced on cgroup v2 on this architecture, setting
+// them fails rather than leaving every device open
+
+const sysBpf = 0
@@ -0,0 +1,81 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestParseDeviceRule(t *testing.T) {
+	for rule, want := range map[string]deviceRule{
+		"a":           {'a', -1, -1, bpfDevcgAccessAll},
+		"c *:* m":     {'c', -1, -1, bpfDevcgAccMknod},
+		"c 136:* rwm": {'c', 136, -1, bpfDevcgAccessAll},
+		"b 8:0 rw":    {'b', 8, 0, bpfDevcgAccRead | bpfDevcgAccWrite},
+	} {
+		got, err := parseDeviceRule(rule)
+		if err != nil {
+			t.Errorf("%q: %v", rule, err)
+		} else if got != want {
+			t.Errorf("%q = %+v, want %+v", rule, got, want)
+		}
+	}
+	for _, rule := range []string{"", "x 1:3 rwm", "c 1 rwm", "c 1:3 rwx", "c -1:3 r", "c 1:3"} {
+		if _, err := parseDeviceRule(rule); err == nil {
+			t.Errorf("no error for %q", rule)
+		}
+	}
+}
+
+// TestDeviceFilter runs commands in a v2 cgroup with the filter attached
+func TestDeviceFilter(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("attaching a device filter needs root")
+	}
+	root := FindCgroup2Mountpoint()
+	if root == "" {
+		t.Skip("no cgroup2 mounted")
+	}
+	dir := path.Join(root, fmt.Sprintf("mydocker-devtest-%d", os.Getpid()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Skipf("can't make a v2 cgroup: %v", err)
+	}
+	defer os.Remove(dir)
+	rules := []string{"c *:* m", "c 1:3 rwm", "c 1:5 r"}
+	if err := setDeviceFilter(dir, rules); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "devtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// in order, the last two use the node of /dev/zero made before them
+	for _, c := range []struct {
+		script  string
+		allowed bool
+	}{
+		{"head -c1 /dev/zero", true},
+		{"echo x > /dev/null", true},
+		{"echo x > /dev/zero", false},
+		{"head -c1 /dev/full", false},
+		{"mknod " + tmp + "/char c 1 5", true},
+		{"mknod " + tmp + "/block b 7 200", false},
+		{"head -c1 " + tmp + "/char", true},
+		{"echo x > " + tmp + "/char", false},
+	} {
+		// the shell moves itself into the cgroup first
+		cmd := exec.Command("sh", "-c", "echo $$ > "+path.Join(dir, "cgroup.procs")+" && "+c.script)
+		out, err := cmd.CombinedOutput()
+		if c.allowed && err != nil {
+			t.Errorf("%q denied: %v %s", c.script, err, out)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("%q allowed", c.script)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Freezer states, as freezer.state names them
+const (
+	Frozen = "FROZEN"
+	Thawed = "THAWED"
+)
+
+// FreezerSubSystem uses the v1 freezer hierarchy, or cgroup.freeze of the
+// cgroup v2 one on hosts without it
+type FreezerSubSystem struct {
+}
+
+// Set does nothing, containers start thawed and pause/unpause call Freeze
+func (s *FreezerSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	return nil
+}
+
+func (s *FreezerSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, _, err := s.path(cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *FreezerSubSystem) Apply(cgroupPath string, pid int) error {
+	subsysCgroupPath, v2, err := s.path(cgroupPath, true)
+	if err != nil {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+	if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("set cgroup proc fail %v", err)
+	}
+	return nil
+}
+
+func (s *FreezerSubSystem) Name() string {
+	return "freezer"
+}
+
+// Freeze moves every task of the cgroup to state, Frozen or Thawed, and waits
+// until the kernel got all of them there
+func (s *FreezerSubSystem) Freeze(cgroupPath string, state string) error {
+	subsysCgroupPath, v2, err := s.path(cgroupPath, false)
+	if err != nil {
+		return err
+	}
+	file, value, check, want := "freezer.state", state, "freezer.state", state
+	if v2 {
+		// cgroup.events has "frozen 1" once the last task stopped
+		file, check = "cgroup.freeze", "cgroup.events"
+		value, want = "0", "frozen 0"
+		if state == Frozen {
+			value, want = "1", "frozen 1"
+		}
+	}
+	// a task forking while we freeze can leave the cgroup FREEZING, writing again retries it
+	for i := 0; i < 1000; i++ {
+		if i%50 == 0 {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, file), []byte(value), 0644); err != nil {
+				return fmt.Errorf("set cgroup freezer %s fail %v", state, err)
+			}
+		}
+		content, err := ioutil.ReadFile(path.Join(subsysCgroupPath, check))
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.TrimSpace(line) == want {
+				return nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// don't leave it half frozen
+	if state == Frozen {
+		s.Freeze(cgroupPath, Thawed)
+	}
+	return fmt.Errorf("cgroup %s did not get %s in time", cgroupPath, state)
+}
+
+// path is the cgroup in the freezer hierarchy, v2 tells it is in the unified
+// one, where cgroup.freeze needs no controller
+func (s *FreezerSubSystem) path(cgroupPath string, autoCreate bool) (string, bool, error) {
+	return SubsystemPath(s.Name(), cgroupPath, autoCreate)
+}
@@ -0,0 +1,80 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// HugetlbSubSystem is optional, many kernels are built without it. Without
+// the hierarchy only a container asking for hugetlb limits fails.
+type HugetlbSubSystem struct {
+}
+
+func (s *HugetlbSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if len(res.HugetlbLimits) == 0 {
+		return nil
+	}
+	if !s.mounted() {
+		return fmt.Errorf("hugetlb cgroup is not mounted")
+	}
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		suffix := ".limit_in_bytes"
+		if v2 {
+			if err := checkController(subsysCgroupPath, s.Name()); err != nil {
+				return err
+			}
+			suffix = ".max"
+		}
+		// pagesize:bytes, the kernel names the file hugetlb.<pagesize>.limit_in_bytes, .max on v2
+		for _, limit := range res.HugetlbLimits {
+			parts := strings.SplitN(limit, ":", 2)
+			file := path.Join(subsysCgroupPath, "hugetlb."+parts[0]+suffix)
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				return fmt.Errorf("hugetlb page size %s is not supported", parts[0])
+			}
+			if err := ioutil.WriteFile(file, []byte(parts[1]), 0644); err != nil {
+				return fmt.Errorf("set cgroup hugetlb %s fail %v", parts[0], err)
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (s *HugetlbSubSystem) Remove(cgroupPath string) error {
+	if !s.mounted() {
+		return nil
+	}
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
+		return RemoveCgroup(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *HugetlbSubSystem) Apply(cgroupPath string, pid int) error {
+	if !s.mounted() {
+		return nil
+	}
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+func (s *HugetlbSubSystem) Name() string {
+	return "hugetlb"
+}
+
+func (s *HugetlbSubSystem) mounted() bool {
+	return FindCgroupMountpoint(s.Name()) != "" || FindCgroup2Mountpoint() != ""
+}
@@ -3,9 +3,9 @@ package subsystems
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -15,14 +15,70 @@ type MemorySubSystem struct {
 
 func (s *MemorySubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	//获取当前subsystem在虚拟文件系统中的路径
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
+		if v2 {
+			return s.setV2(subsysCgroupPath, res)
+		}
 		//logrus.Infof("[Memory Set Cgroup] %s", subsysCgroupPath)
 		// 如果设置了对应的内存限制
 		// 那么写入cgroup对应目录的memory.limit_in_bytes文件中
+		limit, swap := "", res.MemorySwap
 		if res.MemoryLimit != "" {
-			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.limit_in_bytes"), []byte(res.MemoryLimit), 0644); err != nil {
+			bytes, err := ParseBytes(res.MemoryLimit)
+			if err != nil {
+				return err
+			}
+			limit = strconv.FormatInt(bytes, 10)
+		}
+		if swap != "" && swap != "-1" {
+			bytes, err := ParseBytes(swap)
+			if err != nil {
+				return err
+			}
+			swap = strconv.FormatInt(bytes, 10)
+		}
+		setLimit := func() error {
+			if limit == "" {
+				return nil
+			}
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.limit_in_bytes"), []byte(limit), 0644); err != nil {
 				return fmt.Errorf("set cgroup memory failed %v", err)
 			}
+			return nil
+		}
+		setSwap := func() error {
+			if swap == "" {
+				return nil
+			}
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.memsw.limit_in_bytes"), []byte(swap), 0644); err != nil {
+				return fmt.Errorf("set cgroup memory+swap failed %v", err)
+			}
+			return nil
+		}
+		// memory+swap may never be below the memory limit: growing, it goes first
+		if err := setSwap(); err != nil {
+			if err := setLimit(); err != nil {
+				return err
+			}
+			if err := setSwap(); err != nil {
+				return err
+			}
+		} else if err := setLimit(); err != nil {
+			return err
+		}
+		if res.MemoryReservation != "" {
+			bytes, err := ParseBytes(res.MemoryReservation)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.soft_limit_in_bytes"), []byte(strconv.FormatInt(bytes, 10)), 0644); err != nil {
+				return fmt.Errorf("set cgroup memory reservation failed %v", err)
+			}
+		}
+		if res.OomKillDisable {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.oom_control"), []byte("1"), 0644); err != nil {
+				return fmt.Errorf("set cgroup oom kill disable failed %v", err)
+			}
 		}
 		return nil
 	} else {
@@ -30,6 +86,77 @@ func (s *MemorySubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	}
 }
 
+// setV2 writes the limits to the v2 files. memory.swap.max is the swap alone,
+// not memory+swap like memory.memsw.limit_in_bytes, and the reservation is
+// memory.low.
+func (s *MemorySubSystem) setV2(subsysCgroupPath string, res *ResourceConfig) error {
+	if res.MemoryLimit == "" && res.MemorySwap == "" && res.MemoryReservation == "" && !res.OomKillDisable {
+		return nil
+	}
+	if err := checkController(subsysCgroupPath, s.Name()); err != nil {
+		return err
+	}
+	limit := int64(-1)
+	if res.MemoryLimit != "" {
+		bytes, err := ParseBytes(res.MemoryLimit)
+		if err != nil {
+			return err
+		}
+		limit = bytes
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.max"), []byte(strconv.FormatInt(limit, 10)), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory failed %v", err)
+		}
+	}
+	if res.MemorySwap != "" {
+		swap := "max"
+		if res.MemorySwap != "-1" {
+			total, err := ParseBytes(res.MemorySwap)
+			if err != nil {
+				return err
+			}
+			// update may change the swap alone, it is on top of the limit set before
+			if limit < 0 {
+				if limit, err = readLimit(path.Join(subsysCgroupPath, "memory.max")); err != nil {
+					return err
+				}
+			}
+			if limit < 0 || total < limit {
+				return fmt.Errorf("memory+swap %s needs a memory limit below it", res.MemorySwap)
+			}
+			swap = strconv.FormatInt(total-limit, 10)
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.swap.max"), []byte(swap), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory+swap failed %v", err)
+		}
+	}
+	if res.MemoryReservation != "" {
+		bytes, err := ParseBytes(res.MemoryReservation)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.low"), []byte(strconv.FormatInt(bytes, 10)), 0644); err != nil {
+			return fmt.Errorf("set cgroup memory reservation failed %v", err)
+		}
+	}
+	if res.OomKillDisable {
+		logrus.Warnf("cgroup v2 can't disable the OOM killer, ignoring oom-kill-disable")
+	}
+	return nil
+}
+
+// readLimit reads a v2 limit file, "max" is -1
+func readLimit(file string) (int64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "max" {
+		return -1, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
 func (s *MemorySubSystem) Name() string {
 	return "memory"
 }
@@ -37,10 +164,10 @@ func (s *MemorySubSystem) Name() string {
 func (s *MemorySubSystem) Remove(cgroupPath string) error {
 	//logrus.Infof("[Memory::Remove() Cgroup PATH] %s", path.Join(s.Name(), cgroupPath))
 
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+	if subsysCgroupPath, _, err := SubsystemPath(s.Name(), cgroupPath, false); err == nil {
 		//logrus.Infof("[Memory Remove Cgroup SUCCESS] %s", subsysCgroupPath)
 		//删除cgroupPath 对应的目录
-		return os.Remove(subsysCgroupPath)
+		return RemoveCgroup(subsysCgroupPath)
 	} else {
 		//subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
 		logrus.Infof("[Memory Remove Cgroup FAILED] %s", subsysCgroupPath)
@@ -49,11 +176,10 @@ func (s *MemorySubSystem) Remove(cgroupPath string) error {
 }
 
 func (s *MemorySubSystem) Apply(cgroupPath string, pid int) error {
-	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+	if subsysCgroupPath, v2, err := SubsystemPath(s.Name(), cgroupPath, true); err == nil {
 		//writePath := path.Join(subsysCgroupPath, "tasks")
 		//logrus.Infof("[Memroy Apply Cgroup] %s", writePath)
-		if err := ioutil.WriteFile(
-			path.Join(subsysCgroupPath, "tasks"),
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, procsFile(v2)),
 			[]byte(strconv.Itoa(pid)),
 			0644); err != nil {
 			return fmt.Errorf("set cgroup failed %v", err)
@@ -1,9 +1,24 @@
 package subsystems
 
 type ResourceConfig struct {
-	MemoryLimit string
-	CpuShare    string
-	CpuSet      string
+	MemoryLimit       string `json:"memoryLimit,omitempty"`
+	MemorySwap        string `json:"memorySwap,omitempty"`        // memory+swap, -1 for unlimited
+	MemoryReservation string `json:"memoryReservation,omitempty"` // soft limit, enforced under memory pressure
+	OomKillDisable    bool   `json:"oomKillDisable,omitempty"`
+	CpuShare          string `json:"cpuShare,omitempty"`
+	CpuPeriod         string `json:"cpuPeriod,omitempty"` // microseconds
+	CpuQuota          string `json:"cpuQuota,omitempty"`  // microseconds per period, -1 for unlimited
+	CpuSet            string `json:"cpuSet,omitempty"`
+	PidsLimit         string `json:"pidsLimit,omitempty"` // 0 or -1 for unlimited
+
+	BlkioWeight    string   `json:"blkioWeight,omitempty"`    // 10 to 1000
+	BlkioReadBps   []string `json:"blkioReadBps,omitempty"`   // "major:minor bytes" per second
+	BlkioWriteBps  []string `json:"blkioWriteBps,omitempty"`  // "major:minor bytes" per second
+	BlkioReadIops  []string `json:"blkioReadIops,omitempty"`  // "major:minor operations" per second
+	BlkioWriteIops []string `json:"blkioWriteIops,omitempty"` // "major:minor operations" per second
+	HugetlbLimits  []string `json:"hugetlbLimits,omitempty"`  // "pagesize:bytes", like 2MB:1073741824
+
+	Devices []string `json:"devices,omitempty"` // devices.allow rules, everything else is denied
 }
 
 //subsystem的接口（可实现）
@@ -20,5 +35,11 @@ var (
 		&CpusetSubSystem{},
 		&MemorySubSystem{},
 		&CpuSubSystem{},
+		&CpuacctSubSystem{},
+		&DevicesSubSystem{},
+		&FreezerSubSystem{},
+		&PidsSubSystem{},
+		&BlkioSubSystem{},
+		&HugetlbSubSystem{},
 	}
 )
@@ -3,9 +3,11 @@ package subsystems
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -22,6 +24,10 @@ func FindCgroupMountpoint(subsystem string) string {
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		txt := scanner.Text()
+		// only v1 hierarchies, the options of cgroup2 are no controllers
+		if !strings.Contains(txt, " - cgroup ") {
+			continue
+		}
 		fields := strings.Split(txt, " ")
 		for _, opt := range strings.Split(fields[len(fields)-1], ",") {
 			if opt == subsystem {
@@ -36,14 +42,37 @@ func FindCgroupMountpoint(subsystem string) string {
 	return ""
 }
 
+// FindCgroup2Mountpoint finds the unified hierarchy, /sys/fs/cgroup on v2
+// hosts and usually /sys/fs/cgroup/unified on hybrid ones
+func FindCgroup2Mountpoint() string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		logrus.Errorf(err.Error())
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// the filesystem type follows the " - " separator
+		fields := strings.Split(scanner.Text(), " - ")
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "cgroup2 ") {
+			return strings.Split(fields[0], " ")[4]
+		}
+	}
+	return ""
+}
+
 //获得cgroup对应的绝对路径
 
 func GetCgroupPath(subsystem string, cgroupPath string, autoCreate bool) (string, error) {
 	cgroupRoot := FindCgroupMountpoint(subsystem)
+	if cgroupRoot == "" {
+		return "", fmt.Errorf("no %s cgroup mounted", subsystem)
+	}
 	//logrus.Infof("[GetCgroupPath] /%s/%s", cgroupRoot, cgroupPath)
 	if _, err := os.Stat(path.Join(cgroupRoot, cgroupPath)); err == nil || (autoCreate && os.IsNotExist(err)) {
 		if os.IsNotExist(err) {
-			if err := os.Mkdir(path.Join(cgroupRoot, cgroupPath), 0755); err == nil {
+			if err := os.MkdirAll(path.Join(cgroupRoot, cgroupPath), 0755); err == nil {
 			} else {
 				return "", fmt.Errorf("error create cgroup %v", err)
 			}
@@ -53,3 +82,117 @@ func GetCgroupPath(subsystem string, cgroupPath string, autoCreate bool) (string
 		return "", fmt.Errorf("cgroup path error %v", err)
 	}
 }
+
+// GetCgroup2Path is GetCgroupPath for the unified hierarchy. A v2 cgroup only
+// gets the controllers its parent enabled in cgroup.subtree_control, so
+// autoCreate enables the ones the parent has on each level it makes.
+func GetCgroup2Path(cgroupPath string, autoCreate bool) (string, error) {
+	root := FindCgroup2Mountpoint()
+	if root == "" {
+		return "", fmt.Errorf("no cgroup2 mounted")
+	}
+	dir := root
+	for _, name := range strings.Split(path.Clean("/"+cgroupPath), "/") {
+		if name == "" {
+			continue
+		}
+		parent := dir
+		dir = path.Join(dir, name)
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		} else if !autoCreate || !os.IsNotExist(err) {
+			return "", fmt.Errorf("cgroup path error %v", err)
+		}
+		enableControllers(parent)
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("error create cgroup %v", err)
+		}
+	}
+	return dir, nil
+}
+
+// SubsystemPath is the cgroup of a subsystem in its v1 hierarchy, or in the
+// unified one on hosts without it; v2 tells which, their files differ
+func SubsystemPath(subsystem string, cgroupPath string, autoCreate bool) (string, bool, error) {
+	if FindCgroupMountpoint(subsystem) != "" {
+		subsysCgroupPath, err := GetCgroupPath(subsystem, cgroupPath, autoCreate)
+		return subsysCgroupPath, false, err
+	}
+	if FindCgroup2Mountpoint() == "" {
+		return "", false, fmt.Errorf("no %s cgroup mounted", subsystem)
+	}
+	subsysCgroupPath, err := GetCgroup2Path(cgroupPath, autoCreate)
+	return subsysCgroupPath, true, err
+}
+
+// procsFile is where a pid is written to move it into a cgroup
+func procsFile(v2 bool) string {
+	if v2 {
+		return "cgroup.procs"
+	}
+	return "tasks"
+}
+
+// checkController fails unless the parent of a v2 cgroup enabled controller
+// for it, without it the limit files are not there
+func checkController(dir string, controller string) error {
+	content, err := ioutil.ReadFile(path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Fields(string(content)) {
+		if name == controller {
+			return nil
+		}
+	}
+	return fmt.Errorf("cgroup v2 controller %s is not enabled in %s", controller, dir)
+}
+
+// enableControllers passes the controllers of a v2 cgroup down to its
+// children. A cgroup with processes of its own can't, other than the root, so
+// that is left to cgroups that only hold others.
+func enableControllers(dir string) {
+	content, err := ioutil.ReadFile(path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return
+	}
+	for _, controller := range strings.Fields(string(content)) {
+		if err := ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+			logrus.Debugf("enable controller %s in %s error %v", controller, dir, err)
+		}
+	}
+}
+
+// RemoveEmptyParents removes the parents of cgroupPath in the hierarchy
+// mounted at root, from the innermost up, until one still has tasks or children
+func RemoveEmptyParents(root string, cgroupPath string) {
+	if root == "" {
+		return
+	}
+	for dir := path.Dir(path.Clean("/" + cgroupPath)); dir != "/"; dir = path.Dir(dir) {
+		// rmdir fails with EBUSY or ENOTEMPTY on a cgroup that is still in use
+		if err := os.Remove(path.Join(root, dir)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+}
+
+// RemoveCgroup removes a cgroup directory. The kernel refuses while the last
+// tasks are still exiting, so it retries with a growing delay for a few
+// seconds. A cgroup that is gone already is fine.
+func RemoveCgroup(dir string) error {
+	delay := 10 * time.Millisecond
+	for i := 0; ; i++ {
+		err := os.Remove(dir)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if i == 9 {
+			return fmt.Errorf("remove cgroup %s error %v", dir, err)
+		}
+		time.Sleep(delay)
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
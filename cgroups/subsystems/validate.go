@@ -0,0 +1,213 @@
+package subsystems
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MinMemoryLimit is the smallest memory limit we accept, like docker
+const MinMemoryLimit = 6 * 1024 * 1024
+
+var (
+	cpusetPattern   = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+	throttlePattern = regexp.MustCompile(`^[0-9]+:[0-9]+ [0-9]+$`)
+	hugetlbPattern  = regexp.MustCompile(`^[0-9]+[KMG]B:[0-9]+$`)
+)
+
+// ParseBytes parses a size with an optional b, k, m or g suffix, 512m or 1G
+func ParseBytes(size string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(size))
+	multiplier := int64(1)
+	value = strings.TrimSuffix(value, "b")
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+// Validate checks every limit before any is written, so that a bad value
+// doesn't leave a cgroup half updated
+func (r *ResourceConfig) Validate() error {
+	var memory int64
+	if r.MemoryLimit != "" {
+		var err error
+		if memory, err = ParseBytes(r.MemoryLimit); err != nil {
+			return fmt.Errorf("invalid memory limit: %v", err)
+		}
+		if memory < MinMemoryLimit {
+			return fmt.Errorf("minimum memory limit allowed is 6MB")
+		}
+	}
+	if r.MemorySwap != "" && r.MemorySwap != "-1" {
+		if r.MemoryLimit == "" {
+			return fmt.Errorf("you should always set the memory limit when using memory+swap limit")
+		}
+		swap, err := ParseBytes(r.MemorySwap)
+		if err != nil {
+			return fmt.Errorf("invalid memory+swap limit: %v", err)
+		}
+		if swap < memory {
+			return fmt.Errorf("minimum memory+swap limit should be larger than memory limit")
+		}
+	}
+	if err := checkRange("cpu shares", r.CpuShare, 2, 262144); err != nil {
+		return err
+	}
+	if err := checkRange("cpu period", r.CpuPeriod, 1000, 1000000); err != nil {
+		return err
+	}
+	if r.CpuQuota != "-1" {
+		if err := checkRange("cpu quota", r.CpuQuota, 1000, 1<<62); err != nil {
+			return err
+		}
+	}
+	if r.CpuSet != "" && !cpusetPattern.MatchString(r.CpuSet) {
+		return fmt.Errorf("invalid cpuset %q, expect a list like 0-2,4", r.CpuSet)
+	}
+	if r.PidsLimit != "" {
+		if _, err := strconv.ParseInt(r.PidsLimit, 10, 64); err != nil {
+			return fmt.Errorf("invalid pids limit %q", r.PidsLimit)
+		}
+	}
+	if r.MemoryReservation != "" {
+		reservation, err := ParseBytes(r.MemoryReservation)
+		if err != nil {
+			return fmt.Errorf("invalid memory reservation: %v", err)
+		}
+		if r.MemoryLimit != "" && reservation > memory {
+			return fmt.Errorf("minimum memory limit can not be less than memory reservation limit")
+		}
+	}
+	if err := checkRange("blkio weight", r.BlkioWeight, 10, 1000); err != nil {
+		return err
+	}
+	for _, rules := range [][]string{r.BlkioReadBps, r.BlkioWriteBps, r.BlkioReadIops, r.BlkioWriteIops} {
+		for _, rule := range rules {
+			if !throttlePattern.MatchString(rule) {
+				return fmt.Errorf("invalid blkio throttle %q, expect major:minor rate", rule)
+			}
+		}
+	}
+	for _, limit := range r.HugetlbLimits {
+		if !hugetlbPattern.MatchString(limit) {
+			return fmt.Errorf("invalid hugetlb limit %q, expect pagesize:bytes", limit)
+		}
+	}
+	return nil
+}
+
+// ParseThrottleDevice parses --device-read-bps style path:rate into the
+// "major:minor rate" the blkio cgroup takes. bps rates may have a size suffix.
+func ParseThrottleDevice(spec string, bps bool) (string, error) {
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 {
+		return "", fmt.Errorf("invalid device throttle %q, expect path:rate", spec)
+	}
+	devicePath, rate := spec[:i], spec[i+1:]
+	var value int64
+	var err error
+	if bps {
+		value, err = ParseBytes(rate)
+	} else {
+		value, err = strconv.ParseInt(rate, 10, 64)
+	}
+	if err != nil || value < 0 {
+		return "", fmt.Errorf("invalid rate %q in device throttle %q", rate, spec)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(devicePath, &st); err != nil {
+		return "", fmt.Errorf("stat device %s error %v", devicePath, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", devicePath)
+	}
+	// throttles are per whole disk, the kernel rejects partitions
+	major := uint32((st.Rdev>>8)&0xfff) | uint32((st.Rdev>>32)&^0xfff)
+	minor := uint32(st.Rdev&0xff) | uint32((st.Rdev>>12)&^0xff)
+	return fmt.Sprintf("%d:%d %d", major, minor, value), nil
+}
+
+// ParseHugetlbLimit parses pagesize:limit, 2MB:1g, into the "pagesize:bytes" of HugetlbLimits
+func ParseHugetlbLimit(spec string) (string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid hugetlb limit %q, expect pagesize:limit", spec)
+	}
+	// the kernel's file names use 2MB, 1GB and 64KB
+	pageSize := strings.ToUpper(parts[0])
+	if !strings.HasSuffix(pageSize, "B") {
+		pageSize += "B"
+	}
+	limit, err := ParseBytes(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid hugetlb limit %q: %v", spec, err)
+	}
+	result := fmt.Sprintf("%s:%d", pageSize, limit)
+	if !hugetlbPattern.MatchString(result) {
+		return "", fmt.Errorf("invalid hugetlb page size %q", parts[0])
+	}
+	return result, nil
+}
+
+// CpusToQuota turns --cpus, 1.5 for one and a half cpus, into a cfs period and quota
+func CpusToQuota(cpus string) (string, string, error) {
+	value, err := strconv.ParseFloat(cpus, 64)
+	if err != nil || value <= 0 {
+		return "", "", fmt.Errorf("invalid --cpus %q", cpus)
+	}
+	period := int64(100000)
+	quota := int64(value * float64(period))
+	if quota < 1000 {
+		return "", "", fmt.Errorf("--cpus %s is below the minimum of 0.01", cpus)
+	}
+	return strconv.FormatInt(period, 10), strconv.FormatInt(quota, 10), nil
+}
+
+// Merge returns r with the limits set in update replacing its own
+func (r *ResourceConfig) Merge(update *ResourceConfig) *ResourceConfig {
+	merged := &ResourceConfig{}
+	if r != nil {
+		*merged = *r
+	}
+	for _, field := range []struct{ to, from *string }{
+		{&merged.MemoryLimit, &update.MemoryLimit},
+		{&merged.MemorySwap, &update.MemorySwap},
+		{&merged.CpuShare, &update.CpuShare},
+		{&merged.CpuPeriod, &update.CpuPeriod},
+		{&merged.CpuQuota, &update.CpuQuota},
+		{&merged.CpuSet, &update.CpuSet},
+		{&merged.PidsLimit, &update.PidsLimit},
+	} {
+		if *field.from != "" {
+			*field.to = *field.from
+		}
+	}
+	return merged
+}
+
+// checkRange accepts an empty value or an integer between min and max
+func checkRange(name string, value string, min int64, max int64) error {
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < min || n > max {
+		return fmt.Errorf("invalid %s %q, it must be between %d and %d", name, value, min, max)
+	}
+	return nil
+}
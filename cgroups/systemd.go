@@ -0,0 +1,396 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"./subsystems"
+)
+
+// DefaultSlice holds the containers of the systemd driver
+const DefaultSlice = "system.slice"
+
+// UnitProperty is a property of a systemd unit, Value is a string, bool,
+// uint64 or []uint32
+type UnitProperty struct {
+	Name  string
+	Value interface{}
+}
+
+// SystemdConnection is the part of the systemd manager API the systemd driver uses
+type SystemdConnection interface {
+	StartTransientUnit(name string, properties []UnitProperty) error
+	SetUnitProperties(name string, properties []UnitProperty) error
+	StopUnit(name string) error
+	Close() error
+}
+
+// systemd's errors for units it doesn't have or already has
+const (
+	errNoSuchUnit = "org.freedesktop.systemd1.NoSuchUnit"
+	errUnitExists = "org.freedesktop.systemd1.UnitExists"
+)
+
+// NewSystemdConnection connects to systemd. Tests swap in NewLocalSystemd,
+// its units only live as long as the process, so it is no use to the CLI.
+var NewSystemdConnection = dialSystemd
+
+// dialSystemd prefers systemd's private socket, only root may use it, then the system bus
+func dialSystemd() (SystemdConnection, error) {
+	if address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); address != "" {
+		socket, err := dbusSocketPath(address)
+		if err != nil {
+			return nil, err
+		}
+		return dialSystemdSocket(socket, true)
+	}
+	if _, err := os.Stat("/run/systemd/private"); err == nil && os.Geteuid() == 0 {
+		return dialSystemdSocket("/run/systemd/private", false)
+	}
+	return dialSystemdSocket("/run/dbus/system_bus_socket", true)
+}
+
+func dialSystemdSocket(socket string, bus bool) (SystemdConnection, error) {
+	conn, err := dialDBus(socket, bus)
+	if err != nil {
+		return nil, fmt.Errorf("connect to systemd on %s error %v", socket, err)
+	}
+	return &systemdDBus{conn}, nil
+}
+
+type systemdDBus struct {
+	*dbusConn
+}
+
+func (s *systemdDBus) managerCall(member string, signature string, body func(*dbusEncoder)) error {
+	_, err := s.call("org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", member, signature, body)
+	return err
+}
+
+func encodeProperties(e *dbusEncoder, properties []UnitProperty) error {
+	var err error
+	e.array(8, func() {
+		for _, property := range properties {
+			e.align(8)
+			e.string(property.Name)
+			if verr := e.variant(property.Value); verr != nil && err == nil {
+				err = fmt.Errorf("property %s: %v", property.Name, verr)
+			}
+		}
+	})
+	return err
+}
+
+func (s *systemdDBus) StartTransientUnit(name string, properties []UnitProperty) error {
+	var err error
+	callErr := s.managerCall("StartTransientUnit", "ssa(sv)a(sa(sv))", func(e *dbusEncoder) {
+		e.string(name)
+		e.string("fail")
+		err = encodeProperties(e, properties)
+		// no auxiliary units
+		e.array(8, func() {})
+	})
+	if err != nil {
+		return err
+	}
+	return callErr
+}
+
+func (s *systemdDBus) SetUnitProperties(name string, properties []UnitProperty) error {
+	var err error
+	callErr := s.managerCall("SetUnitProperties", "sba(sv)", func(e *dbusEncoder) {
+		e.string(name)
+		// runtime only, like the transient unit itself
+		e.bool(true)
+		err = encodeProperties(e, properties)
+	})
+	if err != nil {
+		return err
+	}
+	return callErr
+}
+
+func (s *systemdDBus) StopUnit(name string) error {
+	return s.managerCall("StopUnit", "ss", func(e *dbusEncoder) {
+		e.string(name)
+		e.string("fail")
+	})
+}
+
+// LocalSystemd stands in for systemd in tests: units live in memory and
+// their cgroups are made with cgroupfs at the path systemd would use
+type LocalSystemd struct {
+	mu    sync.Mutex
+	Units map[string][]UnitProperty
+}
+
+var localSystemd = &LocalSystemd{Units: map[string][]UnitProperty{}}
+
+// NewLocalSystemd returns the stand-in shared by the whole process
+func NewLocalSystemd() (SystemdConnection, error) {
+	return localSystemd, nil
+}
+
+func (l *LocalSystemd) StartTransientUnit(name string, properties []UnitProperty) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.Units[name]; ok {
+		return &DBusError{Name: errUnitExists, Message: fmt.Sprintf("Unit %s already exists.", name)}
+	}
+	slice := DefaultSlice
+	var pids []uint32
+	for _, property := range properties {
+		switch property.Name {
+		case "Slice":
+			slice = property.Value.(string)
+		case "PIDs":
+			pids = property.Value.([]uint32)
+		}
+	}
+	manager := NewCgroupManager(SystemdScopePath(slice, name))
+	// creates the cgroups, cpuset ones need their cpus and mems before a task joins
+	if err := manager.Set(&subsystems.ResourceConfig{}); err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := manager.Apply(int(pid)); err != nil {
+			return err
+		}
+	}
+	l.Units[name] = properties
+	return nil
+}
+
+func (l *LocalSystemd) SetUnitProperties(name string, properties []UnitProperty) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.Units[name]; !ok {
+		return &DBusError{Name: errNoSuchUnit, Message: fmt.Sprintf("Unit %s not loaded.", name)}
+	}
+	l.Units[name] = append(l.Units[name], properties...)
+	return nil
+}
+
+func (l *LocalSystemd) StopUnit(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.Units[name]; !ok {
+		return &DBusError{Name: errNoSuchUnit, Message: fmt.Sprintf("Unit %s not loaded.", name)}
+	}
+	delete(l.Units, name)
+	return nil
+}
+
+func (l *LocalSystemd) Close() error {
+	return nil
+}
+
+// SystemdScopePath is where systemd puts unit in slice, relative to each
+// hierarchy: a-b.slice nests in a.slice
+func SystemdScopePath(slice string, unit string) string {
+	dir := ""
+	if slice != "-.slice" {
+		parts := strings.Split(strings.TrimSuffix(slice, ".slice"), "-")
+		for i := range parts {
+			dir = path.Join(dir, strings.Join(parts[:i+1], "-")+".slice")
+		}
+	}
+	return path.Join(dir, unit)
+}
+
+// SystemdManager runs a container in a transient scope unit. The limits
+// systemd has properties for are set on the unit, it writes them to the
+// cgroups itself; the others, and all reads, go to cgroupfs.
+type SystemdManager struct {
+	*CgroupManager
+	Unit  string
+	Slice string
+	// limits Set before the unit exists, Apply starts it with them
+	pending *subsystems.ResourceConfig
+}
+
+// NewSystemdManager takes a path made by SystemdScopePath
+func NewSystemdManager(cgroupPath string) *SystemdManager {
+	return &SystemdManager{
+		CgroupManager: NewCgroupManager(cgroupPath),
+		Unit:          path.Base(cgroupPath),
+		Slice:         path.Base(path.Dir(cgroupPath)),
+	}
+}
+
+// Apply starts the scope with pid in it, or moves pid into the running
+// scope, like exec does
+func (m *SystemdManager) Apply(pid int) error {
+	conn, err := NewSystemdConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	properties := []UnitProperty{
+		{"Description", "mydocker container " + strings.TrimSuffix(m.Unit, ".scope")},
+		{"Slice", m.Slice},
+		{"Delegate", true},
+		{"DefaultDependencies", false},
+		{"PIDs", []uint32{uint32(pid)}},
+	}
+	if m.pending != nil {
+		resources, err := unitResources(m.pending)
+		if err != nil {
+			return err
+		}
+		properties = append(properties, resources...)
+	}
+	err = conn.StartTransientUnit(m.Unit, properties)
+	if isDBusError(err, errUnitExists) {
+		return m.CgroupManager.Apply(pid)
+	}
+	if err != nil {
+		return fmt.Errorf("start unit %s error %v", m.Unit, err)
+	}
+	// the start job runs after the call returns
+	if err := waitForCgroup(pid, m.Path); err != nil {
+		return err
+	}
+	if m.pending != nil {
+		if err := m.CgroupManager.Set(m.pending); err != nil {
+			return err
+		}
+		m.pending = nil
+	}
+	// and the hierarchies systemd doesn't manage, like freezer
+	return m.CgroupManager.Apply(pid)
+}
+
+// Set updates the unit's properties, then writes all the limits to cgroupfs
+func (m *SystemdManager) Set(res *subsystems.ResourceConfig) error {
+	properties, err := unitResources(res)
+	if err != nil {
+		return err
+	}
+	conn, err := NewSystemdConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(properties) > 0 {
+		err = conn.SetUnitProperties(m.Unit, properties)
+	} else {
+		// nothing for systemd, still find out if the unit exists
+		err = conn.SetUnitProperties(m.Unit, []UnitProperty{{"Description", "mydocker container " + strings.TrimSuffix(m.Unit, ".scope")}})
+	}
+	if isDBusError(err, errNoSuchUnit) {
+		m.pending = res
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("set unit %s properties error %v", m.Unit, err)
+	}
+	return m.CgroupManager.Set(res)
+}
+
+// Destroy stops the scope, then removes what systemd left in other hierarchies
+func (m *SystemdManager) Destroy() error {
+	conn, err := NewSystemdConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.StopUnit(m.Unit); err != nil && !isDBusError(err, errNoSuchUnit) {
+		return fmt.Errorf("stop unit %s error %v", m.Unit, err)
+	}
+	return m.CgroupManager.Destroy()
+}
+
+// waitForCgroup waits until systemd moved pid to the cgroup
+func waitForCgroup(pid int, cgroupPath string) error {
+	for i := 0; i < 100; i++ {
+		content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(content), ":/"+cgroupPath+"\n") {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("process %d did not get into %s", pid, cgroupPath)
+}
+
+// unitResources maps the limits systemd knows to unit properties, the v1
+// names on hosts with the v1 memory controller and the v2 ones otherwise
+func unitResources(res *subsystems.ResourceConfig) ([]UnitProperty, error) {
+	var properties []UnitProperty
+	v1 := subsystems.FindCgroupMountpoint("memory") != ""
+	if res.MemoryLimit != "" {
+		bytes, err := subsystems.ParseBytes(res.MemoryLimit)
+		if err != nil {
+			return nil, err
+		}
+		name := "MemoryMax"
+		if v1 {
+			name = "MemoryLimit"
+		}
+		properties = append(properties, UnitProperty{name, uint64(bytes)})
+	}
+	if res.CpuShare != "" {
+		shares, err := strconv.ParseUint(res.CpuShare, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu shares %q", res.CpuShare)
+		}
+		if v1 {
+			properties = append(properties, UnitProperty{"CPUShares", shares})
+		} else {
+			// shares 2..262144 onto weights 1..10000
+			properties = append(properties, UnitProperty{"CPUWeight", 1 + (shares-2)*9999/262142})
+		}
+	}
+	if res.CpuQuota != "" {
+		quota := uint64(math.MaxUint64)
+		if res.CpuQuota != "-1" {
+			period := uint64(100000)
+			if res.CpuPeriod != "" {
+				p, err := strconv.ParseUint(res.CpuPeriod, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cpu period %q", res.CpuPeriod)
+				}
+				period = p
+			}
+			q, err := strconv.ParseUint(res.CpuQuota, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cpu quota %q", res.CpuQuota)
+			}
+			quota = q * 1000000 / period
+		}
+		properties = append(properties, UnitProperty{"CPUQuotaPerSecUSec", quota})
+	}
+	if res.PidsLimit != "" {
+		limit, err := strconv.ParseInt(res.PidsLimit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pids limit %q", res.PidsLimit)
+		}
+		tasks := uint64(math.MaxUint64)
+		if limit > 0 {
+			tasks = uint64(limit)
+		}
+		properties = append(properties, UnitProperty{"TasksMax", tasks})
+	}
+	if res.BlkioWeight != "" {
+		weight, err := strconv.ParseUint(res.BlkioWeight, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blkio weight %q", res.BlkioWeight)
+		}
+		name := "IOWeight"
+		if v1 {
+			name = "BlockIOWeight"
+		}
+		properties = append(properties, UnitProperty{name, weight})
+	}
+	return properties, nil
+}
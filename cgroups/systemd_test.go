@@ -0,0 +1,244 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"./subsystems"
+)
+
+// useLocalSystemd makes the systemd driver talk to LocalSystemd for the test
+func useLocalSystemd(t *testing.T) {
+	dial := NewSystemdConnection
+	NewSystemdConnection = NewLocalSystemd
+	t.Cleanup(func() { NewSystemdConnection = dial })
+}
+
+// needCgroups skips tests that make cgroups where they can't be made
+func needCgroups(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("making cgroups needs root")
+	}
+	if subsystems.FindCgroupMountpoint("memory") == "" && subsystems.FindCgroup2Mountpoint() == "" {
+		t.Skip("no cgroup hierarchy mounted")
+	}
+}
+
+func unitProperty(properties []UnitProperty, name string) (interface{}, bool) {
+	var value interface{}
+	found := false
+	// SetUnitProperties appends, the last one wins
+	for _, property := range properties {
+		if property.Name == name {
+			value, found = property.Value, true
+		}
+	}
+	return value, found
+}
+
+func TestUnitResources(t *testing.T) {
+	v1 := subsystems.FindCgroupMountpoint("memory") != ""
+	memory, cpu, blkio := "MemoryMax", "CPUWeight", "IOWeight"
+	shares := uint64(1 + (1024-2)*9999/262142)
+	if v1 {
+		memory, cpu, blkio = "MemoryLimit", "CPUShares", "BlockIOWeight"
+		shares = 1024
+	}
+
+	properties, err := unitResources(&subsystems.ResourceConfig{
+		MemoryLimit: "100m",
+		CpuShare:    "1024",
+		CpuPeriod:   "50000",
+		CpuQuota:    "25000",
+		PidsLimit:   "64",
+		BlkioWeight: "500",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		memory:               uint64(100 << 20),
+		cpu:                  shares,
+		"CPUQuotaPerSecUSec": uint64(500000),
+		"TasksMax":           uint64(64),
+		blkio:                uint64(500),
+	}
+	if len(properties) != len(want) {
+		t.Fatalf("got %d properties %v, want %v", len(properties), properties, want)
+	}
+	for name, value := range want {
+		got, ok := unitProperty(properties, name)
+		if !ok || got != value {
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+}
+
+func TestUnitResourcesDefaults(t *testing.T) {
+	properties, err := unitResources(&subsystems.ResourceConfig{CpuQuota: "50000", PidsLimit: "-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// half a cpu of the default 100ms period
+	if got, _ := unitProperty(properties, "CPUQuotaPerSecUSec"); got != uint64(500000) {
+		t.Errorf("CPUQuotaPerSecUSec = %v, want 500000", got)
+	}
+	if got, _ := unitProperty(properties, "TasksMax"); got != uint64(math.MaxUint64) {
+		t.Errorf("TasksMax = %v, want infinity", got)
+	}
+
+	properties, err = unitResources(&subsystems.ResourceConfig{CpuQuota: "-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := unitProperty(properties, "CPUQuotaPerSecUSec"); got != uint64(math.MaxUint64) {
+		t.Errorf("CPUQuotaPerSecUSec = %v, want infinity", got)
+	}
+
+	if properties, _ := unitResources(&subsystems.ResourceConfig{}); len(properties) != 0 {
+		t.Errorf("got %v for no limits", properties)
+	}
+	for _, res := range []*subsystems.ResourceConfig{
+		{MemoryLimit: "lots"},
+		{CpuShare: "x"},
+		{CpuQuota: "1000", CpuPeriod: "x"},
+		{PidsLimit: "x"},
+	} {
+		if _, err := unitResources(res); err == nil {
+			t.Errorf("no error for %+v", res)
+		}
+	}
+}
+
+func TestSystemdScopePath(t *testing.T) {
+	for _, c := range []struct{ slice, want string }{
+		{"system.slice", "system.slice/test.scope"},
+		{"-.slice", "test.scope"},
+		{"a-b-c.slice", "a.slice/a-b.slice/a-b-c.slice/test.scope"},
+	} {
+		if got := SystemdScopePath(c.slice, "test.scope"); got != c.want {
+			t.Errorf("SystemdScopePath(%q) = %q, want %q", c.slice, got, c.want)
+		}
+	}
+}
+
+func TestSystemdManager(t *testing.T) {
+	needCgroups(t)
+	useLocalSystemd(t)
+
+	slice := "mydockertest.slice"
+	unit := fmt.Sprintf("mydocker-test-%d.scope", os.Getpid())
+	manager := NewSystemdManager(SystemdScopePath(slice, unit))
+	if manager.Unit != unit || manager.Slice != slice {
+		t.Fatalf("unit %s slice %s, want %s in %s", manager.Unit, manager.Slice, unit, slice)
+	}
+	t.Cleanup(func() {
+		manager.Destroy()
+		for _, hierarchy := range Hierarchies() {
+			subsystems.RemoveEmptyParents(hierarchy, manager.Path)
+		}
+	})
+
+	// before the unit exists the limits wait for Apply
+	if err := manager.Set(&subsystems.ResourceConfig{MemoryLimit: "100m", PidsLimit: "32"}); err != nil {
+		t.Fatal(err)
+	}
+	if manager.pending == nil {
+		t.Fatal("limits set before Apply are not pending")
+	}
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if err := manager.Apply(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	if manager.pending != nil {
+		t.Error("pending limits left after Apply")
+	}
+	properties, ok := localSystemd.Units[unit]
+	if !ok {
+		t.Fatalf("unit %s not started", unit)
+	}
+	for name, value := range map[string]interface{}{
+		"Slice":    slice,
+		"Delegate": true,
+		"PIDs":     []uint32{uint32(cmd.Process.Pid)},
+		"TasksMax": uint64(32),
+	} {
+		got, ok := unitProperty(properties, name)
+		if !ok || fmt.Sprint(got) != fmt.Sprint(value) {
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+	if err := waitForCgroup(cmd.Process.Pid, manager.Path); err != nil {
+		t.Error(err)
+	}
+	checkMemoryLimit(t, manager.Path, 100<<20)
+
+	// a running unit gets the new properties and cgroupfs the new limits
+	if err := manager.Set(&subsystems.ResourceConfig{MemoryLimit: "200m"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := unitProperty(localSystemd.Units[unit], "TasksMax"); got != uint64(32) {
+		t.Errorf("TasksMax = %v after another limit was set, want 32", got)
+	}
+	memory := "MemoryMax"
+	if subsystems.FindCgroupMountpoint("memory") != "" {
+		memory = "MemoryLimit"
+	}
+	if got, _ := unitProperty(localSystemd.Units[unit], memory); got != uint64(200<<20) {
+		t.Errorf("%s = %v, want %d", memory, got, 200<<20)
+	}
+	checkMemoryLimit(t, manager.Path, 200<<20)
+
+	// applying again joins the running scope, like exec
+	if err := manager.Apply(cmd.Process.Pid); err != nil {
+		t.Errorf("apply to a running unit error %v", err)
+	}
+
+	if err := manager.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := localSystemd.Units[unit]; ok {
+		t.Errorf("unit %s still there after Destroy", unit)
+	}
+	memoryPath, _, err := subsystems.SubsystemPath("memory", manager.Path, false)
+	if err == nil {
+		if _, err := os.Stat(memoryPath); !os.IsNotExist(err) {
+			t.Errorf("cgroup %s still there after Destroy", memoryPath)
+		}
+	}
+	// stopping a unit that is gone is not an error
+	if err := manager.Destroy(); err != nil {
+		t.Errorf("destroy twice error %v", err)
+	}
+}
+
+func checkMemoryLimit(t *testing.T, cgroupPath string, want int64) {
+	t.Helper()
+	dir, v2, err := subsystems.SubsystemPath("memory", cgroupPath, false)
+	if err != nil {
+		t.Skipf("no memory controller: %v", err)
+	}
+	file := "memory.limit_in_bytes"
+	if v2 {
+		file = "memory.max"
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(content)); got != fmt.Sprint(want) {
+		t.Errorf("%s = %s, want %d", file, got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"./subsystems"
+)
+
+// Hierarchies are the mount points of the subsystems we use, and the unified
+// hierarchy freezer falls back to, each once
+func Hierarchies() []string {
+	var roots []string
+	seen := map[string]bool{}
+	add := func(root string) {
+		if root != "" && !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	for _, subSysIns := range subsystems.SubsystemIns {
+		add(subsystems.FindCgroupMountpoint(subSysIns.Name()))
+	}
+	add(subsystems.FindCgroup2Mountpoint())
+	return roots
+}
+
+// Pids lists the processes in the cgroup and the ones below it, in any
+// hierarchy; a task may have been moved out of the container's cgroup in some
+func (c *CgroupManager) Pids() ([]int, error) {
+	found := map[int]bool{}
+	for _, root := range Hierarchies() {
+		dir := path.Join(root, c.Path)
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				// gone while we walk it
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			pids, err := ReadProcs(file)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, pid := range pids {
+				found[pid] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var pids []int
+	for pid := range found {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// ReadProcs reads cgroup.procs of a cgroup directory
+func ReadProcs(dir string) ([]int, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(content)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+const killTimeout = 10 * time.Second
+
+// KillTasks SIGKILLs every process of the cgroup and waits until they are
+// gone. The cgroup is frozen while we go through them, so none can fork a
+// child we don't see; a frozen task only dies once thawed.
+func (c *CgroupManager) KillTasks() error {
+	frozen := c.Freeze(subsystems.Frozen) == nil
+	pids, err := c.Pids()
+	if err == nil {
+		for _, pid := range pids {
+			if killErr := syscall.Kill(pid, syscall.SIGKILL); killErr != nil && killErr != syscall.ESRCH {
+				err = fmt.Errorf("kill %d error %v", pid, killErr)
+				break
+			}
+		}
+	}
+	if frozen {
+		if thawErr := c.Freeze(subsystems.Thawed); thawErr != nil && err == nil {
+			err = thawErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	delay := 10 * time.Millisecond
+	deadline := time.Now().Add(killTimeout)
+	for {
+		pids, err := c.Pids()
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cgroup %s still has processes %v", c.Path, pids)
+		}
+		// one that got through before the freeze, or a task stuck in the kernel
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(delay)
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os/exec"
 
 	"./container"
+	"./state"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,10 +15,19 @@ func commitContainer(containerName string, imageName string) {
 	imageTar := container.RootUrl + "/" + imageName + ".tar"
 	fmt.Printf("%s\n", imageTar)
 
-	cmd := "tar " + "-czf " + imageTar + mntURL
-	fmt.Printf("%s\n", cmd)
-
-	if _, err := exec.Command("tar", "-czf", imageTar, mntURL).CombinedOutput(); err != nil {
+	// -C keeps the paths in the tarball relative to the container's root,
+	// so the image can also be imported into the layered store and pushed
+	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
 		log.Errorf("Tar folder %s error: %v", mntURL, err)
+		return
+	}
+
+	// Keep the container's entrypoint, env etc. as the new image's defaults
+	containerInfo, err := state.Load(containerName)
+	if err != nil || containerInfo.Config == nil {
+		return
+	}
+	if err := container.WriteImageConfig(imageName, containerInfo.Config); err != nil {
+		log.Errorf("Write image %s config error: %v", imageName, err)
 	}
 }
@@ -0,0 +1,256 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	linuxCapabilityVersion3 = 0x20080522
+
+	prCapbsetDrop          = 24
+	prCapAmbient           = 47
+	prCapAmbientClearAll   = 4
+	capLastCapFile         = "/proc/sys/kernel/cap_last_cap"
+	defaultCapLastCap      = 40
+	allCapabilitiesKeyword = "ALL"
+)
+
+// capabilityNames in kernel order, the index is the capability number
+var capabilityNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// DefaultCapabilities is the same set docker gives to containers
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+func normalizeCapability(name string) string {
+	name = strings.ToUpper(name)
+	if name == allCapabilitiesKeyword {
+		return name
+	}
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	return name
+}
+
+func capabilityNumber(name string) (int, error) {
+	for i, capName := range capabilityNames {
+		if capName == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %q", name)
+}
+
+// AllCapabilities lists every capability the running kernel knows
+func AllCapabilities() []string {
+	return append([]string{}, capabilityNames[:capLastCap()+1]...)
+}
+
+func capLastCap() int {
+	content, err := ioutil.ReadFile(capLastCapFile)
+	if err != nil {
+		return defaultCapLastCap
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || last >= len(capabilityNames) {
+		return len(capabilityNames) - 1
+	}
+	return last
+}
+
+// TweakCapabilities applies --cap-add and --cap-drop to the default set, ALL is allowed in both
+func TweakCapabilities(add []string, drop []string, privileged bool) ([]string, error) {
+	if privileged {
+		return AllCapabilities(), nil
+	}
+	caps := map[string]bool{}
+	for _, name := range DefaultCapabilities {
+		caps[name] = true
+	}
+	for _, name := range drop {
+		name = normalizeCapability(name)
+		if name == allCapabilitiesKeyword {
+			caps = map[string]bool{}
+			continue
+		}
+		if _, err := capabilityNumber(name); err != nil {
+			return nil, err
+		}
+		delete(caps, name)
+	}
+	for _, name := range add {
+		name = normalizeCapability(name)
+		if name == allCapabilitiesKeyword {
+			for _, capName := range AllCapabilities() {
+				caps[capName] = true
+			}
+			continue
+		}
+		if _, err := capabilityNumber(name); err != nil {
+			return nil, err
+		}
+		caps[name] = true
+	}
+
+	var list []string
+	for name := range caps {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// CapabilityMask turns capability names into the 64 bit mask the kernel uses
+func CapabilityMask(names []string) (uint64, error) {
+	var mask uint64
+	for _, name := range names {
+		n, err := capabilityNumber(normalizeCapability(name))
+		if err != nil {
+			return 0, err
+		}
+		mask |= 1 << uint(n)
+	}
+	return mask, nil
+}
+
+// CapabilityNames turns a mask, like CapEff in /proc/<pid>/status, back into names
+func CapabilityNames(mask uint64) []string {
+	var names []string
+	for i, name := range capabilityNames {
+		if mask&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+func prctl(option int, arg2 uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, uintptr(option), arg2, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropBoundingSet removes every capability not in mask from the bounding set,
+// nothing exec'ed afterwards can get them back. Must run while we still have CAP_SETPCAP.
+func dropBoundingSet(mask uint64) error {
+	for i := 0; i <= capLastCap(); i++ {
+		if mask&(1<<uint(i)) != 0 {
+			continue
+		}
+		if err := prctl(prCapbsetDrop, uintptr(i)); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("drop %s from bounding set error %v", capabilityNames[i], err)
+		}
+	}
+	return nil
+}
+
+// setCapabilities sets the effective, permitted and inheritable sets and clears the ambient one
+func setCapabilities(mask uint64) error {
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{
+		{effective: uint32(mask), permitted: uint32(mask), inheritable: uint32(mask)},
+		{effective: uint32(mask >> 32), permitted: uint32(mask >> 32), inheritable: uint32(mask >> 32)},
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset error %v", errno)
+	}
+	// kernels before 4.3 have no ambient capabilities
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("clear ambient capabilities error %v", errno)
+	}
+	return nil
+}
+
+// ProcessCapabilities reads a capability set ("CapEff", "CapBnd", ...) of a process
+func ProcessCapabilities(pid string, set string) ([]string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%s/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, set+":") {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, set+":")), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		return CapabilityNames(mask), nil
+	}
+	return nil, fmt.Errorf("no %s in /proc/%s/status", set, pid)
+}
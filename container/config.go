@@ -0,0 +1,97 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"../image"
+)
+
+// Mount is done by the init process before pivot_root, Target is relative to the rootfs
+type Mount struct {
+	Source string  `json:"source"`
+	Target string  `json:"target"`
+	Type   string  `json:"type"`
+	Flags  uintptr `json:"flags"`
+	Data   string  `json:"data"`
+}
+
+// ProcessConfig describes the command started in a container, by init at run and by exec-init at exec
+type ProcessConfig struct {
+	Args []string `json:"args"` // command to exec, entrypoint + cmd
+	Cwd  string   `json:"cwd"`  // working directory inside the container
+	User string   `json:"user"` // user[:group] the command runs as
+	// Capabilities kept in the bounding set, and in the effective, permitted
+	// and inheritable sets when the command runs as root
+	Capabilities []string `json:"capabilities"`
+	// Seccomp profile to filter the command's syscalls with, nil for unconfined
+	Seccomp *SeccompProfile `json:"seccomp,omitempty"`
+	// NoNewPrivileges sets no_new_privs, execve can't gain privileges through setuid or file capabilities
+	NoNewPrivileges bool `json:"noNewPrivileges"`
+	// Console makes exec-init put the command on a pty of the container's
+	// devpts, whose master it sends on ConsoleSocketFd
+	Console bool `json:"console,omitempty"`
+}
+
+// InitConfig is sent through the pipe to the container's init process
+type InitConfig struct {
+	ProcessConfig
+	Mounts []Mount `json:"mounts"` // mounts the host couldn't do for the container
+	// ReadonlyRootfs remounts the root read-only, Mounts like tmpfs and volumes stay writable
+	ReadonlyRootfs bool     `json:"readonlyRootfs"`
+	MaskedPaths    []string `json:"maskedPaths"`   // hidden behind /dev/null or an empty tmpfs
+	ReadonlyPaths  []string `json:"readonlyPaths"` // bind mounted read-only
+	Privileged     bool     `json:"privileged"`    // mounts /sys read-write
+	// Devices are created in /dev, BindDevices binds the host's nodes where mknod isn't allowed
+	Devices     []Device `json:"devices"`
+	BindDevices bool     `json:"bindDevices"`
+	ShmSize     string   `json:"shmSize"` // size= of the /dev/shm tmpfs
+	Hostname    string   `json:"hostname"`
+	// Reexec asks init to exec itself once more, after newuidmap made it root
+	// of its user namespace, because capabilities are only granted at execve
+	Reexec bool `json:"reexec"`
+}
+
+// Config of an image stored as a plain tarball sits next to it
+func imageConfigPath(imageName string) string {
+	return RootUrl + "/" + imageName + ".json"
+}
+
+// GetImageConfig returns the defaults of an image, empty if the image has none
+func GetImageConfig(imageName string) (*image.ContainerConfig, error) {
+	img, err := image.GetImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if img != nil {
+		imageConfig, err := image.ReadImageConfig(img)
+		if err != nil {
+			return nil, err
+		}
+		return &imageConfig.Config, nil
+	}
+
+	config := &image.ContainerConfig{}
+	content, err := ioutil.ReadFile(imageConfigPath(imageName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal %s error %v", imageConfigPath(imageName), err)
+	}
+	return config, nil
+}
+
+// WriteImageConfig saves the config of a tarball image made by commit
+func WriteImageConfig(imageName string, config *image.ContainerConfig) error {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(imageConfigPath(imageName), content, 0644)
+}
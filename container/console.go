@@ -0,0 +1,170 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ConsoleSocketFd is where exec-init finds the socket to send the master of
+// its pty on, the sync pipe is fd 3
+const ConsoleSocketFd = 4
+
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setUpConsole makes a pty on the container's devpts the controlling
+// terminal and stdio of the process, the master goes to the other end of
+// socket. We must be in the container's mount namespace.
+func setUpConsole(socket *os.File) error {
+	defer socket.Close()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open ptmx error %v", err)
+	}
+	defer master.Close()
+	unlock := int32(0)
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return fmt.Errorf("unlock pty error %v", err)
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		return fmt.Errorf("get pty number error %v", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return fmt.Errorf("open %s error %v", slavePath, err)
+	}
+	defer slave.Close()
+
+	if err := syscall.Sendmsg(int(socket.Fd()), []byte{0}, syscall.UnixRights(int(master.Fd())), nil, 0); err != nil {
+		return fmt.Errorf("send pty master error %v", err)
+	}
+	if _, err := syscall.Setsid(); err != nil {
+		return fmt.Errorf("setsid error %v", err)
+	}
+	if err := ioctl(slave.Fd(), syscall.TIOCSCTTY, 0); err != nil {
+		return fmt.Errorf("set controlling terminal error %v", err)
+	}
+	for fd := 0; fd <= 2; fd++ {
+		if err := syscall.Dup3(int(slave.Fd()), fd, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewConsoleSocket returns our end of the console socket and the one for exec-init
+func NewConsoleSocket() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create console socket error %v", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "console"), os.NewFile(uintptr(fds[1]), "console"), nil
+}
+
+// ReceiveConsole reads the pty master exec-init sent, it fails once
+// exec-init exited without sending one
+func ReceiveConsole(socket *os.File) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(socket.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receive pty master error %v", err)
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) != 1 {
+		return nil, fmt.Errorf("no pty master received")
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		return nil, fmt.Errorf("no pty master received")
+	}
+	return os.NewFile(uintptr(fds[0]), "ptmx"), nil
+}
+
+// AttachConsole connects our terminal to the pty master until the process
+// on it is done, wait waits for that. Our terminal is raw meanwhile, the
+// keys go to the pty as they are typed and ^C is the container's.
+func AttachConsole(master *os.File, wait func() error) error {
+	defer master.Close()
+	if restore, err := makeRaw(os.Stdin); err == nil {
+		defer restore()
+		resizeConsole(master)
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				resizeConsole(master)
+			}
+		}()
+	}
+	go io.Copy(master, os.Stdin)
+	output := make(chan struct{})
+	go func() {
+		// ends with EIO once nothing has the pty open anymore
+		io.Copy(os.Stdout, master)
+		close(output)
+	}()
+	err := wait()
+	// what it wrote last is still in the pty, something left running in the
+	// background may keep it open though
+	select {
+	case <-output:
+	case <-time.After(500 * time.Millisecond):
+	}
+	return err
+}
+
+// IsTerminal tells if f is a terminal
+func IsTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
+
+// makeRaw puts a terminal in raw mode, not a terminal is an error
+func makeRaw(f *os.File) (func(), error) {
+	var old syscall.Termios
+	if err := ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&old))); err != nil {
+		return nil, err
+	}
+	raw := old
+	// like cfmakeraw(3)
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return func() {
+		ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	}, nil
+}
+
+// winsize is struct winsize
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+// resizeConsole gives the pty the size of our terminal
+func resizeConsole(master *os.File) {
+	var size winsize
+	if err := ioctl(os.Stdin.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); err != nil {
+		return
+	}
+	ioctl(master.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&size)))
+}
@@ -4,21 +4,27 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"syscall"
 
+	"../cgroups/subsystems"
+	"../image"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	RUNNING             string = "running"
+	PAUSED              string = "paused"
 	STOP                string = "stopped"
 	EXIT                string = "exited"
-	DefaultInfoLocation string = "/var/run/mydocker/%s/"
+	DefaultInfoLocation string = "/root/go/mydocker/mydocker/containers/%s/"
 	ConfigName          string = "config.json"
 	ContainerLogFile    string = "container.log"
 )
 
 type ContainerInfo struct {
+	SchemaVersion int `json:"schemaVersion"` // of this file, see the state package
+
 	Pid         string `json:"pid"`        // container's init process's PID in host
 	Id          string `json:"id"`         // container's ID
 	Name        string `json:"name"`       // container's Name
@@ -26,6 +32,55 @@ type ContainerInfo struct {
 	CreatedTime string `json:"createTime"` // container's Created Time
 	Status      string `json:"status"`     // container's Status
 	Volume      string `json:"volume"`     // container's Volume
+	Image       string `json:"image"`      // image the container runs
+	Hostname    string `json:"hostname"`   // set in the container's UTS namespace
+
+	Labels map[string]string `json:"labels,omitempty"` // the image's, overridden by the ones given to run
+
+	Capabilities []string `json:"capabilities"` // capabilities given to the container's processes
+	Seccomp      string   `json:"seccomp"`      // default, unconfined or the profile file given to run
+
+	NoNewPrivileges bool `json:"noNewPrivileges"` // exec sessions set no_new_privs too
+	ReadonlyRootfs  bool `json:"readonlyRootfs"`
+
+	CgroupPath   string                     `json:"cgroupPath,omitempty"`   // relative to each subsystem's mount point, empty in rootless mode
+	CgroupDriver string                     `json:"cgroupDriver,omitempty"` // cgroupfs or systemd
+	CgroupParent string                     `json:"cgroupParent,omitempty"` // what CgroupPath is in, a path or a slice
+	Resources    *subsystems.ResourceConfig `json:"resources,omitempty"`    // limits given to run, changed by update
+	OOMKilled    bool                       `json:"oomKilled"`              // the OOM killer killed one of its processes
+
+	// init is alive while a process with Pid started at PidStartTime in the boot BootID
+	PidStartTime  uint64 `json:"pidStartTime,omitempty"` // clock ticks after boot
+	BootID        string `json:"bootId,omitempty"`
+	StartedAt     string `json:"startedAt,omitempty"` // of the last start, CreatedTime is the first
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+	RestartCount  int    `json:"restartCount,omitempty"`
+
+	Config *image.ContainerConfig `json:"config"` // image config merged with the run flags
+}
+
+// UseRoot keeps the images, layers and containers under root instead,
+// somewhere that survives a reboot
+func UseRoot(root string) {
+	RootUrl = path.Clean(root) + "/"
+	MntUrl = RootUrl + "mnt/%s"
+	WriteLayerURL = RootUrl + "writeLayer/%s"
+	DefaultInfoLocation = RootUrl + "containers/%s/"
+	image.StoreRoot = RootUrl + "images/"
+	image.RegistryConfigPath = RootUrl + "registries.json"
+}
+
+// OldInfoLocation is where the containers were kept before they moved under
+// the root, the runtime dir in rootless mode
+func OldInfoLocation() string {
+	if !Rootless {
+		return "/var/run/mydocker/%s/"
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/tmp/mydocker-%d", os.Geteuid())
+	}
+	return path.Join(runtimeDir, "mydocker") + "/%s/"
 }
 
 var (
@@ -34,13 +89,14 @@ var (
 	WriteLayerURL string = "/root/go/mydocker/mydocker/writeLayer/%s"
 )
 
-func NewParentProcess(tty bool, volume string, containerName string, imageName string, envSlice []string) (*exec.Cmd, *os.File) {
+// NewParentProcess also returns the mounts the init process has to do itself
+func NewParentProcess(tty bool, volume string, containerName string, imageName string, envSlice []string, userns *UserNSConfig) (*exec.Cmd, *os.File, []Mount) {
 
 	readPipe, writePipe, err := NewPipe()
 
 	if err != nil {
 		log.Errorf("New pipe error %v", err)
-		return nil, nil
+		return nil, nil, nil
 	}
 	//args := []string{"init", command}
 
@@ -52,6 +108,9 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
 	}
+	if userns != nil {
+		setUserNamespace(cmd.SysProcAttr, userns)
+	}
 	if tty {
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
@@ -59,15 +118,16 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 	} else {
 		// generate container.log
 		dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
-		if err := os.MkdirAll(dirURL, 0622); err != nil {
+		if err := os.MkdirAll(dirURL, 0755); err != nil {
 			log.Errorf("[NewParentProcess] Mkdir %s error %v", dirURL, err)
-			return nil, nil
+			return nil, nil, nil
 		}
 		stdLogFilePath := dirURL + ContainerLogFile
-		stdLogFile, err := os.Create(stdLogFilePath)
+		// a restarted container keeps the log of its earlier runs
+		stdLogFile, err := os.OpenFile(stdLogFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			log.Errorf("[NewParentProcess] Create file %s error %v", stdLogFile, err)
-			return nil, nil
+			log.Errorf("[NewParentProcess] Create file %s error %v", stdLogFilePath, err)
+			return nil, nil, nil
 		}
 		// redirect the file ouput stream
 		cmd.Stdout = stdLogFile
@@ -75,7 +135,8 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 
 	//在这里传入管道读端的句柄到子进程
 	cmd.ExtraFiles = []*os.File{readPipe}
-	cmd.Env = append(os.Environ(), envSlice...)
+	// The container only sees the environment built from its image and -e, never the host's
+	cmd.Env = envSlice
 	// Add Dir
 	//cmd.Dir = "/root/go/mydocker/mydocker/busybox"
 
@@ -85,10 +146,20 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 	/* NewWorkSpace(rootURL, mntURL) */
 	/* NewWorkSpace(rootURL, mntURL, volume) */
 
-	NewWorkSpace(volume, imageName, containerName)
+	mounts := NewWorkSpace(volume, imageName, containerName)
 	cmd.Dir = fmt.Sprintf(MntUrl, containerName)
 
-	return cmd, writePipe
+	// Root of a remapped container must own its write layer to write to it
+	if userns != nil && !Rootless {
+		uid, _ := HostID(userns.UidMap, 0)
+		gid, _ := HostID(userns.GidMap, 0)
+		writeURL := fmt.Sprintf(WriteLayerURL, containerName)
+		if err := os.Chown(writeURL, uid, gid); err != nil {
+			log.Errorf("[NewParentProcess] Chown %s error %v", writeURL, err)
+		}
+	}
+
+	return cmd, writePipe, mounts
 
 }
 
@@ -0,0 +1,307 @@
+package container
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CopyConfig tells the copy helper what to do. In a running container
+// nsenter moved it in already; for a stopped one it first mounts Mounts in
+// Root and chroots into it.
+type CopyConfig struct {
+	Archive bool    `json:"archive"` // true to write Path as a tar to stdout, false to extract stdin to it
+	Path    string  `json:"path"`    // in the container
+	Root    string  `json:"root,omitempty"`
+	Mounts  []Mount `json:"mounts,omitempty"`
+}
+
+// RunCopyHelper is "mydocker cp-helper", it reads its CopyConfig from fd 3,
+// behind the sync byte nsenter took for a running container
+func RunCopyHelper() error {
+	runtime.LockOSThread()
+	os.Unsetenv(ENV_NSENTER_PID)
+
+	pipe := os.NewFile(uintptr(3), "pipe")
+	msg, err := ioutil.ReadAll(pipe)
+	pipe.Close()
+	if err != nil {
+		return fmt.Errorf("copy helper read pipe error %v", err)
+	}
+	var config CopyConfig
+	if err := json.Unmarshal(msg, &config); err != nil {
+		return fmt.Errorf("unmarshal copy config error %v", err)
+	}
+
+	if len(config.Mounts) > 0 {
+		// in a mount namespace of our own, none of it reaches the host
+		if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("make mounts private error %v", err)
+		}
+		for _, m := range config.Mounts {
+			if err := mountInRootfs(config.Root, m); err != nil {
+				return err
+			}
+		}
+	}
+	if config.Root != "" {
+		// the container's symlinks resolve in its rootfs, not on the host
+		if err := syscall.Chroot(config.Root); err != nil {
+			return fmt.Errorf("chroot %s error %v", config.Root, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if config.Archive {
+		return WriteTar(os.Stdout, config.Path)
+	}
+	return ExtractTar(os.Stdin, config.Path)
+}
+
+// WriteTar archives src, which goes in the tar under its base name. With a
+// trailing "/." only what is in the directory goes, under ".".
+func WriteTar(w io.Writer, src string) error {
+	contents := strings.HasSuffix(src, "/.")
+	src = filepath.Clean(src)
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if contents && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+	top := filepath.Base(src)
+	if contents {
+		top = "."
+	}
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		return writeTarEntry(tw, file, path.Join(top, rel), info)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, file string, name string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSocket != 0 {
+		// tar has no sockets, they mean nothing without their process anyway
+		return nil
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	// the numeric ids are what the other side applies
+	hdr.Name, hdr.Uname, hdr.Gname = name, "", ""
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ExtractTar writes a tar of WriteTar to dst, like cp: into dst when it is a
+// directory, as dst otherwise. Ownership is kept where we are allowed to.
+func ExtractTar(r io.Reader, dst string) error {
+	dst = filepath.Clean(dst)
+	tr := tar.NewReader(r)
+	var top, base string
+	type dirTimes struct {
+		path    string
+		modTime time.Time
+	}
+	var dirs []dirTimes
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path %q in archive", hdr.Name)
+		}
+		// the first entry is what was copied, the others are in it
+		if base == "" {
+			top = name
+			if base, err = copyTarget(dst, top, hdr); err != nil {
+				return err
+			}
+		}
+		rel := name
+		if top != "." {
+			if name != top && !strings.HasPrefix(name, top+"/") {
+				return fmt.Errorf("%q is outside of %q in archive", hdr.Name, top)
+			}
+			rel = strings.TrimPrefix(strings.TrimPrefix(name, top), "/")
+		}
+		target := filepath.Join(base, rel)
+		if err := checkNoSymlinks(base, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if err := extractTarEntry(tr, hdr, target); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{target, hdr.ModTime})
+		}
+	}
+	if base == "" {
+		return fmt.Errorf("empty archive")
+	}
+	// the entries written in a directory changed its time, set it last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+	}
+	return nil
+}
+
+// copyTarget is where the top entry of an archive goes
+func copyTarget(dst string, top string, hdr *tar.Header) (string, error) {
+	info, err := os.Stat(dst)
+	if err == nil {
+		if info.IsDir() {
+			if top == "." {
+				return dst, nil
+			}
+			return filepath.Join(dst, top), nil
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			return "", fmt.Errorf("cannot copy a directory to file %s", dst)
+		}
+		return dst, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Dir(dst)); err != nil {
+		return "", fmt.Errorf("destination directory %s does not exist", filepath.Dir(dst))
+	}
+	return dst, nil
+}
+
+// checkNoSymlinks makes sure an archive doesn't write through a link it
+// made, dir is base or below it
+func checkNoSymlinks(base string, dir string) error {
+	for dir != base && strings.HasPrefix(dir, base+"/") {
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink, not following it", dir)
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+func extractTarEntry(tr *tar.Reader, hdr *tar.Header, target string) error {
+	mode := hdr.FileInfo().Mode()
+	// replace what is there, a directory only with a directory
+	if info, err := os.Lstat(target); err == nil {
+		if info.IsDir() && hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("cannot overwrite directory %s with a file", target)
+		}
+		if !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return lchown(target, hdr)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devType := map[byte]uint32{tar.TypeChar: syscall.S_IFCHR, tar.TypeBlock: syscall.S_IFBLK, tar.TypeFifo: syscall.S_IFIFO}[hdr.Typeflag]
+		if err := syscall.Mknod(target, devType|uint32(mode.Perm()), unixMkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			// not in a user namespace
+			if err == syscall.EPERM {
+				log.Warnf("Skip device %s, mknod not permitted", target)
+				return nil
+			}
+			return fmt.Errorf("mknod %s error %v", target, err)
+		}
+	default:
+		log.Warnf("Skip %s, unsupported type %c", target, hdr.Typeflag)
+		return nil
+	}
+
+	// chown first, it clears the setuid bits chmod sets
+	if err := lchown(target, hdr); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// lchown gives target the owner of the entry. The ids may not exist where we
+// are, then the file stays ours.
+func lchown(target string, hdr *tar.Header) error {
+	err := os.Lchown(target, hdr.Uid, hdr.Gid)
+	if pathErr, ok := err.(*os.PathError); ok && (pathErr.Err == syscall.EPERM || pathErr.Err == syscall.EINVAL) {
+		log.Debugf("Keep owner of %s, chown error %v", target, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// Device is a node created in the container's /dev
+type Device struct {
+	Path        string      `json:"path"`     // inside the container
+	HostPath    string      `json:"hostPath"` // bound instead of mknod'ed in a user namespace
+	Type        string      `json:"type"`     // c or b
+	Major       int64       `json:"major"`
+	Minor       int64       `json:"minor"`
+	FileMode    os.FileMode `json:"fileMode"`
+	Uid         uint32      `json:"uid"`
+	Gid         uint32      `json:"gid"`
+	Permissions string      `json:"permissions"` // for the devices cgroup, any of rwm
+}
+
+// CgroupRule is the line written to devices.allow
+func (d *Device) CgroupRule() string {
+	return fmt.Sprintf("%s %d:%d %s", d.Type, d.Major, d.Minor, d.Permissions)
+}
+
+// DefaultDevices are created in every container
+var DefaultDevices = []Device{
+	{Path: "/dev/null", HostPath: "/dev/null", Type: "c", Major: 1, Minor: 3, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/zero", HostPath: "/dev/zero", Type: "c", Major: 1, Minor: 5, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/full", HostPath: "/dev/full", Type: "c", Major: 1, Minor: 7, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/random", HostPath: "/dev/random", Type: "c", Major: 1, Minor: 8, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/urandom", HostPath: "/dev/urandom", Type: "c", Major: 1, Minor: 9, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/tty", HostPath: "/dev/tty", Type: "c", Major: 5, Minor: 0, FileMode: 0666, Permissions: "rwm"},
+}
+
+// DefaultDeviceRules are allowed in the devices cgroup besides the devices
+// themselves: mknod of anything, the ptys of devpts and /dev/net/tun
+var DefaultDeviceRules = []string{
+	"c *:* m",
+	"b *:* m",
+	"c 136:* rwm",
+	"c 5:2 rwm",
+	"c 10:200 rwm",
+}
+
+// DefaultShmSize is the size of /dev/shm when --shm-size isn't given
+const DefaultShmSize = "64m"
+
+var shmSizePattern = regexp.MustCompile(`^[0-9]+[kmgKMG]?$`)
+
+// ValidateShmSize accepts a size the tmpfs size= option understands, like 64m
+func ValidateShmSize(size string) error {
+	if !shmSizePattern.MatchString(size) {
+		return fmt.Errorf("invalid --shm-size %q, expect a number with an optional k, m or g suffix", size)
+	}
+	return nil
+}
+
+// ParseDevice parses a --device hostPath[:containerPath][:permissions]
+func ParseDevice(spec string) (Device, error) {
+	parts := strings.Split(spec, ":")
+	hostPath, containerPath, permissions := parts[0], parts[0], "rwm"
+	switch len(parts) {
+	case 1:
+	case 2:
+		if isDevicePermissions(parts[1]) {
+			permissions = parts[1]
+		} else {
+			containerPath = parts[1]
+		}
+	case 3:
+		containerPath, permissions = parts[1], parts[2]
+	default:
+		return Device{}, fmt.Errorf("invalid --device %q", spec)
+	}
+	if !filepath.IsAbs(containerPath) || !isDevicePermissions(permissions) {
+		return Device{}, fmt.Errorf("invalid --device %q", spec)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(hostPath, &st); err != nil {
+		return Device{}, fmt.Errorf("stat device %s error %v", hostPath, err)
+	}
+	device := Device{
+		Path:        containerPath,
+		HostPath:    hostPath,
+		Major:       int64(unixMajor(st.Rdev)),
+		Minor:       int64(unixMinor(st.Rdev)),
+		FileMode:    os.FileMode(st.Mode & 0777),
+		Uid:         st.Uid,
+		Gid:         st.Gid,
+		Permissions: permissions,
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		device.Type = "c"
+	case syscall.S_IFBLK:
+		device.Type = "b"
+	default:
+		return Device{}, fmt.Errorf("%s is not a device", hostPath)
+	}
+	return device, nil
+}
+
+func isDevicePermissions(s string) bool {
+	return s != "" && strings.Trim(s, "rwm") == ""
+}
+
+func unixMajor(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+}
+
+func unixMinor(dev uint64) uint32 {
+	return uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+}
+
+func unixMkdev(major int64, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// setUpDev fills the tmpfs on rootfs/dev. In a user namespace mknod isn't
+// allowed, the host's nodes are bind mounted onto empty files instead.
+func setUpDev(rootfs string, config *InitConfig) error {
+	dev := filepath.Join(rootfs, "dev")
+	for _, device := range config.Devices {
+		if err := createDevice(rootfs, device, config.BindDevices); err != nil {
+			return err
+		}
+	}
+
+	// a devpts instance of our own, ptmx points into it
+	pts := filepath.Join(dev, "pts")
+	if err := os.MkdirAll(pts, 0755); err != nil {
+		return err
+	}
+	ptsFlags := uintptr(syscall.MS_NOSUID | syscall.MS_NOEXEC)
+	if err := syscall.Mount("devpts", pts, "devpts", ptsFlags, "newinstance,ptmxmode=0666,mode=0620,gid=5"); err != nil {
+		// gid 5 (tty) isn't mapped in a rootless user namespace
+		if err := syscall.Mount("devpts", pts, "devpts", ptsFlags, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+			return fmt.Errorf("mount devpts error %v", err)
+		}
+	}
+	if err := os.Symlink("pts/ptmx", filepath.Join(dev, "ptmx")); err != nil {
+		return err
+	}
+
+	shm := filepath.Join(dev, "shm")
+	if err := os.MkdirAll(shm, 0755); err != nil {
+		return err
+	}
+	shmSize := config.ShmSize
+	if shmSize == "" {
+		shmSize = DefaultShmSize
+	}
+	if err := syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777,size="+shmSize); err != nil {
+		return fmt.Errorf("mount /dev/shm error %v", err)
+	}
+
+	for link, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(dev, link)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createDevice(rootfs string, device Device, bind bool) error {
+	path := filepath.Join(rootfs, device.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if bind {
+		f, err := os.OpenFile(path, os.O_CREATE, 0000)
+		if err != nil {
+			return fmt.Errorf("create %s error %v", path, err)
+		}
+		f.Close()
+		if err := syscall.Mount(device.HostPath, path, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind device %s error %v", device.HostPath, err)
+		}
+		return nil
+	}
+
+	mode := uint32(device.FileMode)
+	if device.Type == "b" {
+		mode |= syscall.S_IFBLK
+	} else {
+		mode |= syscall.S_IFCHR
+	}
+	// the umask would take the write bits of the others away
+	oldMask := syscall.Umask(0)
+	defer syscall.Umask(oldMask)
+	if err := syscall.Mknod(path, mode, unixMkdev(device.Major, device.Minor)); err != nil {
+		return fmt.Errorf("mknod %s error %v", path, err)
+	}
+	if err := os.Chown(path, int(device.Uid), int(device.Gid)); err != nil {
+		return fmt.Errorf("chown %s error %v", path, err)
+	}
+	return nil
+}
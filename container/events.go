@@ -0,0 +1,53 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventsLogName is the events log next to the containers' info dirs, one JSON event per line
+const EventsLogName = "events.log"
+
+// Event is something that happened to a container
+type Event struct {
+	Time   string `json:"time"` // RFC3339 with nanoseconds
+	Type   string `json:"type"` // container
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+}
+
+func EventsLogPath() string {
+	return path.Join(fmt.Sprintf(DefaultInfoLocation, ""), EventsLogName)
+}
+
+// LogEvent appends an event of the container to the events log. Losing one
+// must not fail what it reports on, so errors are only logged.
+func LogEvent(action string, info *ContainerInfo) {
+	content, err := json.Marshal(&Event{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Type:   "container",
+		Action: action,
+		ID:     info.Id,
+		Name:   info.Name,
+	})
+	if err != nil {
+		log.Warnf("Marshal %s event error %v", action, err)
+		return
+	}
+	// a single write with O_APPEND keeps concurrent lines whole
+	f, err := os.OpenFile(EventsLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Warnf("Open events log error %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		log.Warnf("Write %s event error %v", action, err)
+	}
+}
@@ -0,0 +1,47 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+)
+
+// ENV_NSENTER_PID makes the nsenter constructor join the namespaces of that pid,
+// it must match ENV_NSENTER_PID in nsenter.go
+const ENV_NSENTER_PID = "_MYDOCKER_NSENTER_PID"
+
+// RunExecInitProcess is the exec helper once nsenter moved it into the
+// container's namespaces: it reads the ProcessConfig behind the sync byte on
+// fd 3 and becomes the command. Its environment is already the command's.
+func RunExecInitProcess() error {
+	runtime.LockOSThread()
+	os.Unsetenv(ENV_NSENTER_PID)
+
+	pipe := os.NewFile(uintptr(3), "pipe")
+	msg, err := ioutil.ReadAll(pipe)
+	pipe.Close()
+	if err != nil {
+		return fmt.Errorf("exec init read pipe error %v", err)
+	}
+	var config ProcessConfig
+	if err := json.Unmarshal(msg, &config); err != nil {
+		return fmt.Errorf("unmarshal exec config error %v", err)
+	}
+	if len(config.Args) == 0 {
+		return fmt.Errorf("exec needs a command")
+	}
+	if config.Console {
+		if err := setUpConsole(os.NewFile(uintptr(ConsoleSocketFd), "console")); err != nil {
+			return err
+		}
+	}
+	// -w is created like at run, while we are still root
+	if config.Cwd != "" {
+		if err := os.MkdirAll(config.Cwd, 0755); err != nil {
+			return fmt.Errorf("create working dir %s error %v", config.Cwd, err)
+		}
+	}
+	return execProcess(&config)
+}
@@ -0,0 +1,121 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Exec session states
+const (
+	ExecCreated = "created"
+	ExecRunning = "running"
+	ExecExited  = "exited"
+	// ExecLost is a session left running by a mydocker that died before its command
+	ExecLost = "lost"
+)
+
+// ExecSessionsDir holds one <id>.json per exec in the container's info dir,
+// and the output of detached ones in <id>.log
+const ExecSessionsDir = "execs"
+
+// ExecSession records a command run in a container with mydocker exec
+type ExecSession struct {
+	ID         string   `json:"id"`
+	Command    []string `json:"command"`
+	User       string   `json:"user"`    // user[:group] it ran as, empty for the container's init user
+	Workdir    string   `json:"workdir"` // empty for the container's
+	Tty        bool     `json:"tty"`
+	Detach     bool     `json:"detach"`
+	Pid        int      `json:"pid"` // exec helper on the host, the command is its only child
+	Status     string   `json:"status"`
+	ExitCode   int      `json:"exitCode"`
+	StartedAt  string   `json:"startedAt"`
+	FinishedAt string   `json:"finishedAt"`
+	Error      string   `json:"error,omitempty"` // why it ended before or without its command
+}
+
+func execSessionsDir(containerName string) string {
+	return path.Join(fmt.Sprintf(DefaultInfoLocation, containerName), ExecSessionsDir)
+}
+
+// ExecLogPath is where a detached exec writes its output
+func ExecLogPath(containerName string, id string) string {
+	return path.Join(execSessionsDir(containerName), id+".log")
+}
+
+func SaveExecSession(containerName string, session *ExecSession) error {
+	dir := execSessionsDir(containerName)
+	// not MkdirAll, a detached exec outliving rm must not bring the container's dir back
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	content, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	// write and rename, ls must never see half a session
+	tmp := path.Join(dir, "."+session.ID+".json")
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, session.ID+".json"))
+}
+
+func GetExecSession(containerName string, id string) (*ExecSession, error) {
+	content, err := ioutil.ReadFile(path.Join(execSessionsDir(containerName), id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no exec session %s in container %s", id, containerName)
+		}
+		return nil, err
+	}
+	var session ExecSession
+	if err := json.Unmarshal(content, &session); err != nil {
+		return nil, fmt.Errorf("unmarshal exec session %s error %v", id, err)
+	}
+	session.checkAlive()
+	return &session, nil
+}
+
+// ListExecSessions returns the sessions of a container, oldest first
+func ListExecSessions(containerName string) ([]*ExecSession, error) {
+	files, err := ioutil.ReadDir(execSessionsDir(containerName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*ExecSession
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		session, err := GetExecSession(containerName, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt < sessions[j].StartedAt
+	})
+	return sessions, nil
+}
+
+// checkAlive marks a running session lost when its helper is gone
+func (s *ExecSession) checkAlive() {
+	if s.Status != ExecRunning || s.Pid == 0 {
+		return
+	}
+	if err := syscall.Kill(s.Pid, 0); err == syscall.ESRCH {
+		s.Status = ExecLost
+	}
+}
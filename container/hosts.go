@@ -0,0 +1,143 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Files generated for each container in its info dir and bound over the image's
+const (
+	HostsName      = "hosts"
+	ResolvConfName = "resolv.conf"
+	HostnameName   = "hostname"
+)
+
+// used when the host only has nameservers the container's network can't reach
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// ParseExtraHost parses a --add-host host:ip
+func ParseExtraHost(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+		return "", "", fmt.Errorf("invalid --add-host %q, expect host:ip", spec)
+	}
+	return parts[0], parts[1], nil
+}
+
+// ValidateHostname rejects what sethostname or resolvers wouldn't take
+func ValidateHostname(hostname string) error {
+	if len(hostname) == 0 || len(hostname) > 64 || strings.ContainsAny(hostname, " \t\n/") {
+		return fmt.Errorf("invalid hostname %q", hostname)
+	}
+	return nil
+}
+
+// DNSConfig holds --dns and --dns-search, empty ones keep what the host has
+type DNSConfig struct {
+	Nameservers []string
+	Search      []string
+}
+
+func hostsContent(hostname string, extraHosts []string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("127.0.0.1\tlocalhost\n")
+	buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	buf.WriteString("fe00::0\tip6-localnet\n")
+	buf.WriteString("ff00::0\tip6-mcastprefix\n")
+	buf.WriteString("ff02::1\tip6-allnodes\n")
+	buf.WriteString("ff02::2\tip6-allrouters\n")
+	// the container has no address of its own, its name resolves to loopback
+	fmt.Fprintf(&buf, "127.0.1.1\t%s\n", hostname)
+	for _, spec := range extraHosts {
+		host, ip, err := ParseExtraHost(spec)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, host)
+	}
+	return buf.Bytes(), nil
+}
+
+// resolvConfContent starts from the host's resolv.conf, dropping the
+// nameservers on loopback, which can't be reached from the container
+func resolvConfContent(hostResolvConf []byte, dns *DNSConfig) []byte {
+	var nameservers, search, others []string
+	for _, line := range strings.Split(string(hostResolvConf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) > 1 {
+				if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+					nameservers = append(nameservers, fields[1])
+				}
+			}
+		case "search", "domain":
+			search = fields[1:]
+		default:
+			others = append(others, line)
+		}
+	}
+	if len(dns.Nameservers) > 0 {
+		nameservers = dns.Nameservers
+	}
+	if len(nameservers) == 0 {
+		nameservers = defaultNameservers
+	}
+	if len(dns.Search) > 0 {
+		search = dns.Search
+	}
+
+	var buf bytes.Buffer
+	for _, ns := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	// "." clears the search list like docker's --dns-search=.
+	if len(search) > 0 && !(len(search) == 1 && search[0] == ".") {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	for _, line := range others {
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
+
+// WriteEtcFiles generates hosts, resolv.conf and hostname in the container's
+// info dir and returns the mounts binding them over the image's files
+func WriteEtcFiles(containerName string, hostname string, extraHosts []string, dns *DNSConfig) ([]Mount, error) {
+	dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
+
+	hosts, err := hostsContent(hostname, extraHosts)
+	if err != nil {
+		return nil, err
+	}
+	hostResolvConf, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		hostResolvConf = nil
+	}
+	files := []struct {
+		name    string
+		target  string
+		content []byte
+	}{
+		{HostsName, "/etc/hosts", hosts},
+		{ResolvConfName, "/etc/resolv.conf", resolvConfContent(hostResolvConf, dns)},
+		{HostnameName, "/etc/hostname", []byte(hostname + "\n")},
+	}
+
+	var mounts []Mount
+	for _, file := range files {
+		source := dirURL + file.name
+		if err := ioutil.WriteFile(source, file.content, 0644); err != nil {
+			return nil, fmt.Errorf("write %s error %v", source, err)
+		}
+		mounts = append(mounts, Mount{Source: source, Target: file.target, Type: "bind", Flags: syscall.MS_BIND})
+	}
+	return mounts, nil
+}
@@ -1,11 +1,14 @@
 package container
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 
@@ -14,41 +17,189 @@ import (
 )
 
 func RunContainerInitProcess() error {
-	cmdArray := readUserCommand()
+	// capabilities are per thread, the thread dropping them must be the one calling exec
+	runtime.LockOSThread()
+
+	config, err := readInitConfig()
+	if err != nil {
+		return err
+	}
+	if config.Reexec {
+		return reexecInit(config)
+	}
+	cmdArray := config.Args
 	if cmdArray == nil || len(cmdArray) == 0 {
 		return fmt.Errorf("Run container get user command error, cmdArray is nil")
 	}
 
-	setUpMount()
+	if err := setUpMount(config); err != nil {
+		return err
+	}
+	if config.Hostname != "" {
+		if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+			return fmt.Errorf("set hostname %s error %v", config.Hostname, err)
+		}
+	}
+	// the host placed us in the container's cgroups already, they become our cgroup root
+	if err := syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("unshare cgroup namespace error %v", err)
+	}
+	return execProcess(&config.ProcessConfig)
+}
 
-	path, err := exec.LookPath(cmdArray[0])
+// execProcess turns the calling thread into the container's process: seccomp,
+// capabilities, user, working directory, then execve. Both init and exec-init end here.
+func execProcess(config *ProcessConfig) error {
+	cmdArray := config.Args
+	capMask, err := CapabilityMask(config.Capabilities)
 	if err != nil {
-		log.Errorf("Exec loop path error %v", err)
 		return err
 	}
+	var filter []syscall.SockFilter
+	if config.Seccomp != nil {
+		if filter, err = config.Seccomp.Compile(config.Capabilities); err != nil {
+			return err
+		}
+	}
+	// Without no_new_privs installing a filter needs CAP_SYS_ADMIN, so it goes in
+	// before we drop it. The profile must allow what's left: setuid, capset and execve.
+	if filter != nil && !config.NoNewPrivileges {
+		if err := installSeccomp(filter); err != nil {
+			return err
+		}
+	}
+	if err := dropBoundingSet(capMask); err != nil {
+		return err
+	}
+	if config.User != "" {
+		if err := setUser(config.User); err != nil {
+			return err
+		}
+	}
+	// the working directory is entered as the user, like a shell of that user would
+	if config.Cwd != "" {
+		if err := syscall.Chdir(config.Cwd); err != nil {
+			return fmt.Errorf("chdir to working dir %s error %v", config.Cwd, err)
+		}
+	}
+	// like docker, a non root user only keeps the capabilities in its bounding set
+	if syscall.Getuid() != 0 {
+		capMask = 0
+	}
+	if err := setCapabilities(capMask); err != nil {
+		return err
+	}
+	if config.NoNewPrivileges {
+		if err := setNoNewPrivs(); err != nil {
+			return err
+		}
+	}
+
+	path, err := exec.LookPath(cmdArray[0])
+	if err != nil {
+		return newExecError(fmt.Errorf("exec look path error %v", err), err)
+	}
 	log.Infof("Find path %s", path)
-	if err := syscall.Exec(path, cmdArray[0:], os.Environ()); err != nil {
-		log.Errorf(err.Error())
+	// with no_new_privs the filter goes in last, so it only has to allow what the command does
+	if filter != nil && config.NoNewPrivileges {
+		if err := installSeccomp(filter); err != nil {
+			return err
+		}
 	}
-	return nil
+	err = syscall.Exec(path, cmdArray[0:], os.Environ())
+	return newExecError(fmt.Errorf("exec %s error %v", path, err), err)
+}
+
+// ExecError is a command that could not be executed. Like a shell, init and
+// exec-init exit with Code: 127 when it is not found, 126 when it can't run.
+type ExecError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExecError) Error() string {
+	return e.Err.Error()
 }
 
-func readUserCommand() []string {
+func newExecError(err error, cause error) *ExecError {
+	code := 126
+	if errors.Is(cause, os.ErrNotExist) || errors.Is(cause, exec.ErrNotFound) {
+		code = 127
+	}
+	return &ExecError{Code: code, Err: err}
+}
+
+func readInitConfig() (*InitConfig, error) {
 	pipe := os.NewFile(uintptr(3), "pipe")
 	defer pipe.Close()
 	msg, err := ioutil.ReadAll(pipe)
 	if err != nil {
 		log.Errorf("init read pipe error %v", err)
-		return nil
+		return nil, err
+	}
+	var config InitConfig
+	if err := json.Unmarshal(msg, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal init config error %v", err)
+	}
+	return &config, nil
+}
+
+// reexecInit runs init again with the same config on a fresh pipe at fd 3.
+// The id maps were written after our execve, so we are root of the user
+// namespace without any capability until we exec once more.
+func reexecInit(config *InitConfig) error {
+	config.Reexec = false
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	readPipe, writePipe, err := NewPipe()
+	if err != nil {
+		return err
+	}
+	// the config is far smaller than the pipe buffer, so this doesn't block
+	if _, err := writePipe.Write(content); err != nil {
+		return err
+	}
+	writePipe.Close()
+	if err := syscall.Dup3(int(readPipe.Fd()), 3, 0); err != nil {
+		return fmt.Errorf("dup init pipe error %v", err)
+	}
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+// setUser switches to the user the command runs as, groups first while we still may.
+// HOME comes from /etc/passwd unless the image or -e set it.
+func setUser(spec string) error {
+	u, err := LookupUser("/", spec)
+	if err != nil {
+		return err
+	}
+	// a user namespace mapped by an unprivileged user has setgroups denied
+	if err := syscall.Setgroups(u.Groups); err != nil && !setgroupsDenied() {
+		return fmt.Errorf("setgroups %v error %v", u.Groups, err)
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf("setgid %d error %v", u.Gid, err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf("setuid %d error %v", u.Uid, err)
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	if _, ok := os.LookupEnv("HOME"); !ok {
+		os.Setenv("HOME", u.Home)
+	}
+	return nil
+}
+
+func setgroupsDenied() bool {
+	content, err := ioutil.ReadFile("/proc/self/setgroups")
+	return err == nil && strings.TrimSpace(string(content)) == "deny"
 }
 
 /**
 Init 挂载点
 */
-func setUpMount() {
+func setUpMount(config *InitConfig) error {
 	// ensure that container mount and parent mount has no shared propagation
 	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
 		logrus.Errorf("mount / fails: %v", err)
@@ -57,16 +208,118 @@ func setUpMount() {
 	pwd, err := os.Getwd()
 	if err != nil {
 		log.Errorf("Get current location error %v", err)
-		return
+		return err
 	}
 	log.Infof("Current location is %s", pwd)
-	pivotRoot(pwd)
+	// a volume or tmpfs that isn't there would leave its data in the write layer
+	for _, m := range config.Mounts {
+		if err := mountInRootfs(pwd, m); err != nil {
+			return err
+		}
+	}
+	// a mount on "/" covers the directory we are in, step into the new mount
+	if err := syscall.Chdir(pwd); err != nil {
+		return fmt.Errorf("chdir %s error %v", pwd, err)
+	}
 
-	//mount proc
+	// mount proc before pivot_root: inside a user namespace the kernel only allows
+	// a new proc mount while the host's /proc is still visible in our namespace
 	defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
-	syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), "")
+	if err := mountInRootfs(pwd, Mount{Source: "proc", Target: "/proc", Type: "proc", Flags: uintptr(defaultMountFlags)}); err != nil {
+		return err
+	}
+	if err := mountInRootfs(pwd, Mount{Source: "tmpfs", Target: "/dev", Type: "tmpfs", Flags: syscall.MS_NOSUID | syscall.MS_STRICTATIME, Data: "mode=755"}); err != nil {
+		return err
+	}
+	if err := setUpDev(pwd, config); err != nil {
+		return err
+	}
+
+	if err := mountSysfs(filepath.Join(pwd, "sys"), config.Privileged); err != nil {
+		return err
+	}
+	// masking uses the host's /dev/null, so it is done before pivot_root too
+	for _, p := range config.ReadonlyPaths {
+		if err := readonlyPath(filepath.Join(pwd, p)); err != nil {
+			return err
+		}
+	}
+	for _, p := range config.MaskedPaths {
+		if err := maskPath(filepath.Join(pwd, p), "/dev/null"); err != nil {
+			return err
+		}
+	}
 
-	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
+	if err := pivotRoot(pwd); err != nil {
+		return err
+	}
+	// -w is created if the image doesn't have it, while the root is still writable
+	if config.Cwd != "" {
+		if err := os.MkdirAll(config.Cwd, 0755); err != nil {
+			return fmt.Errorf("create working dir %s error %v", config.Cwd, err)
+		}
+	}
+	if config.ReadonlyRootfs {
+		return remountReadonly("/")
+	}
+	return nil
+}
+
+// mountSysfs mounts /sys read-only unless privileged. A sysfs can only be mounted
+// by the user namespace owning our network namespace, otherwise bind the host's.
+func mountSysfs(target string, privileged bool) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	if !privileged {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := syscall.Mount("sysfs", target, "sysfs", flags, ""); err == nil {
+		return nil
+	}
+	if err := syscall.Mount("/sys", target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mount sysfs on %s error %v", target, err)
+	}
+	if privileged {
+		return nil
+	}
+	return remountReadonly(target)
+}
+
+// mountInRootfs does a mount the host couldn't do, relative to the future root
+func mountInRootfs(rootfs string, m Mount) error {
+	target := filepath.Join(rootfs, m.Target)
+	if err := makeMountPoint(target, m); err != nil {
+		return fmt.Errorf("create mount point %s error %v", target, err)
+	}
+	if err := syscall.Mount(m.Source, target, m.Type, m.Flags, m.Data); err != nil {
+		return fmt.Errorf("mount %s on %s error %v", m.Source, target, err)
+	}
+	return nil
+}
+
+// makeMountPoint creates a file for a file bind and a directory otherwise.
+// A symlink of the image is replaced, it would be followed on the host's root.
+func makeMountPoint(target string, m Mount) error {
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	if m.Flags&syscall.MS_BIND != 0 {
+		if info, err := os.Stat(m.Source); err == nil && !info.IsDir() {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+	}
+	return os.MkdirAll(target, 0755)
 }
 
 func pivotRoot(root string) error {
@@ -0,0 +1,241 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ClockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. The
+// kernel reports them in 1/100 s on every architecture we build for.
+const ClockTicks = 100
+
+// Process is a process of a container as seen from the host
+type Process struct {
+	Pid          int    // on the host
+	ContainerPid int    // in the container's pid namespace
+	PPid         int    // on the host
+	Uid          int    // real uid on the host
+	State        string // R, S, D, Z, ...
+	CpuTicks     uint64 // user and system time, with that of its waited-for children
+	RssBytes     uint64
+	ReadBytes    uint64 // from /proc/<pid>/io, 0 when we may not read it
+	WriteBytes   uint64
+	Command      string
+}
+
+// NamespaceProcesses lists the processes in the pid namespace of pid, the
+// container's init. Exec sessions join it, so their commands are in the list.
+func NamespaceProcesses(pid string) ([]*Process, error) {
+	nsPid, err := os.Readlink(fmt.Sprintf("/proc/%s/ns/pid", pid))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var processes []*Process
+	for _, entry := range entries {
+		hostPid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// processes may exit while we look at them, skip those
+		if ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", hostPid)); err != nil || ns != nsPid {
+			continue
+		}
+		process, err := readProcess(hostPid)
+		if err != nil {
+			continue
+		}
+		processes = append(processes, process)
+	}
+	if len(processes) == 0 {
+		return nil, fmt.Errorf("no process in the pid namespace of %s", pid)
+	}
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].ContainerPid < processes[j].ContainerPid
+	})
+	return processes, nil
+}
+
+func readProcess(pid int) (*Process, error) {
+	p := &Process{Pid: pid}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// pid (comm) state ppid ..., comm may hold spaces and parentheses
+	end := strings.LastIndex(string(stat), ")")
+	if end < 0 {
+		return nil, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	p.State = fields[0]
+	p.PPid, _ = strconv.Atoi(fields[1])
+	// utime stime cutime cstime are fields 14 to 17
+	for _, field := range fields[11:15] {
+		ticks, _ := strconv.ParseInt(field, 10, 64)
+		p.CpuTicks += uint64(ticks)
+	}
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	p.RssBytes = rss * uint64(os.Getpagesize())
+
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	p.ContainerPid = pid
+	for _, line := range strings.Split(string(status), "\n") {
+		values := strings.Fields(line)
+		if len(values) < 2 {
+			continue
+		}
+		switch values[0] {
+		case "Uid:":
+			p.Uid, _ = strconv.Atoi(values[1])
+		case "NSpid:":
+			// the last one is the innermost namespace
+			p.ContainerPid, _ = strconv.Atoi(values[len(values)-1])
+		}
+	}
+
+	if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+		p.Command = strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1))
+	} else {
+		// kernel threads and zombies have no cmdline
+		p.Command = "[" + string(stat[strings.Index(string(stat), "(")+1:end]) + "]"
+	}
+
+	if io, err := readKeyValueFile(fmt.Sprintf("/proc/%d/io", pid)); err == nil {
+		p.ReadBytes = io["read_bytes"]
+		p.WriteBytes = io["write_bytes"]
+	}
+	return p, nil
+}
+
+// NetworkStats sums the bytes of every interface but lo in a network namespace
+func NetworkStats(pid string) (rxBytes uint64, txBytes uint64, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%s/net/dev", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// iface: rx_bytes packets errs drop fifo frame compressed multicast tx_bytes ...
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseUint(fields[0], 10, 64)
+		tx, _ := strconv.ParseUint(fields[8], 10, 64)
+		rxBytes += rx
+		txBytes += tx
+	}
+	return rxBytes, txBytes, scanner.Err()
+}
+
+// HostMemory is MemTotal of /proc/meminfo, in bytes
+func HostMemory() (uint64, error) {
+	meminfo, err := readKeyValueFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	return meminfo["MemTotal"] * 1024, nil
+}
+
+// readKeyValueFile reads "key: value [kB]" lines
+func readKeyValueFile(path string) (map[string]uint64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			values[strings.TrimSpace(parts[0])] = value
+		}
+	}
+	return values, nil
+}
+
+// ProcessStartTime is when pid started, in clock ticks after boot. With the
+// pid it tells a process apart from a later one that got the same pid.
+func ProcessStartTime(pid int) (uint64, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	// starttime is field 22, the 20th after comm
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// procStatFields are the fields of /proc/<pid>/stat after comm, from state on
+func procStatFields(pid int) ([]string, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	end := strings.LastIndex(string(stat), ")")
+	if end < 0 {
+		return nil, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
+
+// BootID is different after every boot
+func BootID() string {
+	content, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// InitAlive tells if the container's init is still running. Containers
+// recorded without a start time only get their pid checked.
+func InitAlive(info *ContainerInfo) bool {
+	pid, err := strconv.Atoi(info.Pid)
+	if err != nil || pid <= 0 {
+		return false
+	}
+	if info.PidStartTime == 0 {
+		return syscall.Kill(pid, 0) != syscall.ESRCH
+	}
+	if info.BootID != "" && info.BootID != BootID() {
+		return false
+	}
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return false
+	}
+	// a zombie init is dead, it only waits to be reaped
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	return err == nil && startTime == info.PidStartTime && fields[0] != "Z"
+}
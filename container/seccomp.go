@@ -0,0 +1,462 @@
+package container
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// SeccompProfile uses the same JSON format as docker's seccomp profiles
+type SeccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint32          `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	ArchMap         []SeccompArchMap `json:"archMap,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls"`
+}
+
+type SeccompArchMap struct {
+	Architecture     string   `json:"architecture"`
+	SubArchitectures []string `json:"subArchitectures"`
+}
+
+type SeccompSyscall struct {
+	Names    []string      `json:"names"`
+	Action   string        `json:"action"`
+	ErrnoRet *uint32       `json:"errnoRet,omitempty"`
+	Args     []SeccompArg  `json:"args,omitempty"`
+	Includes SeccompFilter `json:"includes,omitempty"`
+	Excludes SeccompFilter `json:"excludes,omitempty"`
+	Comment  string        `json:"comment,omitempty"`
+}
+
+// SeccompArg compares an argument of the syscall, for SCMP_CMP_MASKED_EQ
+// Value is the mask and ValueTwo the expected result
+type SeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// SeccompFilter restricts a rule to some architectures or capabilities
+type SeccompFilter struct {
+	Arches []string `json:"arches,omitempty"`
+	Caps   []string `json:"caps,omitempty"`
+}
+
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	// offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// seccompArch is an architecture the kernel can run syscalls of, the native
+// one or a 32 bit one, with the numbers to resolve the names in profiles with
+type seccompArch struct {
+	name      string // SCMP_ARCH_*
+	shortName string // in includes and excludes, e.g. amd64
+	auditArch uint32
+	syscalls  map[string]uint32
+	wideArgs  bool // arguments are 64 bit, else only their low word counts
+	// syscall numbers from here on are of a sub architecture sharing the
+	// audit arch, we have no table for them
+	subArchNr uint32
+}
+
+// SeccompProfileName is where the profile of a container is kept, next to ConfigName
+const SeccompProfileName = "seccomp.json"
+
+// ResolveSeccomp turns --security-opt seccomp=<choice> into a profile, nil means
+// unconfined. --privileged turns seccomp off unless a profile is given explicitly.
+func ResolveSeccomp(choice string, privileged bool) (*SeccompProfile, string, error) {
+	switch {
+	case choice == "unconfined" || (choice == "" && privileged):
+		return nil, "unconfined", nil
+	case choice == "":
+		return DefaultSeccompProfile(), "default", nil
+	}
+	profile, err := LoadSeccompProfile(choice)
+	if err != nil {
+		return nil, "", err
+	}
+	return profile, choice, nil
+}
+
+// LoadSeccompProfile reads a profile from a --security-opt seccomp=<file> value
+func LoadSeccompProfile(path string) (*SeccompProfile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile SeccompProfile
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return nil, fmt.Errorf("unmarshal seccomp profile %s error %v", path, err)
+	}
+	if _, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = *errnoRet
+	}
+	switch action {
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | (errno & 0xffff), nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace | (errno & 0xffff), nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	}
+	return 0, fmt.Errorf("unknown seccomp action %q", action)
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// applies tells if a rule is meant for this architecture and these capabilities
+func (s *SeccompSyscall) applies(arch *seccompArch, caps []string) bool {
+	if len(s.Includes.Arches) > 0 && !contains(s.Includes.Arches, arch.shortName) {
+		return false
+	}
+	if len(s.Excludes.Arches) > 0 && contains(s.Excludes.Arches, arch.shortName) {
+		return false
+	}
+	for _, capName := range s.Includes.Caps {
+		if !contains(caps, normalizeCapability(capName)) {
+			return false
+		}
+	}
+	for _, capName := range s.Excludes.Caps {
+		if contains(caps, normalizeCapability(capName)) {
+			return false
+		}
+	}
+	return true
+}
+
+// arches are the native architecture and the listed ones of compatArches,
+// directly or as sub architectures of the native one in archMap
+func (profile *SeccompProfile) arches() []*seccompArch {
+	names := profile.Architectures
+	for _, m := range profile.ArchMap {
+		if m.Architecture == nativeArch.name {
+			names = append(names, m.SubArchitectures...)
+		}
+	}
+	arches := []*seccompArch{nativeArch}
+	for _, arch := range compatArches {
+		if contains(names, arch.name) {
+			arches = append(arches, arch)
+		}
+	}
+	return arches
+}
+
+// bpfProgram is a tiny assembler resolving jumps to labels
+type bpfProgram struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+type bpfInsn struct {
+	syscall.SockFilter
+	jt, jf string // labels, "" means the next instruction
+	ja     string // label of an unconditional jump, it goes further than 255
+}
+
+func newBpfProgram() *bpfProgram {
+	return &bpfProgram{labels: map[string]int{}}
+}
+
+func (p *bpfProgram) stmt(code uint16, k uint32) {
+	p.insns = append(p.insns, bpfInsn{SockFilter: syscall.SockFilter{Code: code, K: k}})
+}
+
+func (p *bpfProgram) jump(code uint16, k uint32, jt string, jf string) {
+	p.insns = append(p.insns, bpfInsn{SockFilter: syscall.SockFilter{Code: code, K: k}, jt: jt, jf: jf})
+}
+
+func (p *bpfProgram) jumpTo(label string) {
+	p.insns = append(p.insns, bpfInsn{SockFilter: syscall.SockFilter{Code: bpfJa}, ja: label})
+}
+
+func (p *bpfProgram) label(name string) {
+	p.labels[name] = len(p.insns)
+}
+
+func (p *bpfProgram) offset(from int, label string) (uint8, error) {
+	if label == "" {
+		return 0, nil
+	}
+	to, ok := p.labels[label]
+	if !ok {
+		return 0, fmt.Errorf("undefined bpf label %s", label)
+	}
+	off := to - from - 1
+	if off < 0 || off > 255 {
+		return 0, fmt.Errorf("bpf jump to %s out of range", label)
+	}
+	return uint8(off), nil
+}
+
+func (p *bpfProgram) farOffset(from int, label string) (uint32, error) {
+	to, ok := p.labels[label]
+	if !ok {
+		return 0, fmt.Errorf("undefined bpf label %s", label)
+	}
+	if to <= from {
+		return 0, fmt.Errorf("bpf jump to %s goes backwards", label)
+	}
+	return uint32(to - from - 1), nil
+}
+
+func (p *bpfProgram) assemble() ([]syscall.SockFilter, error) {
+	var filter []syscall.SockFilter
+	for i, insn := range p.insns {
+		jt, err := p.offset(i, insn.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := p.offset(i, insn.jf)
+		if err != nil {
+			return nil, err
+		}
+		insn.Jt, insn.Jf = jt, jf
+		if insn.ja != "" {
+			if insn.K, err = p.farOffset(i, insn.ja); err != nil {
+				return nil, err
+			}
+		}
+		filter = append(filter, insn.SockFilter)
+	}
+	if len(filter) > 4096 {
+		return nil, fmt.Errorf("seccomp filter has %d instructions, the kernel allows 4096", len(filter))
+	}
+	return filter, nil
+}
+
+const (
+	bpfLdAbsW = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+	bpfJeq    = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+	bpfJgt    = syscall.BPF_JMP | syscall.BPF_JGT | syscall.BPF_K
+	bpfJge    = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+	bpfJa     = syscall.BPF_JMP | syscall.BPF_JA
+	bpfAnd    = syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K
+	bpfRet    = syscall.BPF_RET | syscall.BPF_K
+)
+
+// argument words are little endian on every architecture we have a syscall table for
+func argLow(index uint) uint32  { return seccompDataArgs + uint32(index)*8 }
+func argHigh(index uint) uint32 { return seccompDataArgs + uint32(index)*8 + 4 }
+
+// compareArg jumps to pass when the argument matches, else to fail. Only
+// 64 bit architectures compare the high word.
+func (p *bpfProgram) compareArg(arg SeccompArg, wide bool, pass string, fail string, id string) error {
+	if arg.Index > 5 {
+		return fmt.Errorf("seccomp arg index %d out of range", arg.Index)
+	}
+	hi, lo := uint32(arg.Value>>32), uint32(arg.Value)
+	checkLow := id + "-lo"
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		if wide {
+			p.stmt(bpfLdAbsW, argHigh(arg.Index))
+			p.jump(bpfJeq, hi, "", fail)
+		}
+		p.stmt(bpfLdAbsW, argLow(arg.Index))
+		p.jump(bpfJeq, lo, pass, fail)
+	case "SCMP_CMP_NE":
+		if wide {
+			p.stmt(bpfLdAbsW, argHigh(arg.Index))
+			p.jump(bpfJeq, hi, "", pass)
+		}
+		p.stmt(bpfLdAbsW, argLow(arg.Index))
+		p.jump(bpfJeq, lo, fail, pass)
+	case "SCMP_CMP_MASKED_EQ":
+		if wide {
+			p.stmt(bpfLdAbsW, argHigh(arg.Index))
+			p.stmt(bpfAnd, hi)
+			p.jump(bpfJeq, uint32(arg.ValueTwo>>32), "", fail)
+		}
+		p.stmt(bpfLdAbsW, argLow(arg.Index))
+		p.stmt(bpfAnd, lo)
+		p.jump(bpfJeq, uint32(arg.ValueTwo), pass, fail)
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		if wide {
+			p.stmt(bpfLdAbsW, argHigh(arg.Index))
+			p.jump(bpfJgt, hi, pass, "")
+			p.jump(bpfJeq, hi, checkLow, fail)
+			p.label(checkLow)
+		}
+		p.stmt(bpfLdAbsW, argLow(arg.Index))
+		if arg.Op == "SCMP_CMP_GT" {
+			p.jump(bpfJgt, lo, pass, fail)
+		} else {
+			p.jump(bpfJge, lo, pass, fail)
+		}
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		if wide {
+			p.stmt(bpfLdAbsW, argHigh(arg.Index))
+			p.jump(bpfJge, hi, "", pass)
+			p.jump(bpfJeq, hi, checkLow, fail)
+			p.label(checkLow)
+		}
+		p.stmt(bpfLdAbsW, argLow(arg.Index))
+		if arg.Op == "SCMP_CMP_LT" {
+			p.jump(bpfJge, lo, fail, pass)
+		} else {
+			p.jump(bpfJgt, lo, fail, pass)
+		}
+	default:
+		return fmt.Errorf("unknown seccomp operator %q", arg.Op)
+	}
+	return nil
+}
+
+// Compile turns the profile into a BPF program. Each architecture the
+// profile lists and we have a syscall table for gets the rules resolved with
+// that table; syscalls of the other ones kill the process, whatever the
+// default action, so they can't go around the rules. Syscalls unknown to an
+// architecture are skipped, like libseccomp does.
+func (profile *SeccompProfile) Compile(caps []string) ([]syscall.SockFilter, error) {
+	if nativeArch == nil {
+		return nil, fmt.Errorf("seccomp profiles are not supported on this architecture")
+	}
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	arches := profile.arches()
+
+	p := newBpfProgram()
+	// 1. Dispatch on the architecture, conditional jumps only go 255 far
+	p.stmt(bpfLdAbsW, seccompDataArch)
+	for _, arch := range arches {
+		next := arch.name + "-not"
+		p.jump(bpfJeq, arch.auditArch, "", next)
+		p.jumpTo(arch.name)
+		p.label(next)
+	}
+	p.stmt(bpfRet, seccompRetKillProcess)
+
+	// 2. One block per syscall and rule, the first matching rule wins
+	ruleCount := 0
+	for _, arch := range arches {
+		p.label(arch.name)
+		if arch.subArchNr != 0 {
+			rules := arch.name + "-rules"
+			p.stmt(bpfLdAbsW, seccompDataNr)
+			p.jump(bpfJge, arch.subArchNr, "", rules)
+			p.stmt(bpfRet, seccompRetKillProcess)
+			p.label(rules)
+		}
+		for _, rule := range profile.Syscalls {
+			if !rule.applies(arch, caps) {
+				continue
+			}
+			action, err := seccompAction(rule.Action, rule.ErrnoRet)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range rule.Names {
+				nr, ok := arch.syscalls[name]
+				if !ok {
+					continue
+				}
+				ruleCount++
+				id := fmt.Sprintf("rule%d", ruleCount)
+				next := id + "-next"
+				p.stmt(bpfLdAbsW, seccompDataNr)
+				p.jump(bpfJeq, nr, "", next)
+				for i, arg := range rule.Args {
+					pass := fmt.Sprintf("%s-arg%d", id, i+1)
+					if err := p.compareArg(arg, arch.wideArgs, pass, next, fmt.Sprintf("%s-arg%d", id, i)); err != nil {
+						return nil, err
+					}
+					p.label(pass)
+				}
+				p.stmt(bpfRet, action)
+				p.label(next)
+			}
+		}
+		p.stmt(bpfRet, defaultAction)
+	}
+
+	return p.assemble()
+}
+
+// installSeccomp loads the filter for the calling thread, which must be
+// the thread going to exec since filters are per thread
+func installSeccomp(filter []syscall.SockFilter) error {
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("install seccomp filter error %v", errno)
+	}
+	return nil
+}
+
+// EncodeSeccompFilter hex encodes the raw program, for nsenter to install in exec sessions
+func EncodeSeccompFilter(filter []syscall.SockFilter) string {
+	raw := make([]byte, 0, len(filter)*8)
+	for _, insn := range filter {
+		b := (*[8]byte)(unsafe.Pointer(&insn))
+		raw = append(raw, b[:]...)
+	}
+	return hex.EncodeToString(raw)
+}
+
+// SaveSeccompProfile keeps the profile of a container in its info dir, exec sessions load it from there
+func SaveSeccompProfile(containerName string, profile *SeccompProfile) error {
+	content, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fmt.Sprintf(DefaultInfoLocation, containerName)+SeccompProfileName, content, 0644)
+}
+
+// GetSeccompProfile returns nil for a container running unconfined
+func GetSeccompProfile(containerName string) (*SeccompProfile, error) {
+	path := fmt.Sprintf(DefaultInfoLocation, containerName) + SeccompProfileName
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return LoadSeccompProfile(path)
+}
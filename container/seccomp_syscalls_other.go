@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package container
+
+// Seccomp profiles can't be resolved on this architecture, only unconfined works
+
+var (
+	nativeArch   *seccompArch
+	compatArches []*seccompArch
+)
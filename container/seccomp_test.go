@@ -0,0 +1,241 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+// runBpf runs a seccomp program on the seccomp_data of a call, like the
+// kernel would, and returns what it returned
+func runBpf(t *testing.T, filter []syscall.SockFilter, arch uint32, nr uint32, args [6]uint64) uint32 {
+	t.Helper()
+	data := make([]byte, seccompDataArgs+6*8)
+	binary.LittleEndian.PutUint32(data[seccompDataNr:], nr)
+	binary.LittleEndian.PutUint32(data[seccompDataArch:], arch)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(data[seccompDataArgs+i*8:], arg)
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		insn := filter[pc]
+		switch insn.Code {
+		case bpfLdAbsW:
+			if int(insn.K)+4 > len(data) {
+				t.Fatalf("insn %d loads out of seccomp_data at %d", pc, insn.K)
+			}
+			acc = binary.LittleEndian.Uint32(data[insn.K:])
+		case bpfAnd:
+			acc &= insn.K
+		case bpfJa:
+			pc += int(insn.K)
+		case bpfJeq, bpfJgt, bpfJge:
+			var taken bool
+			switch insn.Code {
+			case bpfJeq:
+				taken = acc == insn.K
+			case bpfJgt:
+				taken = acc > insn.K
+			case bpfJge:
+				taken = acc >= insn.K
+			}
+			if taken {
+				pc += int(insn.Jt)
+			} else {
+				pc += int(insn.Jf)
+			}
+		case bpfRet:
+			return insn.K
+		default:
+			t.Fatalf("insn %d has unexpected code %#x", pc, insn.Code)
+		}
+	}
+	t.Fatal("program fell off its end")
+	return 0
+}
+
+func needSeccompArch(t *testing.T) {
+	if nativeArch == nil {
+		t.Skip("no seccomp syscall table for this architecture")
+	}
+}
+
+func compileProfile(t *testing.T, profile *SeccompProfile) []syscall.SockFilter {
+	t.Helper()
+	filter, err := profile.Compile(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+var errnoEPERM = seccompRetErrno | uint32(syscall.EPERM)
+
+// argProfile allows personality only when its first argument matches arg
+func argProfile(arg SeccompArg, arches ...string) *SeccompProfile {
+	return &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ERRNO",
+		Architectures: arches,
+		Syscalls: []SeccompSyscall{
+			{Names: []string{"personality"}, Action: "SCMP_ACT_ALLOW", Args: []SeccompArg{arg}},
+		},
+	}
+}
+
+func TestSeccompCompareArg(t *testing.T) {
+	needSeccompArch(t)
+	const boundary = uint64(1) << 32
+	values := []uint64{0, 1, boundary - 2, boundary - 1, boundary, boundary + 1, boundary + boundary - 1, 1<<63 + 1, ^uint64(0)}
+	ops := map[string]func(arg uint64, value uint64) bool{
+		"SCMP_CMP_EQ": func(arg, value uint64) bool { return arg == value },
+		"SCMP_CMP_NE": func(arg, value uint64) bool { return arg != value },
+		"SCMP_CMP_GT": func(arg, value uint64) bool { return arg > value },
+		"SCMP_CMP_GE": func(arg, value uint64) bool { return arg >= value },
+		"SCMP_CMP_LT": func(arg, value uint64) bool { return arg < value },
+		"SCMP_CMP_LE": func(arg, value uint64) bool { return arg <= value },
+	}
+	nr := nativeArch.syscalls["personality"]
+	for op, want := range ops {
+		for _, value := range values {
+			filter := compileProfile(t, argProfile(SeccompArg{Index: 0, Value: value, Op: op}))
+			for _, arg := range values {
+				expect := errnoEPERM
+				if want(arg, value) {
+					expect = seccompRetAllow
+				}
+				if got := runBpf(t, filter, nativeArch.auditArch, nr, [6]uint64{arg}); got != expect {
+					t.Errorf("%s %#x: arg %#x returned %#x, want %#x", op, value, arg, got, expect)
+				}
+			}
+		}
+	}
+}
+
+func TestSeccompMaskedEq(t *testing.T) {
+	needSeccompArch(t)
+	nr := nativeArch.syscalls["personality"]
+	// the mask and the result span both words
+	filter := compileProfile(t, argProfile(SeccompArg{Index: 2, Value: 0x1000000ff, ValueTwo: 0x100000001, Op: "SCMP_CMP_MASKED_EQ"}))
+	for _, c := range []struct {
+		arg   uint64
+		allow bool
+	}{
+		{0x100000001, true},
+		{0xf10000f01, true},
+		{0x000000001, false},
+		{0x100000002, false},
+		{0x200000001, false},
+	} {
+		expect := errnoEPERM
+		if c.allow {
+			expect = seccompRetAllow
+		}
+		if got := runBpf(t, filter, nativeArch.auditArch, nr, [6]uint64{0, 0, c.arg}); got != expect {
+			t.Errorf("masked arg %#x returned %#x, want %#x", c.arg, got, expect)
+		}
+	}
+}
+
+func TestSeccompCompatArchArgs(t *testing.T) {
+	needSeccompArch(t)
+	if len(compatArches) == 0 {
+		t.Skip("no 32 bit architecture")
+	}
+	compat := compatArches[0]
+	nr := compat.syscalls["personality"]
+	filter := compileProfile(t, argProfile(SeccompArg{Index: 0, Value: 8, Op: "SCMP_CMP_EQ"}, compat.name))
+	// only the low word of a 32 bit call's argument counts
+	for arg, expect := range map[uint64]uint32{
+		8:             seccompRetAllow,
+		0xffffffff:    errnoEPERM,
+		1<<32 | 8:     seccompRetAllow,
+		1<<32 | 0x108: errnoEPERM,
+	} {
+		if got := runBpf(t, filter, compat.auditArch, nr, [6]uint64{arg}); got != expect {
+			t.Errorf("%s arg %#x returned %#x, want %#x", compat.shortName, arg, got, expect)
+		}
+	}
+}
+
+func TestSeccompArches(t *testing.T) {
+	needSeccompArch(t)
+	profile := &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []SeccompSyscall{
+			{Names: []string{"personality"}, Action: "SCMP_ACT_ERRNO"},
+		},
+	}
+	filter := compileProfile(t, profile)
+	native := nativeArch.syscalls["personality"]
+	if got := runBpf(t, filter, nativeArch.auditArch, native, [6]uint64{}); got != errnoEPERM {
+		t.Errorf("native personality returned %#x, want %#x", got, errnoEPERM)
+	}
+	if got := runBpf(t, filter, nativeArch.auditArch, nativeArch.syscalls["read"], [6]uint64{}); got != seccompRetAllow {
+		t.Errorf("native read returned %#x, want allow", got)
+	}
+	// an architecture of another machine, and one not listed, can't go around the rules
+	if got := runBpf(t, filter, 0x12345678, native, [6]uint64{}); got != seccompRetKillProcess {
+		t.Errorf("foreign arch returned %#x, want kill", got)
+	}
+	for _, compat := range compatArches {
+		if got := runBpf(t, filter, compat.auditArch, compat.syscalls["read"], [6]uint64{}); got != seccompRetKillProcess {
+			t.Errorf("unlisted %s returned %#x, want kill", compat.shortName, got)
+		}
+	}
+	if nativeArch.subArchNr != 0 {
+		if got := runBpf(t, filter, nativeArch.auditArch, nativeArch.subArchNr|native, [6]uint64{}); got != seccompRetKillProcess {
+			t.Errorf("sub arch call returned %#x, want kill", got)
+		}
+	}
+
+	// listed in archMap, the compat arch gets the rules with its own numbers
+	for _, compat := range compatArches {
+		profile.ArchMap = []SeccompArchMap{{Architecture: nativeArch.name, SubArchitectures: []string{compat.name}}}
+		filter := compileProfile(t, profile)
+		if got := runBpf(t, filter, compat.auditArch, compat.syscalls["personality"], [6]uint64{}); got != errnoEPERM {
+			t.Errorf("%s personality returned %#x, want %#x", compat.shortName, got, errnoEPERM)
+		}
+		if got := runBpf(t, filter, compat.auditArch, compat.syscalls["read"], [6]uint64{}); got != seccompRetAllow {
+			t.Errorf("%s read returned %#x, want allow", compat.shortName, got)
+		}
+	}
+}
+
+func TestSeccompDefaultProfile(t *testing.T) {
+	needSeccompArch(t)
+	filter := compileProfile(t, DefaultSeccompProfile())
+	// the blocks of the later architectures are out of reach of a conditional jump
+	if len(filter) <= 255 {
+		t.Fatalf("default profile has %d instructions, expected far jumps", len(filter))
+	}
+	for _, arch := range append([]*seccompArch{nativeArch}, compatArches...) {
+		for name, expect := range map[string]uint32{
+			"read":   seccompRetAllow,
+			"reboot": errnoEPERM,
+		} {
+			nr, ok := arch.syscalls[name]
+			if !ok {
+				t.Fatalf("%s has no %s", arch.shortName, name)
+			}
+			if got := runBpf(t, filter, arch.auditArch, nr, [6]uint64{}); got != expect {
+				t.Errorf("%s %s returned %#x, want %#x", arch.shortName, name, got, expect)
+			}
+		}
+	}
+}
+
+func TestSeccompCompileErrors(t *testing.T) {
+	needSeccompArch(t)
+	for _, profile := range []*SeccompProfile{
+		{DefaultAction: "SCMP_ACT_NOPE"},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_NOPE"}}},
+		argProfile(SeccompArg{Index: 6, Op: "SCMP_CMP_EQ"}),
+		argProfile(SeccompArg{Index: 0, Op: "SCMP_CMP_NOPE"}),
+	} {
+		if _, err := profile.Compile(nil); err == nil {
+			t.Errorf("no error for %s", fmt.Sprint(profile))
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const prSetNoNewPrivs = 38
+
+// DefaultMaskedPaths are hidden from the container, like docker does
+var DefaultMaskedPaths = []string{
+	"/proc/asound",
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// DefaultReadonlyPaths stay visible but can't be written
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// SecurityOptions are the values of --security-opt
+type SecurityOptions struct {
+	Seccomp         string // profile file, "unconfined" or "" for the default profile
+	NoNewPrivileges bool
+}
+
+// ParseSecurityOpts accepts seccomp=<profile.json|unconfined> and no-new-privileges[=true|false]
+func ParseSecurityOpts(opts []string) (*SecurityOptions, error) {
+	security := &SecurityOptions{NoNewPrivileges: true}
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		switch {
+		case parts[0] == "seccomp" && len(parts) == 2:
+			security.Seccomp = parts[1]
+		case parts[0] == "no-new-privileges":
+			if len(parts) == 1 {
+				security.NoNewPrivileges = true
+				continue
+			}
+			value, err := strconv.ParseBool(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid --security-opt %q, expect no-new-privileges=<true|false>", opt)
+			}
+			security.NoNewPrivileges = value
+		default:
+			return nil, fmt.Errorf("invalid --security-opt %q", opt)
+		}
+	}
+	return security, nil
+}
+
+// ParseTmpfs turns a --tmpfs path[:options] into a mount, options are the ones of mount -t tmpfs
+func ParseTmpfs(spec string) (Mount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if !filepath.IsAbs(parts[0]) {
+		return Mount{}, fmt.Errorf("invalid --tmpfs %q, the path must be absolute", spec)
+	}
+	m := Mount{Source: "tmpfs", Target: parts[0], Type: "tmpfs", Flags: syscall.MS_NOSUID | syscall.MS_NODEV}
+	if len(parts) == 1 {
+		return m, nil
+	}
+	var data []string
+	for _, option := range strings.Split(parts[1], ",") {
+		switch option {
+		case "ro":
+			m.Flags |= syscall.MS_RDONLY
+		case "rw":
+			m.Flags &^= syscall.MS_RDONLY
+		case "noexec":
+			m.Flags |= syscall.MS_NOEXEC
+		case "exec":
+			m.Flags &^= syscall.MS_NOEXEC
+		case "suid":
+			m.Flags &^= syscall.MS_NOSUID
+		case "dev":
+			m.Flags &^= syscall.MS_NODEV
+		case "nosuid", "nodev", "":
+		default:
+			data = append(data, option)
+		}
+	}
+	m.Data = strings.Join(data, ",")
+	return m, nil
+}
+
+// maskPath hides a file behind /dev/null and a directory behind an empty read-only tmpfs
+func maskPath(path string, devNull string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "size=0")
+	} else {
+		err = syscall.Mount(devNull, path, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("mask %s error %v", path, err)
+	}
+	return nil
+}
+
+// readonlyPath bind mounts path on itself and makes that read-only
+func readonlyPath(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s error %v", path, err)
+	}
+	return remountReadonly(path)
+}
+
+// remountReadonly keeps the flags of the mount at path, a user namespace
+// doesn't let us clear nosuid, nodev, noexec or the atime flags
+func remountReadonly(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fmt.Errorf("statfs %s error %v", path, err)
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	// ST_* values match the MS_* ones except relatime
+	for _, f := range []uintptr{syscall.MS_NOSUID, syscall.MS_NODEV, syscall.MS_NOEXEC, syscall.MS_NOATIME, syscall.MS_NODIRATIME} {
+		if uintptr(st.Flags)&f != 0 {
+			flags |= f
+		}
+	}
+	if st.Flags&0x1000 != 0 { // ST_RELATIME
+		flags |= syscall.MS_RELATIME
+	}
+	if err := syscall.Mount("", path, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only error %v", path, err)
+	}
+	return nil
+}
+
+// setNoNewPrivs stops execve from granting privileges: setuid bits and file capabilities are ignored
+func setNoNewPrivs() error {
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		return fmt.Errorf("set no_new_privs error %v", err)
+	}
+	return nil
+}
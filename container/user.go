@@ -0,0 +1,120 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExecUser is what user[:group] resolved to in a container
+type ExecUser struct {
+	Uid    int
+	Gid    int
+	Groups []int // supplementary groups, from the container's /etc/group
+	Home   string
+}
+
+// LookupUser resolves user[:group] against the /etc/passwd and /etc/group
+// under root, the container's own files rather than the host's. Init calls
+// it with "/" after pivot_root, exec with /proc/<pid>/root.
+func LookupUser(root string, spec string) (*ExecUser, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	u := &ExecUser{Home: "/"}
+	userName := ""
+	found := false
+
+	passwd, err := readColonFile(filepath.Join(root, "etc/passwd"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range passwd {
+		// name:password:uid:gid:gecos:home:shell
+		if len(entry) < 4 || (entry[0] != parts[0] && entry[2] != parts[0]) {
+			continue
+		}
+		if u.Uid, err = strconv.Atoi(entry[2]); err != nil {
+			return nil, fmt.Errorf("invalid uid %q in /etc/passwd", entry[2])
+		}
+		if u.Gid, err = strconv.Atoi(entry[3]); err != nil {
+			return nil, fmt.Errorf("invalid gid %q in /etc/passwd", entry[3])
+		}
+		if len(entry) > 5 && entry[5] != "" {
+			u.Home = entry[5]
+		}
+		userName = entry[0]
+		found = true
+		break
+	}
+	if !found {
+		// numeric users don't need to exist in /etc/passwd
+		if u.Uid, err = strconv.Atoi(parts[0]); err != nil {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", parts[0])
+		}
+	}
+
+	groups, err := readColonFile(filepath.Join(root, "etc/group"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(parts) == 2 {
+		if u.Gid, err = lookupGroup(groups, parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	// name:password:gid:member,member
+	for _, entry := range groups {
+		if userName == "" || len(entry) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(entry[3], ",") {
+			if member != userName {
+				continue
+			}
+			if gid, err := strconv.Atoi(entry[2]); err == nil && gid != u.Gid {
+				u.Groups = append(u.Groups, gid)
+			}
+		}
+	}
+	return u, nil
+}
+
+// lookupGroup finds a group by name or gid, a numeric gid doesn't need to exist
+func lookupGroup(groups [][]string, spec string) (int, error) {
+	for _, entry := range groups {
+		if len(entry) < 3 || (entry[0] != spec && entry[2] != spec) {
+			continue
+		}
+		gid, err := strconv.Atoi(entry[2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid gid %q in /etc/group", entry[2])
+		}
+		return gid, nil
+	}
+	gid, err := strconv.Atoi(spec)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find group %s: no matching entries in group file", spec)
+	}
+	return gid, nil
+}
+
+// readColonFile splits every line of passwd style files by ':'
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,204 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Rootless is set when mydocker runs as an unprivileged user
+var Rootless bool
+
+// IDMap maps Size ids starting at ContainerID inside the container to HostID on the host
+type IDMap struct {
+	ContainerID int `json:"containerId"`
+	HostID      int `json:"hostId"`
+	Size        int `json:"size"`
+}
+
+type UserNSConfig struct {
+	UidMap []IDMap `json:"uidMap"`
+	GidMap []IDMap `json:"gidMap"`
+	// Helper maps are written by newuidmap/newgidmap, an unprivileged user
+	// can only write a map of its own uid by itself
+	Helper bool `json:"helper"`
+}
+
+// UseRootlessPaths moves the images, layers and containers to
+// $XDG_DATA_HOME (or ~/.local/share), which the user can write
+func UseRootlessPaths() {
+	Rootless = true
+
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = fmt.Sprintf("/tmp/mydocker-%d", os.Geteuid())
+		}
+		dataDir = path.Join(home, ".local", "share")
+	}
+	UseRoot(path.Join(dataDir, "mydocker"))
+}
+
+// ParseIDMap parses containerID:hostID:size
+func ParseIDMap(spec string) (IDMap, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return IDMap{}, fmt.Errorf("invalid id map %q, expect containerID:hostID:size", spec)
+	}
+	var ids [3]int
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return IDMap{}, fmt.Errorf("invalid id map %q", spec)
+		}
+		ids[i] = id
+	}
+	if ids[2] == 0 {
+		return IDMap{}, fmt.Errorf("invalid id map %q, size must be positive", spec)
+	}
+	return IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// subIDRange finds the first range of name (or its numeric id) in /etc/subuid or /etc/subgid
+func subIDRange(file string, name string, id int) (int, int, error) {
+	entries, err := readColonFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		// name:start:count
+		if len(entry) != 3 || (entry[0] != name && entry[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(entry[1])
+		count, err2 := strconv.Atoi(entry[2])
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("invalid entry %q in %s", strings.Join(entry, ":"), file)
+		}
+		return start, count, nil
+	}
+	return 0, 0, fmt.Errorf("no entry for %s in %s", name, file)
+}
+
+// RemapConfig maps root of the container onto the subordinate ids of user[:group]
+func RemapConfig(spec string) (*UserNSConfig, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("lookup userns-remap user %s error %v", parts[0], err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	groupName, gid := u.Username, uid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("lookup userns-remap group %s error %v", parts[1], err)
+		}
+		groupName = g.Name
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	uidStart, uidCount, err := subIDRange("/etc/subuid", u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	gidStart, gidCount, err := subIDRange("/etc/subgid", groupName, gid)
+	if err != nil {
+		return nil, err
+	}
+	return &UserNSConfig{
+		UidMap: []IDMap{{ContainerID: 0, HostID: uidStart, Size: uidCount}},
+		GidMap: []IDMap{{ContainerID: 0, HostID: gidStart, Size: gidCount}},
+	}, nil
+}
+
+// RootlessConfig maps root of the container onto the calling user, and the other
+// ids onto the user's subordinate ids when newuidmap/newgidmap can write them
+func RootlessConfig() *UserNSConfig {
+	uid, gid := os.Geteuid(), os.Getegid()
+	config := &UserNSConfig{
+		UidMap: []IDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMap: []IDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return config
+	}
+	uidStart, uidCount, err := subIDRange("/etc/subuid", u.Username, uid)
+	if err != nil {
+		return config
+	}
+	gidStart, gidCount, err := subIDRange("/etc/subgid", u.Username, gid)
+	if err != nil {
+		return config
+	}
+	if _, err := exec.LookPath("newuidmap"); err != nil {
+		return config
+	}
+	if _, err := exec.LookPath("newgidmap"); err != nil {
+		return config
+	}
+	config.UidMap = append(config.UidMap, IDMap{ContainerID: 1, HostID: uidStart, Size: uidCount})
+	config.GidMap = append(config.GidMap, IDMap{ContainerID: 1, HostID: gidStart, Size: gidCount})
+	config.Helper = true
+	return config
+}
+
+// HostID translates an id of the container into the host's
+func HostID(idMap []IDMap, containerID int) (int, bool) {
+	for _, m := range idMap {
+		if containerID >= m.ContainerID && containerID < m.ContainerID+m.Size {
+			return m.HostID + containerID - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+func sysProcIDMap(idMap []IDMap) []syscall.SysProcIDMap {
+	var mappings []syscall.SysProcIDMap
+	for _, m := range idMap {
+		mappings = append(mappings, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return mappings
+}
+
+// setUserNamespace adds CLONE_NEWUSER, letting Go write the maps when it is allowed to
+func setUserNamespace(attr *syscall.SysProcAttr, userns *UserNSConfig) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	if userns.Helper {
+		return
+	}
+	attr.UidMappings = sysProcIDMap(userns.UidMap)
+	attr.GidMappings = sysProcIDMap(userns.GidMap)
+	// an unprivileged process may only map its gid after denying setgroups
+	attr.GidMappingsEnableSetgroups = !Rootless
+}
+
+// WriteIDMaps writes the maps of pid with the setuid helpers newuidmap/newgidmap
+func WriteIDMaps(pid int, userns *UserNSConfig) error {
+	if !userns.Helper {
+		return nil
+	}
+	if out, err := exec.Command("newuidmap", idMapArgs(pid, userns.UidMap)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("newuidmap error %v: %s", err, out)
+	}
+	if out, err := exec.Command("newgidmap", idMapArgs(pid, userns.GidMap)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("newgidmap error %v: %s", err, out)
+	}
+	return nil
+}
+
+func idMapArgs(pid int, idMap []IDMap) []string {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range idMap {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	return args
+}
@@ -2,18 +2,26 @@ package container
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
+	"syscall"
 
+	"../image"
 	log "github.com/sirupsen/logrus"
 )
 
-func NewWorkSpace(volume string, imageName string, containerName string) {
+func NewWorkSpace(volume string, imageName string, containerName string) []Mount {
 	/*
 		mntURL := "/root/mnt/"
 		rootURL := "/root/go/mydocker/mydocker/"
 	*/
+	if Rootless {
+		return newRootlessWorkSpace(volume, imageName, containerName)
+	}
 	CreateReadOnlyLayer(imageName)
 	CreateWriteLayer(containerName)
 	CreateMountPoint(containerName, imageName)
@@ -31,7 +39,49 @@ func NewWorkSpace(volume string, imageName string, containerName string) {
 			log.Errorf("Volume param input error!\n volume:%s\n", volume)
 		}
 	}
+	return nil
+}
+
+// AUFS can't be mounted inside a user namespace, so rootless containers get an
+// overlay of the same layers mounted by their init process instead.
+// Note that overlayfs doesn't understand the .wh. whiteouts of pulled layers.
+func newRootlessWorkSpace(volume string, imageName string, containerName string) []Mount {
+	CreateReadOnlyLayer(imageName)
+	CreateWriteLayer(containerName)
+	writeURL := fmt.Sprintf(WriteLayerURL, containerName)
+	upperURL, workURL := writeURL+"/diff", writeURL+"/work"
+	for _, dir := range []string{upperURL, workURL, fmt.Sprintf(MntUrl, containerName)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Errorf("[newRootlessWorkSpace] mkdir %s error %v", dir, err)
+		}
+	}
 
+	mounts := []Mount{{
+		Source: "overlay",
+		Target: "/",
+		Type:   "overlay",
+		Data:   fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(imageLayerDirs(imageName), ":"), upperURL, workURL),
+	}}
+	if volume != "" && volume != "false" {
+		volumeURLs := strings.Split(volume, ":")
+		if len(volumeURLs) == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
+			if err := os.MkdirAll(volumeURLs[0], 0777); err != nil {
+				log.Errorf("mkdir %s failed, error: %v", volumeURLs[0], err)
+			}
+			mounts = append(mounts, Mount{Source: volumeURLs[0], Target: volumeURLs[1], Type: "bind", Flags: syscall.MS_BIND | syscall.MS_REC})
+		} else {
+			log.Errorf("Volume param input error!\n volume:%s\n", volume)
+		}
+	}
+	return mounts
+}
+
+// imageLayerDirs lists the read-only layers of an image, top-most first
+func imageLayerDirs(imageName string) []string {
+	if layerDirs, err := image.LayerDirs(imageName); err == nil {
+		return layerDirs
+	}
+	return []string{RootUrl + "/" + imageName}
 }
 
 //parse the volume string
@@ -72,39 +122,21 @@ func MountVolume(volumeURLs []string, containerName string) error {
 
 }
 
-func DeleteMountPointWithVolume(volumeURLs []string, containerName string) error {
-	// 1. Unload the volume's mount point inside of the container
+// UnmountWorkSpace unmounts the volume and the rootfs of a container, what
+// is not mounted any more is skipped. The write layer stays.
+func UnmountWorkSpace(volume string, containerName string) error {
 	mntURL := fmt.Sprintf(MntUrl, containerName)
-	containerUrl := mntURL + "/" + volumeURLs[1]
-	if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
-		log.Errorf("umount Volume : %s failed , error: %v", containerUrl, err)
-		return err
-	}
-	// cmd := exec.Command("umount", containerUrl)
-	// cmd.Stderr = os.Stderr
-	// cmd.Stdout = os.Stdout
-	// if err := cmd.Run(); err != nil {
-	// 	log.Errorf("umount Volume : %s failed , error: %v", containerUrl, err)
-	// }
-
-	// 2. Unload the whole fs 's mount point
-	if _, err := exec.Command("umount", mntURL).CombinedOutput(); err != nil {
-		log.Errorf("umount mount point : %s failed , error: %v", mntURL, err)
-		return err
-	}
-	// cmd = exec.Command("umount", mntURL)
-	// cmd.Stderr = os.Stderr
-	// cmd.Stdout = os.Stdout
-	// if err := cmd.Run(); err != nil {
-	// 	log.Errorf("umount mount point : %s failed , error: %v", containerUrl, err)
-	// }
-
-	// 3. Delete the whole fs 's mount point
-	if err := os.RemoveAll(mntURL); err != nil {
-		log.Errorf("Remove mountpint dir %s error: %v", mntURL, err)
+	volumeURLs := strings.Split(volume, ":")
+	if len(volumeURLs) == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
+		containerUrl := mntURL + "/" + volumeURLs[1]
+		if IsMounted(containerUrl) {
+			if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
+				log.Errorf("umount Volume : %s failed , error: %v", containerUrl, err)
+				return err
+			}
+		}
 	}
-	return nil
-
+	return DeleteMountPoint(containerName)
 }
 
 // undecompress the busybox.tar to busybox/
@@ -113,6 +145,11 @@ func CreateReadOnlyLayer(imageName string) error {
 	// busyboxURL := rootURL + "busybox/"
 	// busyboxTarURL := rootURL + "busybox.tar"
 
+	// Images pulled from a registry are already extracted in the layered store
+	if img, err := image.GetImage(imageName); err == nil && img != nil {
+		return nil
+	}
+
 	unTarFolderUrl := RootUrl + "/" + imageName + "/"
 	imageUrl := RootUrl + "/" + imageName + ".tar"
 	exist, err := PathExists(unTarFolderUrl)
@@ -161,8 +198,19 @@ func CreateMountPoint(containerName string, imageName string) error {
 	tmpWriteLayer := fmt.Sprintf(WriteLayerURL, containerName)
 	tmpImageLocation := RootUrl + "/" + imageName
 	mntURL := fmt.Sprintf(MntUrl, containerName)
+	// a container started again after a crash may still have it mounted
+	if IsMounted(mntURL) {
+		return nil
+	}
 	// Try to mount writeLayer/ and busybox/ to mnt/
 	dirs := "dirs=" + tmpWriteLayer + ":" + tmpImageLocation
+	// Layered images: every layer is a read-only branch which may contain whiteouts
+	if img, err := image.GetImage(imageName); err == nil && img != nil {
+		dirs = "dirs=" + tmpWriteLayer + "=rw"
+		for _, layerDir := range imageLayerDirs(imageName) {
+			dirs += ":" + layerDir + "=ro+wh"
+		}
+	}
 	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntURL).CombinedOutput()
 
 	if err != nil {
@@ -179,6 +227,23 @@ func CreateMountPoint(containerName string, imageName string) error {
 	// }
 }
 
+// IsMounted tells if something is mounted on dir, from /proc/self/mountinfo
+func IsMounted(dir string) bool {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	dir = path.Clean(dir)
+	for _, line := range strings.Split(string(content), "\n") {
+		// the mount point is the 5th field, with spaces escaped as \040
+		fields := strings.Fields(line)
+		if len(fields) > 4 && strings.Replace(fields[4], "\\040", " ", -1) == dir {
+			return true
+		}
+	}
+	return false
+}
+
 // Check if the file's path exists
 func PathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -203,30 +268,35 @@ func PathExists(path string) (bool, error) {
 	After these steps, any changes we done to the FS has been removed !
 
 */
-func DeleteWorkSpace(volume string, containerName string) {
-	if volume != "" {
-		//volumeURLs := volumeUrlExtract(volume)
-		volumeURLs := strings.Split(volume, ":")
-		length := len(volumeURLs)
-		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			DeleteMountPointWithVolume(volumeURLs, containerName)
-		} else {
-			DeleteMountPoint(containerName)
+func DeleteWorkSpace(volume string, containerName string) error {
+	// Rootless mounts lived in the container's mount namespace and are gone with it
+	if Rootless {
+		mntURL := fmt.Sprintf(MntUrl, containerName)
+		if err := os.RemoveAll(mntURL); err != nil {
+			log.Errorf("Remove dir %s error %v", mntURL, err)
+			return err
 		}
-	} else {
-		DeleteMountPoint(containerName)
+		return DeleteWriteLayer(containerName)
 	}
-	DeleteWriteLayer(containerName)
+	// the write layer is only removed once nothing is mounted on top of it
+	if err := UnmountWorkSpace(volume, containerName); err != nil {
+		return err
+	}
+	return DeleteWriteLayer(containerName)
 }
 
+// DeleteMountPoint unmounts the container's rootfs and removes the mount
+// point, one a reboot unmounted is only removed
 func DeleteMountPoint(containerName string) error {
 	mntURL := fmt.Sprintf(MntUrl, containerName)
-	_, err := exec.Command("umount", mntURL).CombinedOutput()
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
-	if err != nil {
-		log.Errorf("[DeleteMountPoint] %v", err)
-		return err
+	if IsMounted(mntURL) {
+		out, err := exec.Command("umount", mntURL).CombinedOutput()
+		// cmd.Stdout = os.Stdout
+		// cmd.Stderr = os.Stderr
+		if err != nil {
+			log.Errorf("[DeleteMountPoint] %v", err)
+			return fmt.Errorf("umount %s error %v %s", mntURL, err, strings.TrimSpace(string(out)))
+		}
 	}
 
 	if err := os.RemoveAll(mntURL); err != nil {
@@ -236,10 +306,53 @@ func DeleteMountPoint(containerName string) error {
 	return nil
 }
 
-func DeleteWriteLayer(containerName string) {
+func DeleteWriteLayer(containerName string) error {
 	//writeURL := rootURL + "writeLayer/"
 	writeURL := fmt.Sprintf(WriteLayerURL, containerName)
 	if err := os.RemoveAll(writeURL); err != nil {
 		log.Errorf("[DeleteWriteLayer] Remove dir %s error %v", writeURL, err)
+		return err
+	}
+	return nil
+}
+
+// DirSize adds up the files under dir, a link counts for itself
+func DirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// WriteLayerSize is what the container changed on top of its image
+func WriteLayerSize(containerName string) (uint64, error) {
+	writeURL := fmt.Sprintf(WriteLayerURL, containerName)
+	// the work dir of overlay is the kernel's, and not readable by the user
+	if Rootless {
+		writeURL += "/diff"
+	}
+	return DirSize(writeURL)
+}
+
+// ImageSize adds up the read-only layers of an image
+func ImageSize(imageName string) (uint64, error) {
+	var size uint64
+	for _, dir := range imageLayerDirs(imageName) {
+		layerSize, err := DirSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		size += layerSize
 	}
+	return size, nil
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"./container"
+	"./state"
+)
+
+// splitCopyPath splits container:path. A local path with a colon in it
+// needs a / in front of the colon, ./a:b
+func splitCopyPath(arg string) (string, string) {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.Contains(arg[:i], "/") {
+		return "", arg
+	}
+	containerPath := arg[i+1:]
+	// relative to the root, the working dir of the helper
+	if !strings.HasPrefix(containerPath, "/") {
+		containerPath = "/" + containerPath
+	}
+	return arg[:i], containerPath
+}
+
+// copyFiles copies between a container and the host, either way. "-" is a
+// tar on stdin or stdout.
+func copyFiles(src string, dst string) error {
+	srcContainer, srcPath := splitCopyPath(src)
+	dstContainer, dstPath := splitCopyPath(dst)
+	switch {
+	case srcContainer != "" && dstContainer != "":
+		return fmt.Errorf("copying between containers is not supported")
+	case srcContainer == "" && dstContainer == "":
+		return fmt.Errorf("one of the paths must be container:path")
+	}
+
+	if srcContainer != "" {
+		helper, err := newCopyHelper(srcContainer, &container.CopyConfig{Archive: true, Path: srcPath})
+		if err != nil {
+			return err
+		}
+		if dstPath == "-" {
+			helper.cmd.Stdout = os.Stdout
+		} else {
+			stdout, err := helper.cmd.StdoutPipe()
+			if err != nil {
+				return err
+			}
+			helper.onStart = func() error {
+				// a helper still writing gets a broken pipe if we gave up
+				defer stdout.Close()
+				return container.ExtractTar(stdout, dstPath)
+			}
+		}
+		return helper.run()
+	}
+
+	if srcPath != "-" {
+		if _, err := os.Lstat(strings.TrimSuffix(srcPath, "/.")); err != nil {
+			return err
+		}
+	}
+	helper, err := newCopyHelper(dstContainer, &container.CopyConfig{Path: dstPath})
+	if err != nil {
+		return err
+	}
+	if srcPath == "-" {
+		helper.cmd.Stdin = os.Stdin
+	} else {
+		stdin, err := helper.cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		helper.onStart = func() error {
+			defer stdin.Close()
+			return container.WriteTar(stdin, srcPath)
+		}
+	}
+	return helper.run()
+}
+
+// copyHelper is "mydocker cp-helper" set up to work in a container
+type copyHelper struct {
+	cmd     *exec.Cmd
+	config  *container.CopyConfig
+	nsenter bool         // the config goes behind the sync byte of nsenter
+	onStart func() error // feeds or drains the tar while it runs
+	cleanup func()
+}
+
+// newCopyHelper sets up the helper: a running container's namespaces are
+// joined, a stopped container's rootfs is mounted from its write layer
+func newCopyHelper(containerName string, config *container.CopyConfig) (*copyHelper, error) {
+	info, err := state.Load(containerName)
+	if err != nil {
+		return nil, fmt.Errorf("get container %s info error %v", containerName, err)
+	}
+	helper := &copyHelper{
+		cmd:     exec.Command("/proc/self/exe", "cp-helper"),
+		config:  config,
+		cleanup: func() {},
+	}
+	helper.cmd.Stderr = os.Stderr
+
+	running := info.Status == container.RUNNING || info.Status == container.PAUSED
+	if running && container.InitAlive(info) {
+		// the volumes and tmpfs mounts are in its mount namespace
+		helper.nsenter = true
+		helper.cmd.Env = append(os.Environ(), container.ENV_NSENTER_PID+"="+info.Pid)
+		return helper, nil
+	}
+
+	mntURL := fmt.Sprintf(container.MntUrl, containerName)
+	config.Root = mntURL
+	if container.Rootless {
+		// mounted by the helper, in a user and mount namespace of its own
+		config.Mounts = container.NewWorkSpace(info.Volume, info.Image, containerName)
+		helper.cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}},
+			GidMappingsEnableSetgroups: false,
+		}
+		return helper, nil
+	}
+	// stop leaves the rootfs mounted, a reboot or a crash doesn't
+	if !container.IsMounted(mntURL) {
+		container.NewWorkSpace(info.Volume, info.Image, containerName)
+		helper.cleanup = func() {
+			container.UnmountWorkSpace(info.Volume, containerName)
+		}
+	}
+	return helper, nil
+}
+
+// run starts the helper, hands it its config, and waits for both it and
+// onStart to be done
+func (h *copyHelper) run() error {
+	defer h.cleanup()
+	content, err := json.Marshal(h.config)
+	if err != nil {
+		return err
+	}
+	readPipe, writePipe, err := container.NewPipe()
+	if err != nil {
+		return err
+	}
+	h.cmd.ExtraFiles = []*os.File{readPipe}
+	if err := h.cmd.Start(); err != nil {
+		readPipe.Close()
+		writePipe.Close()
+		return err
+	}
+	readPipe.Close()
+	if h.nsenter {
+		content = append([]byte{0}, content...)
+	}
+	_, err = writePipe.Write(content)
+	writePipe.Close()
+	if err != nil {
+		h.cmd.Process.Kill()
+		h.cmd.Wait()
+		return err
+	}
+
+	var copyErr error
+	if h.onStart != nil {
+		copyErr = h.onStart()
+	}
+	// the helper tells why first, a broken pipe on our side follows from it
+	if err := h.cmd.Wait(); err != nil {
+		return fmt.Errorf("copy in container error %v", err)
+	}
+	return copyErr
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// parseEnv turns KEY=VAL into itself and a bare KEY into the host's value of KEY.
+// A bare KEY not set on the host is dropped, just like docker does.
+func parseEnv(envs []string) []string {
+	var parsed []string
+	for _, env := range envs {
+		if strings.Contains(env, "=") {
+			parsed = append(parsed, env)
+			continue
+		}
+		if value, ok := os.LookupEnv(env); ok {
+			parsed = append(parsed, env+"="+value)
+		}
+	}
+	return parsed
+}
+
+// readEnvFile reads one KEY=VAL or KEY per line, skipping blank lines and # comments
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var envs []string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "=") || strings.ContainsAny(strings.SplitN(line, "=", 2)[0], " \t") {
+			return nil, fmt.Errorf("%s:%d: invalid variable %q", path, lineNum, line)
+		}
+		envs = append(envs, line)
+	}
+	return envs, scanner.Err()
+}
+
+// envFromFlags collects --env-file first and -e after it, so -e wins on duplicates
+func envFromFlags(context *cli.Context) ([]string, error) {
+	var envs []string
+	for _, envFile := range context.StringSlice("env-file") {
+		fileEnvs, err := readEnvFile(envFile)
+		if err != nil {
+			return nil, fmt.Errorf("read env file error %v", err)
+		}
+		envs = append(envs, fileEnvs...)
+	}
+	envs = append(envs, context.StringSlice("e")...)
+	return parseEnv(envs), nil
+}
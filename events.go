@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"./container"
+)
+
+// parseEventTime takes an RFC3339 time or a duration back from now, like 10m
+func parseEventTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expect RFC3339 or a duration like 10m", value)
+	}
+	return t, nil
+}
+
+// StreamEvents prints the events logged since, then follows the log for new
+// ones until until has passed, forever when it is empty
+func StreamEvents(since string, until string, format string) error {
+	if format != "" && format != "json" {
+		return fmt.Errorf("unknown format %q, only json is supported", format)
+	}
+	var sinceTime, untilTime time.Time
+	var err error
+	if since != "" {
+		if sinceTime, err = parseEventTime(since); err != nil {
+			return err
+		}
+	}
+	if until != "" {
+		if untilTime, err = parseEventTime(until); err != nil {
+			return err
+		}
+	}
+
+	logPath := container.EventsLogPath()
+	if err := os.MkdirAll(path.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logPath, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// without --since only new events are shown
+	if since == "" {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(f)
+	pending := ""
+	for {
+		line, err := reader.ReadString('\n')
+		pending += line
+		if err == io.EOF {
+			if !untilTime.IsZero() && time.Now().After(untilTime) {
+				return nil
+			}
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, pending = strings.TrimSpace(pending), ""
+		var event container.Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			continue
+		}
+		eventTime, _ := time.Parse(time.RFC3339Nano, event.Time)
+		if eventTime.Before(sinceTime) {
+			continue
+		}
+		if !untilTime.IsZero() && eventTime.After(untilTime) {
+			return nil
+		}
+		if format == "json" {
+			fmt.Fprintln(os.Stdout, line)
+		} else {
+			fmt.Fprintf(os.Stdout, "%s %s %s %s (name=%s)\n", event.Time, event.Type, event.Action, event.ID, event.Name)
+		}
+	}
+}
@@ -6,61 +6,288 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"./container"
+	"./image"
 	_ "./nsenter"
+	"./state"
 	log "github.com/sirupsen/logrus"
 )
 
-const ENV_EXEC_PID = "mydocker_pid"
-const ENV_EXEC_CMD = "mydocker_cmd"
+// ExecOptions carries the flags of mydocker exec
+type ExecOptions struct {
+	Tty     bool     // attach our terminal and stdin
+	Detach  bool     // don't wait for the command
+	Env     []string // -e and --env-file, on top of the container's env
+	User    string   // defaults to the container's -u
+	Workdir string   // defaults to the container's -w
+}
+
+// execRequest is handed to the exec-monitor of a detached exec through its pipe
+type execRequest struct {
+	Session *container.ExecSession `json:"session"`
+	Options *ExecOptions           `json:"options"`
+}
 
-func ExecContainer(containerName string, commandArray []string) {
-	pid, err := getContainerPidByName(containerName)
+// ExecContainer records an exec session and runs it, returning the exit status
+// of the command. A detached one is run by an exec-monitor in the background.
+func ExecContainer(containerName string, commandArray []string, opts *ExecOptions) (int, error) {
+	containerInfo, err := state.Load(containerName)
 	if err != nil {
-		log.Errorf("[ExecContainer] Get Name: %s , error: %v", containerName, err)
-		return
+		return 0, fmt.Errorf("get container %s info error %v", containerName, err)
 	}
-	cmdStr := strings.Join(commandArray, " ")
-	//log.Infof("Command: %s", cmdStr)
-	//log.Infof("Container's pid: %s", pid)
-
-	// Exec: docker exec
-	cmd := exec.Command("/proc/self/exe", "exec")
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if containerInfo.Status == container.PAUSED {
+		return 0, fmt.Errorf("container %s is paused, unpause the container before exec", containerName)
+	}
+	if containerInfo.Status != container.RUNNING || !container.InitAlive(containerInfo) {
+		return 0, fmt.Errorf("container %s is not running", containerName)
+	}
+	session := &container.ExecSession{
+		ID:      randStringBytes(10),
+		Command: commandArray,
+		User:    opts.User,
+		Workdir: opts.Workdir,
+		Tty:     opts.Tty,
+		Detach:  opts.Detach,
+		Status:  container.ExecCreated,
+	}
+	if containerInfo.Config != nil {
+		if session.User == "" {
+			session.User = containerInfo.Config.User
+		}
+		if session.Workdir == "" {
+			session.Workdir = containerInfo.Config.WorkingDir
+		}
+	}
+	if err := container.SaveExecSession(containerName, session); err != nil {
+		return 0, fmt.Errorf("save exec session error %v", err)
+	}
+	if opts.Detach {
+		if err := startExecMonitor(containerName, session, opts); err != nil {
+			failExecSession(containerName, session, err)
+			return 0, err
+		}
+		fmt.Fprintln(os.Stdout, session.ID)
+		return 0, nil
+	}
+	return runExecSession(containerInfo, session, opts)
+}
 
-	os.Setenv(ENV_EXEC_PID, pid)
-	os.Setenv(ENV_EXEC_CMD, cmdStr)
+// startExecMonitor runs a detached session in "mydocker exec-monitor", which
+// waits for the command to record how it ended. The output goes to the session's log.
+func startExecMonitor(containerName string, session *container.ExecSession, opts *ExecOptions) error {
+	logFile, err := os.Create(container.ExecLogPath(containerName, session.ID))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	content, err := json.Marshal(&execRequest{Session: session, Options: opts})
+	if err != nil {
+		return err
+	}
+	readPipe, writePipe, err := container.NewPipe()
+	if err != nil {
+		return err
+	}
+	defer writePipe.Close()
+	cmd := exec.Command("/proc/self/exe", "exec-monitor", containerName, session.ID)
+	cmd.ExtraFiles = []*os.File{readPipe}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	readPipe.Close()
+	_, err = writePipe.Write(content)
+	return err
+}
 
-	// Get container's ENVs
-	containerEnvs := getEnvsByPid(pid)
-	// Set both host's ENVs and container's ENVs
-	cmd.Env = append(os.Environ(), containerEnvs...)
+// RunExecMonitor is the exec-monitor of the detached session id, whatever
+// goes wrong ends up in its record
+func RunExecMonitor(containerName string, id string) error {
+	request, err := readExecRequest()
+	if err != nil {
+		if session, getErr := container.GetExecSession(containerName, id); getErr == nil {
+			failExecSession(containerName, session, err)
+		}
+		return err
+	}
+	containerInfo, err := state.Load(containerName)
+	if err != nil {
+		failExecSession(containerName, request.Session, err)
+		return err
+	}
+	_, err = runExecSession(containerInfo, request.Session, request.Options)
+	return err
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Errorf("Exec container: %s ; error: %v", containerName, err)
+func readExecRequest() (*execRequest, error) {
+	pipe := os.NewFile(uintptr(3), "pipe")
+	content, err := ioutil.ReadAll(pipe)
+	pipe.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read exec request error %v", err)
 	}
+	var request execRequest
+	if err := json.Unmarshal(content, &request); err != nil {
+		return nil, fmt.Errorf("unmarshal exec request error %v", err)
+	}
+	return &request, nil
+}
+
+// execFailedExitCode is recorded for a session that failed before its
+// command ran, like nsenter exits with when it can't enter the container
+const execFailedExitCode = 255
 
+// failExecSession records a session that ended because of err
+func failExecSession(containerName string, session *container.ExecSession, err error) {
+	session.Status = container.ExecExited
+	session.ExitCode = execFailedExitCode
+	session.Error = err.Error()
+	session.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	if err := container.SaveExecSession(containerName, session); err != nil {
+		log.Errorf("Save exec session %s error %v", session.ID, err)
+	}
 }
 
-// Get container_PID through container_NAME
-func getContainerPidByName(containerName string) (string, error) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	contentBytes, err := ioutil.ReadFile(configFilePath)
+// runExecSession starts "mydocker exec-init" which nsenter moves into the
+// container. The session is recorded as exited however it ends.
+func runExecSession(containerInfo *container.ContainerInfo, session *container.ExecSession, opts *ExecOptions) (exitCode int, err error) {
+	containerName, pid := containerInfo.Name, containerInfo.Pid
+	defer func() {
+		if err != nil {
+			failExecSession(containerName, session, err)
+		}
+	}()
+
+	process := container.ProcessConfig{
+		Args:            session.Command,
+		User:            session.User,
+		Cwd:             session.Workdir,
+		Capabilities:    containerInfo.Capabilities,
+		NoNewPrivileges: containerInfo.NoNewPrivileges,
+	}
+	// containers from before capabilities were recorded ran with ours
+	if process.Capabilities == nil {
+		process.Capabilities = container.AllCapabilities()
+	}
+	// and the same seccomp profile as the container
+	seccomp, err := container.GetSeccompProfile(containerName)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	process.Seccomp = seccomp
+	process.Console = opts.Tty
+	content, err := json.Marshal(process)
+	if err != nil {
+		return 0, err
 	}
 
-	// Unseriliazed to containerInfo Object
-	var containerInfo container.ContainerInfo
-	if err := json.Unmarshal(contentBytes, &containerInfo); err != nil {
-		return "", err
+	readPipe, writePipe, err := container.NewPipe()
+	if err != nil {
+		return 0, err
 	}
-	return containerInfo.Pid, nil
+	cmd := exec.Command("/proc/self/exe", "exec-init")
+	cmd.ExtraFiles = []*os.File{readPipe}
+	// The command gets exactly the container's ENVs plus the ones given with -e
+	cmd.Env = image.MergeEnv(getContainerEnvs(containerName, pid), opts.Env)
+	cmd.Env = append(cmd.Env, container.ENV_NSENTER_PID+"="+pid)
+	// with -t the command gets a pty of the container instead, the helper
+	// writes to these until it is set up
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	var consoleSocket, helperSocket *os.File
+	if opts.Tty {
+		if consoleSocket, helperSocket, err = container.NewConsoleSocket(); err != nil {
+			return 0, err
+		}
+		defer consoleSocket.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, helperSocket)
+	}
+	err = cmd.Start()
+	readPipe.Close()
+	if helperSocket != nil {
+		// or it would keep the socket open if exec-init fails before sending
+		helperSocket.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	session.Pid = cmd.Process.Pid
+	session.Status = container.ExecRunning
+	session.StartedAt = time.Now().Format("2006-01-02 15:04:05")
+	if err := container.SaveExecSession(containerName, session); err != nil {
+		log.Errorf("Save exec session %s error %v", session.ID, err)
+	}
+
+	// nsenter waits for the sync byte, the command starts in the container's cgroups
+	if containerInfo.CgroupPath != "" {
+		cgroupManager, err := containerCgroupManager(containerInfo)
+		if err == nil {
+			err = cgroupManager.Apply(cmd.Process.Pid)
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, err
+		}
+	}
+	_, err = writePipe.Write(append([]byte{0}, content...))
+	writePipe.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+
+	var console *os.File
+	if consoleSocket != nil {
+		// none comes when exec-init failed, its exit status tells why
+		if console, err = container.ReceiveConsole(consoleSocket); err != nil {
+			log.Debugf("Exec session %s has no console: %v", session.ID, err)
+		}
+	}
+
+	// nsenter passes these on to the command
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	if console != nil {
+		err = container.AttachConsole(console, cmd.Wait)
+	} else {
+		err = cmd.Wait()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode, err = exitErr.ExitCode(), nil
+	}
+	session.Status = container.ExecExited
+	session.ExitCode = exitCode
+	session.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	if err := container.SaveExecSession(containerName, session); err != nil {
+		log.Errorf("Save exec session %s error %v", session.ID, err)
+	}
+	return exitCode, err
+}
+
+// getContainerEnvs prefers the env recorded at run, containers started before it was recorded
+// fall back to the environ of their init process
+func getContainerEnvs(containerName string, pid string) []string {
+	containerInfo, err := state.Load(containerName)
+	if err == nil && containerInfo.Config != nil {
+		return containerInfo.Config.Env
+	}
+	return getEnvsByPid(pid)
 }
 
 func getEnvsByPid(pid string) []string {
@@ -72,6 +299,11 @@ func getEnvsByPid(pid string) []string {
 		return nil
 	}
 	// different env use \u0000 as the split byte
-	envs := strings.Split(string(contentBytes), "\u0000")
+	var envs []string
+	for _, env := range strings.Split(string(contentBytes), "\u0000") {
+		if env != "" {
+			envs = append(envs, env)
+		}
+	}
 	return envs
 }
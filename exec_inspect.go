@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"./container"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListExecSessions prints the exec sessions of a container, oldest first
+func ListExecSessions(containerName string) {
+	sessions, err := container.ListExecSessions(containerName)
+	if err != nil {
+		log.Errorf("List exec sessions of %s error %v", containerName, err)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tPID\tSTATUS\tEXIT CODE\tUSER\tCOMMAND\tSTARTED\tFINISHED\n")
+	for _, item := range sessions {
+		exitCode := ""
+		if item.Status == container.ExecExited {
+			exitCode = fmt.Sprint(item.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			item.ID,
+			item.Pid,
+			item.Status,
+			exitCode,
+			item.User,
+			strings.Join(item.Command, " "),
+			item.StartedAt,
+			item.FinishedAt)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+		return
+	}
+}
+
+func inspectExecSession(containerName string, id string) {
+	session, err := container.GetExecSession(containerName, id)
+	if err != nil {
+		log.Errorf("Get exec session error %v", err)
+		return
+	}
+	content, err := json.MarshalIndent(session, "", "    ")
+	if err != nil {
+		log.Errorf("Marshal exec session %s error %v", id, err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(content))
+}
@@ -0,0 +1,87 @@
+package image
+
+import (
+	"strings"
+)
+
+// PATH given to containers whose image doesn't set one
+const DefaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Merge applies the overrides given on the command line to the image defaults.
+// Like docker, overriding the entrypoint also drops the image's default cmd.
+func (c *ContainerConfig) Merge(override *ContainerConfig) *ContainerConfig {
+	merged := &ContainerConfig{
+		User:         c.User,
+		Entrypoint:   c.Entrypoint,
+		Cmd:          c.Cmd,
+		WorkingDir:   c.WorkingDir,
+		Env:          MergeEnv(c.Env, override.Env),
+		ExposedPorts: map[string]struct{}{},
+		Labels:       map[string]string{},
+	}
+	// a non nil Entrypoint means --entrypoint was given, even if empty
+	if override.Entrypoint != nil {
+		merged.Entrypoint = override.Entrypoint
+		merged.Cmd = nil
+	}
+	if len(override.Cmd) > 0 {
+		merged.Cmd = override.Cmd
+	}
+	if override.User != "" {
+		merged.User = override.User
+	}
+	if override.WorkingDir != "" {
+		merged.WorkingDir = override.WorkingDir
+	}
+	for port := range c.ExposedPorts {
+		merged.ExposedPorts[port] = struct{}{}
+	}
+	for port := range override.ExposedPorts {
+		merged.ExposedPorts[port] = struct{}{}
+	}
+	for k, v := range c.Labels {
+		merged.Labels[k] = v
+	}
+	for k, v := range override.Labels {
+		merged.Labels[k] = v
+	}
+	if !HasEnv(merged.Env, "PATH") {
+		merged.Env = append([]string{DefaultPathEnv}, merged.Env...)
+	}
+	return merged
+}
+
+// Args is the command line the container's init process will exec
+func (c *ContainerConfig) Args() []string {
+	var args []string
+	args = append(args, c.Entrypoint...)
+	return append(args, c.Cmd...)
+}
+
+func envKey(env string) string {
+	return strings.SplitN(env, "=", 2)[0]
+}
+
+func HasEnv(envs []string, key string) bool {
+	for _, env := range envs {
+		if envKey(env) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeEnv appends override to base, a key set in both keeps the value of override
+func MergeEnv(base []string, override []string) []string {
+	var merged []string
+	index := map[string]int{}
+	for _, env := range append(append([]string{}, base...), override...) {
+		if i, ok := index[envKey(env)]; ok {
+			merged[i] = env
+			continue
+		}
+		index[envKey(env)] = len(merged)
+		merged = append(merged, env)
+	}
+	return merged
+}
@@ -0,0 +1,109 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultRegistry = "registry-1.docker.io"
+	DefaultTag      = "latest"
+)
+
+// Reference is a parsed image name like [registry/]repository[:tag][@digest]
+type Reference struct {
+	Registry   string // registry host, e.g. registry-1.docker.io or localhost:5000
+	Repository string // repository path inside the registry, e.g. library/busybox
+	Tag        string // tag, defaults to latest
+	Digest     string // sha256:... when pulled by digest
+}
+
+func ParseReference(name string) (*Reference, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty image reference")
+	}
+	ref := &Reference{}
+
+	// name@sha256:xxx
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if err := ValidateDigest(ref.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	// The tag is the part after the last ':' which is not part of the registry host
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+
+	// The first component is a registry host only if it looks like one
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = DefaultRegistry
+		ref.Repository = name
+	}
+	if ref.Registry == "docker.io" || ref.Registry == "index.docker.io" {
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	if ref.Repository == "" || strings.ToLower(ref.Repository) != ref.Repository {
+		return nil, fmt.Errorf("invalid repository name %q", ref.Repository)
+	}
+	return ref, nil
+}
+
+// Name is the short name the image is stored under locally,
+// e.g. busybox:latest for registry-1.docker.io/library/busybox:latest
+func (r *Reference) Name() string {
+	name := r.Repository
+	if r.Registry == DefaultRegistry {
+		name = strings.TrimPrefix(name, "library/")
+	} else {
+		name = r.Registry + "/" + name
+	}
+	if r.Tag != "" {
+		return name + ":" + r.Tag
+	}
+	return name + "@" + r.Digest
+}
+
+// Reference returns the tag or the digest used to address the manifest
+func (r *Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r *Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// NormalizeName turns a user supplied image name into the key used by the store.
+// Names that can't be parsed are returned untouched so legacy tarball images still work.
+func NormalizeName(name string) string {
+	ref, err := ParseReference(name)
+	if err != nil {
+		return name
+	}
+	return ref.Name()
+}
@@ -0,0 +1,564 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var RegistryConfigPath string = "/root/go/mydocker/mydocker/registries.json"
+
+// Size of each PATCH request of a chunked blob upload
+var UploadChunkSize = 5 << 20
+
+// RegistryConfig is read from RegistryConfigPath, e.g.
+//
+//	{
+//	  "mirrors":  {"registry-1.docker.io": ["https://mirror.example.com"]},
+//	  "insecure": ["myregistry:5000"],
+//	  "auths":    {"myregistry:5000": {"username": "u", "password": "p"}}
+//	}
+type RegistryConfig struct {
+	Mirrors  map[string][]string   `json:"mirrors"`
+	Insecure []string              `json:"insecure"`
+	Auths    map[string]AuthConfig `json:"auths"`
+}
+
+type AuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func LoadRegistryConfig() (*RegistryConfig, error) {
+	config := &RegistryConfig{
+		Mirrors: map[string][]string{},
+		Auths:   map[string]AuthConfig{},
+	}
+	content, err := ioutil.ReadFile(RegistryConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal %s error %v", RegistryConfigPath, err)
+	}
+	if config.Mirrors == nil {
+		config.Mirrors = map[string][]string{}
+	}
+	if config.Auths == nil {
+		config.Auths = map[string]AuthConfig{}
+	}
+	return config, nil
+}
+
+// Client talks the OCI distribution API
+type Client struct {
+	HTTP   *http.Client
+	Config *RegistryConfig
+	// bearer tokens by registry host and repository
+	tokens map[string]string
+}
+
+func NewClient(config *RegistryConfig) *Client {
+	return &Client{
+		HTTP:   http.DefaultClient,
+		Config: config,
+		tokens: map[string]string{},
+	}
+}
+
+// endpoint is a base URL serving the /v2/ API for a registry
+type endpoint struct {
+	base string // scheme://host[/path]
+	host string // registry host the credentials are looked up with
+}
+
+// isInsecure tells if a registry is spoken to in plain http: the loopback
+// itself, or one configured so. Only the exact host counts, localhost.example.com
+// is someone else's.
+func (c *Client) isInsecure(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")
+	if hostname == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, insecure := range c.Config.Insecure {
+		if insecure == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) registryEndpoint(host string) endpoint {
+	scheme := "https"
+	if c.isInsecure(host) {
+		scheme = "http"
+	}
+	return endpoint{base: scheme + "://" + host, host: host}
+}
+
+// pullEndpoints lists the configured mirrors of a registry before the registry itself
+func (c *Client) pullEndpoints(host string) []endpoint {
+	var endpoints []endpoint
+	for _, mirror := range c.Config.Mirrors[host] {
+		mirror = strings.TrimSuffix(mirror, "/")
+		if !strings.Contains(mirror, "://") {
+			endpoints = append(endpoints, c.registryEndpoint(mirror))
+			continue
+		}
+		u, err := url.Parse(mirror)
+		if err != nil {
+			log.Warnf("Ignore invalid mirror %s: %v", mirror, err)
+			continue
+		}
+		endpoints = append(endpoints, endpoint{base: mirror, host: u.Host})
+	}
+	return append(endpoints, c.registryEndpoint(host))
+}
+
+// do sends the request, answering a 401 with basic or bearer credentials and retrying once
+func (c *Client) do(ep endpoint, repo string, req *http.Request) (*http.Response, error) {
+	tokenKey := ep.host + "/" + repo
+	if token, ok := c.tokens[tokenKey]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if auth, ok := c.Config.Auths[ep.host]; ok && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	scheme, params := parseChallenge(challenge)
+	retry, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		token, err := c.fetchToken(ep, params)
+		if err != nil {
+			return nil, err
+		}
+		c.tokens[tokenKey] = token
+		retry.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		auth, ok := c.Config.Auths[ep.host]
+		if !ok {
+			return nil, fmt.Errorf("%s requires credentials", ep.host)
+		}
+		retry.SetBasicAuth(auth.Username, auth.Password)
+	default:
+		return nil, fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+	return c.HTTP.Do(retry)
+}
+
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("can't retry %s %s after auth challenge", req.Method, req.URL)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// parseChallenge splits `Bearer realm="...",service="...",scope="..."`
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+func (c *Client) fetchToken(ep endpoint, params map[string]string) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge from %s has no realm", ep.host)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid realm %s: %v", realm, err)
+	}
+	query := u.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth, ok := c.Config.Auths[ep.host]; ok && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token from %s: %s", realm, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decode token error %v", err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// getManifest fetches a manifest or an index by tag or digest
+func (c *Client) getManifest(ep endpoint, repo string, reference string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", ep.base, repo, reference), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		MediaTypeOCIManifest, MediaTypeOCIIndex, MediaTypeDockerManifest, MediaTypeDockerList,
+	}, ", "))
+	resp, err := c.do(ep, repo, req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", responseError(resp)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest := DigestBytes(content)
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return nil, "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", reference, digest)
+	}
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" && header != digest {
+		return nil, "", fmt.Errorf("manifest digest mismatch: registry says %s, got %s", header, digest)
+	}
+	return content, resp.Header.Get("Content-Type"), nil
+}
+
+// fetchBlob downloads a blob into the store, verifying its digest on the way
+func (c *Client) fetchBlob(ep endpoint, repo string, digest string) error {
+	if HasBlob(digest) {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/blobs/%s", ep.base, repo, digest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ep, repo, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return WriteBlob(digest, resp.Body)
+}
+
+// Pull downloads an image, trying the mirrors of its registry first, and saves it in the store
+func (c *Client) Pull(ref *Reference) (*Image, error) {
+	var lastErr error
+	for _, ep := range c.pullEndpoints(ref.Registry) {
+		img, err := c.pullFrom(ep, ref)
+		if err == nil {
+			return img, nil
+		}
+		log.Warnf("Pull %s from %s failed: %v", ref, ep.base, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c *Client) pullFrom(ep endpoint, ref *Reference) (*Image, error) {
+	content, mediaType, err := c.getManifest(ep, ref.Repository, ref.Reference())
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseManifest(content, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	if isIndex(manifest.MediaType) {
+		desc, err := manifest.SelectPlatform()
+		if err != nil {
+			return nil, err
+		}
+		if content, mediaType, err = c.getManifest(ep, ref.Repository, desc.Digest); err != nil {
+			return nil, err
+		}
+		if manifest, err = ParseManifest(content, mediaType); err != nil {
+			return nil, err
+		}
+	}
+
+	manifestDigest, err := PutBlob(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.fetchBlob(ep, ref.Repository, manifest.Config.Digest); err != nil {
+		return nil, fmt.Errorf("fetch config error %v", err)
+	}
+	var layers []string
+	for _, layer := range manifest.Layers {
+		log.Infof("Pulling layer %s", layer.Digest)
+		if err := c.fetchBlob(ep, ref.Repository, layer.Digest); err != nil {
+			return nil, fmt.Errorf("fetch layer error %v", err)
+		}
+		if err := ExtractLayer(layer.Digest); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer.Digest)
+	}
+
+	img := &Image{
+		Name:      ref.Name(),
+		Manifest:  manifestDigest,
+		MediaType: manifest.MediaType,
+		Config:    manifest.Config.Digest,
+		Layers:    layers,
+	}
+	if config, err := ReadImageConfig(img); err == nil {
+		img.Created = config.Created
+	}
+	if err := SaveImage(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (c *Client) blobExists(ep endpoint, repo string, digest string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%s/v2/%s/blobs/%s", ep.base, repo, digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(ep, repo, req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD blob %s: %s", digest, resp.Status)
+}
+
+// resolveLocation makes the Location header of an upload response absolute
+func resolveLocation(ep endpoint, resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("upload response has no Location")
+	}
+	base, err := url.Parse(ep.base)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(u), nil
+}
+
+// uploadBlob pushes a blob with a chunked upload: POST, PATCH per chunk, then PUT with the digest
+func (c *Client) uploadBlob(ep endpoint, repo string, digest string) error {
+	exist, err := c.blobExists(ep, repo, digest)
+	if err != nil {
+		return err
+	}
+	if exist {
+		log.Infof("Blob %s already exists", digest)
+		return nil
+	}
+
+	blob, err := os.Open(BlobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v2/%s/blobs/uploads/", ep.base, repo), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ep, repo, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		defer resp.Body.Close()
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	location, err := resolveLocation(ep, resp)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, UploadChunkSize)
+	var offset int64
+	for {
+		n, readErr := io.ReadFull(blob, chunk)
+		if n > 0 {
+			req, err := http.NewRequest(http.MethodPatch, location.String(), bytes.NewReader(chunk[:n]))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+			resp, err := c.do(ep, repo, req)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusAccepted {
+				defer resp.Body.Close()
+				return responseError(resp)
+			}
+			resp.Body.Close()
+			if location, err = resolveLocation(ep, resp); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	req, err = http.NewRequest(http.MethodPut, location.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err = c.do(ep, repo, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" && header != digest {
+		return fmt.Errorf("registry stored %s as %s", digest, header)
+	}
+	return nil
+}
+
+func (c *Client) putManifest(ep endpoint, repo string, reference string, mediaType string, content []byte) error {
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v2/%s/manifests/%s", ep.base, repo, reference), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(ep, repo, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Push uploads a stored image's blobs and manifest to ref
+func (c *Client) Push(img *Image, ref *Reference) error {
+	ep := c.registryEndpoint(ref.Registry)
+	for _, digest := range append([]string{img.Config}, img.Layers...) {
+		log.Infof("Pushing blob %s", digest)
+		if err := c.uploadBlob(ep, ref.Repository, digest); err != nil {
+			return fmt.Errorf("push blob %s error %v", digest, err)
+		}
+	}
+	content, err := ReadBlob(img.Manifest)
+	if err != nil {
+		return err
+	}
+	if err := c.putManifest(ep, ref.Repository, ref.Reference(), img.MediaType, content); err != nil {
+		return fmt.Errorf("push manifest error %v", err)
+	}
+	log.Infof("Pushed %s: digest %s", ref, img.Manifest)
+	return nil
+}
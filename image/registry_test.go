@@ -0,0 +1,436 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is a local registry stand-in speaking enough of the
+// distribution API for pull and push, with optional basic or bearer auth
+type testRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte // repo:reference
+	types     map[string]string // repo:reference -> media type
+	uploads   map[string]*bytes.Buffer
+	patches   int
+
+	auth        string // "", "basic" or "bearer"
+	username    string
+	password    string
+	token       string
+	tokenFetch  int
+	corruptBlob string // serves this blob with a flipped byte
+	wrongDigest bool   // answers manifest GETs with a wrong Docker-Content-Digest
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+		uploads:   map[string]*bytes.Buffer{},
+		username:  "user",
+		password:  "secret",
+		token:     "t0ken",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", r.serveToken)
+	mux.HandleFunc("/v2/", r.serveV2)
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+// host is what goes in front of the repository in an image name
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+func (r *testRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokenFetch++
+	if user, pass, ok := req.BasicAuth(); !ok || user != r.username || pass != r.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Query().Get("service") != "test-registry" || req.URL.Query().Get("scope") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+}
+
+func (r *testRegistry) authorized(w http.ResponseWriter, req *http.Request, repo string) bool {
+	switch r.auth {
+	case "basic":
+		if user, pass, ok := req.BasicAuth(); ok && user == r.username && pass == r.password {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+	case "bearer":
+		if req.Header.Get("Authorization") == "Bearer "+r.token {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:%s:pull,push"`, r.URL, repo))
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+func (r *testRegistry) serveV2(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	var repo, kind, rest string
+	for _, k := range []string{"/blobs/uploads/", "/blobs/", "/manifests/"} {
+		if i := strings.Index(p, k); i > 0 {
+			repo, kind, rest = p[:i], k, p[i+len(k):]
+			break
+		}
+	}
+	if kind == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !r.authorized(w, req, repo) {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+
+	switch {
+	case kind == "/blobs/uploads/" && req.Method == http.MethodPost:
+		id := fmt.Sprintf("upload-%d", len(r.uploads))
+		r.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "/blobs/uploads/" && req.Method == http.MethodPatch:
+		upload, ok := r.uploads[rest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if want := fmt.Sprintf("%d-%d", upload.Len(), upload.Len()+len(body)-1); req.Header.Get("Content-Range") != want {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		upload.Write(body)
+		r.patches++
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "/blobs/uploads/" && req.Method == http.MethodPut:
+		upload, ok := r.uploads[rest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		upload.Write(body)
+		digest := req.URL.Query().Get("digest")
+		if DigestBytes(upload.Bytes()) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "DIGEST_INVALID")
+			return
+		}
+		r.blobs[digest] = upload.Bytes()
+		delete(r.uploads, rest)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "/blobs/" && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		blob, ok := r.blobs[rest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rest == r.corruptBlob {
+			blob = append([]byte{}, blob...)
+			blob[0] ^= 0xff
+		}
+		w.Write(blob)
+	case kind == "/manifests/" && req.Method == http.MethodPut:
+		digest := DigestBytes(body)
+		for _, ref := range []string{rest, digest} {
+			r.manifests[repo+":"+ref] = body
+			r.types[repo+":"+ref] = req.Header.Get("Content-Type")
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case kind == "/manifests/" && req.Method == http.MethodGet:
+		content, ok := r.manifests[repo+":"+rest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		digest := DigestBytes(content)
+		if r.wrongDigest {
+			digest = DigestBytes(append(content, '\n'))
+		}
+		w.Header().Set("Content-Type", r.types[repo+":"+rest])
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(content)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// useTempStore points the store at a new directory for the rest of the test
+func useTempStore(t *testing.T) {
+	old := StoreRoot
+	StoreRoot = t.TempDir() + "/"
+	t.Cleanup(func() { StoreRoot = old })
+}
+
+// newTestImage stores a one layer image with /hello in it
+func newTestImage(t *testing.T, name string, padding int) *Image {
+	var layer bytes.Buffer
+	gz := gzip.NewWriter(&layer)
+	tw := tar.NewWriter(gz)
+	content := []byte("hello from the layer\n")
+	tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write(content)
+	// random-ish data gzip can't shrink, so the blob spans several chunks
+	junk := make([]byte, padding)
+	for i := range junk {
+		junk[i] = byte(i*7919 + i/251)
+	}
+	tw.WriteHeader(&tar.Header{Name: "junk", Mode: 0644, Size: int64(len(junk)), Typeflag: tar.TypeReg})
+	tw.Write(junk)
+	tw.Close()
+	gz.Close()
+
+	layerDigest, err := PutBlob(layer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := NewImage(name, []string{layerDigest}, []string{layerDigest}, &ContainerConfig{Cmd: []string{"/hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// pushTestImage pushes a new image to the registry and gives the reference
+func pushTestImage(t *testing.T, r *testRegistry, client *Client) (*Image, *Reference) {
+	useTempStore(t)
+	ref, err := ParseReference(r.host() + "/test/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := newTestImage(t, ref.Name(), 4096)
+	if err := client.Push(img, ref); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	return img, ref
+}
+
+func TestIsInsecure(t *testing.T) {
+	client := NewClient(&RegistryConfig{Insecure: []string{"myregistry:5000"}})
+	for host, want := range map[string]bool{
+		"localhost":                  true,
+		"localhost:5000":             true,
+		"127.0.0.1:5000":             true,
+		"127.0.0.2":                  true,
+		"[::1]:5000":                 true,
+		"::1":                        true,
+		"myregistry:5000":            true,
+		"myregistry":                 false,
+		"localhost.attacker.com":     false,
+		"localhost.attacker.com:443": false,
+		"127.0.0.1.nip.io":           false,
+		"127.0.0.1.nip.io:5000":      false,
+		"registry-1.docker.io":       false,
+	} {
+		if got := client.isInsecure(host); got != want {
+			t.Errorf("isInsecure(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	r := newTestRegistry(t)
+	old := UploadChunkSize
+	UploadChunkSize = 1024
+	defer func() { UploadChunkSize = old }()
+
+	client := NewClient(&RegistryConfig{})
+	pushed, ref := pushTestImage(t, r, client)
+	if r.patches < 2 {
+		t.Errorf("layer went in %d PATCH requests, want a chunked upload", r.patches)
+	}
+	for _, digest := range append([]string{pushed.Config}, pushed.Layers...) {
+		if _, ok := r.blobs[digest]; !ok {
+			t.Errorf("blob %s not in the registry", digest)
+		}
+	}
+	// pushing again finds the blobs there
+	patches := r.patches
+	if err := client.Push(pushed, ref); err != nil {
+		t.Fatalf("push again: %v", err)
+	}
+	if r.patches != patches {
+		t.Errorf("existing blobs were uploaded again")
+	}
+
+	useTempStore(t)
+	pulled, err := client.Pull(ref)
+	if err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if pulled.Manifest != pushed.Manifest || pulled.Config != pushed.Config || len(pulled.Layers) != 1 || pulled.Layers[0] != pushed.Layers[0] {
+		t.Errorf("pulled %+v, pushed %+v", pulled, pushed)
+	}
+	content, err := ioutil.ReadFile(path.Join(LayerPath(pulled.Layers[0]), "hello"))
+	if err != nil || string(content) != "hello from the layer\n" {
+		t.Errorf("extracted layer has %q, %v", content, err)
+	}
+	if img, err := GetImage(ref.Name()); err != nil || img == nil {
+		t.Errorf("pulled image not in the store: %v", err)
+	}
+
+	// by digest too
+	byDigest, err := ParseReference(r.host() + "/test/app@" + pushed.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTempStore(t)
+	if _, err := client.Pull(byDigest); err != nil {
+		t.Errorf("pull by digest: %v", err)
+	}
+}
+
+func TestPullDigestMismatch(t *testing.T) {
+	r := newTestRegistry(t)
+	client := NewClient(&RegistryConfig{})
+	pushed, ref := pushTestImage(t, r, client)
+
+	r.corruptBlob = pushed.Layers[0]
+	useTempStore(t)
+	if _, err := client.Pull(ref); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("pull of a corrupt layer: %v, want a digest mismatch", err)
+	}
+	if HasBlob(pushed.Layers[0]) {
+		t.Errorf("corrupt layer was stored")
+	}
+
+	r.corruptBlob = ""
+	r.wrongDigest = true
+	useTempStore(t)
+	if _, err := client.Pull(ref); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("pull with a wrong manifest digest: %v, want a digest mismatch", err)
+	}
+
+	// a manifest asked for by digest must hash to it
+	r.wrongDigest = false
+	other := DigestBytes([]byte("something else"))
+	r.manifests["test/app:"+other] = r.manifests["test/app:v1"]
+	byDigest, err := ParseReference(r.host() + "/test/app@" + other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Pull(byDigest); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("pull of a manifest by another digest: %v, want a digest mismatch", err)
+	}
+}
+
+func TestPushDigestMismatch(t *testing.T) {
+	r := newTestRegistry(t)
+	useTempStore(t)
+	client := NewClient(&RegistryConfig{})
+	ref, err := ParseReference(r.host() + "/test/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := newTestImage(t, ref.Name(), 0)
+	// the blob changed on disk after it was stored
+	if err := ioutil.WriteFile(BlobPath(img.Layers[0]), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Push(img, ref); err == nil || !strings.Contains(err.Error(), "DIGEST_INVALID") {
+		t.Errorf("push of a tampered blob: %v, want the registry to refuse it", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	r := newTestRegistry(t)
+	r.auth = "basic"
+	useTempStore(t)
+	ref, err := ParseReference(r.host() + "/test/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := newTestImage(t, ref.Name(), 0)
+
+	if err := NewClient(&RegistryConfig{}).Push(img, ref); err == nil || !strings.Contains(err.Error(), "requires credentials") {
+		t.Errorf("push without credentials: %v", err)
+	}
+	wrong := NewClient(&RegistryConfig{Auths: map[string]AuthConfig{r.host(): {Username: "user", Password: "wrong"}}})
+	if err := wrong.Push(img, ref); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("push with a wrong password: %v", err)
+	}
+
+	client := NewClient(&RegistryConfig{Auths: map[string]AuthConfig{r.host(): {Username: "user", Password: "secret"}}})
+	if err := client.Push(img, ref); err != nil {
+		t.Fatalf("push with credentials: %v", err)
+	}
+	useTempStore(t)
+	if _, err := client.Pull(ref); err != nil {
+		t.Errorf("pull with credentials: %v", err)
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	r := newTestRegistry(t)
+	r.auth = "bearer"
+	useTempStore(t)
+	ref, err := ParseReference(r.host() + "/test/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := newTestImage(t, ref.Name(), 0)
+
+	if err := NewClient(&RegistryConfig{}).Push(img, ref); err == nil || !strings.Contains(err.Error(), "get token") {
+		t.Errorf("push without credentials: %v", err)
+	}
+
+	client := NewClient(&RegistryConfig{Auths: map[string]AuthConfig{r.host(): {Username: "user", Password: "secret"}}})
+	r.tokenFetch = 0
+	if err := client.Push(img, ref); err != nil {
+		t.Fatalf("push with a token: %v", err)
+	}
+	useTempStore(t)
+	if _, err := client.Pull(ref); err != nil {
+		t.Errorf("pull with a token: %v", err)
+	}
+	// the token of the repository is kept for the requests after the first
+	if r.tokenFetch != 1 {
+		t.Errorf("token fetched %d times, want once", r.tokenFetch)
+	}
+}
+
+func TestMain(m *testing.M) {
+	// nothing may reach a real store or registry config
+	dir, err := ioutil.TempDir("", "mydocker-image-test")
+	if err != nil {
+		panic(err)
+	}
+	StoreRoot = dir + "/"
+	RegistryConfigPath = path.Join(dir, "registries.json")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,363 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Layered image store
+
+StoreRoot/
+├── blobs/sha256/<hex>      manifests, configs and compressed layers as pulled
+├── layers/<hex>/           extracted layers, used as AUFS read-only branches
+└── repositories.json       image name -> Image
+*/
+var (
+	StoreRoot        string = "/root/go/mydocker/mydocker/images/"
+	RepositoriesFile string = "repositories.json"
+)
+
+// Image is a locally stored image
+type Image struct {
+	Name      string   `json:"name"`      // image name, e.g. busybox:latest
+	Manifest  string   `json:"manifest"`  // digest of the manifest blob
+	MediaType string   `json:"mediaType"` // media type of the manifest blob
+	Config    string   `json:"config"`    // digest of the config blob
+	Layers    []string `json:"layers"`    // digests of the layer blobs, bottom-most first
+	Created   string   `json:"created"`
+}
+
+func ValidateDigest(digest string) error {
+	hexPart := strings.TrimPrefix(digest, "sha256:")
+	if hexPart == digest {
+		return fmt.Errorf("unsupported digest algorithm in %q", digest)
+	}
+	if len(hexPart) != 64 {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexPart); err != nil {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return nil
+}
+
+func digestHex(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
+func DigestBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func BlobPath(digest string) string {
+	return path.Join(StoreRoot, "blobs", "sha256", digestHex(digest))
+}
+
+func LayerPath(digest string) string {
+	return path.Join(StoreRoot, "layers", digestHex(digest))
+}
+
+func HasBlob(digest string) bool {
+	_, err := os.Stat(BlobPath(digest))
+	return err == nil
+}
+
+// digestVerifier hashes everything written through it
+type digestVerifier struct {
+	hash hash.Hash
+}
+
+func newDigestVerifier() *digestVerifier {
+	return &digestVerifier{hash: sha256.New()}
+}
+
+func (v *digestVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+func (v *digestVerifier) Digest() string {
+	return "sha256:" + hex.EncodeToString(v.hash.Sum(nil))
+}
+
+// WriteBlob stores the content read from r, refusing it if it doesn't match digest
+func WriteBlob(digest string, r io.Reader) error {
+	if err := ValidateDigest(digest); err != nil {
+		return err
+	}
+	blobPath := BlobPath(digest)
+	if err := os.MkdirAll(path.Dir(blobPath), 0755); err != nil {
+		return fmt.Errorf("mkdir %s error %v", path.Dir(blobPath), err)
+	}
+	tmp, err := ioutil.TempFile(path.Dir(blobPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	verifier := newDigestVerifier()
+	if _, err := io.Copy(io.MultiWriter(tmp, verifier), r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write blob %s error %v", digest, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if got := verifier.Digest(); got != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, got)
+	}
+	return os.Rename(tmp.Name(), blobPath)
+}
+
+// PutBlob stores content and returns its digest
+func PutBlob(content []byte) (string, error) {
+	digest := DigestBytes(content)
+	if HasBlob(digest) {
+		return digest, nil
+	}
+	return digest, WriteBlob(digest, bytes.NewReader(content))
+}
+
+func ReadBlob(digest string) ([]byte, error) {
+	return ioutil.ReadFile(BlobPath(digest))
+}
+
+// ExtractLayer untars a layer blob into its own directory.
+// Whiteout files (.wh.*) are kept as is, AUFS understands them natively.
+func ExtractLayer(digest string) error {
+	layerPath := LayerPath(digest)
+	if exist, _ := pathExists(layerPath); exist {
+		return nil
+	}
+	tmpPath := layerPath + ".tmp"
+	os.RemoveAll(tmpPath)
+	if err := os.MkdirAll(tmpPath, 0755); err != nil {
+		return fmt.Errorf("mkdir %s error %v", tmpPath, err)
+	}
+	// tar detects the gzip compression by itself
+	if out, err := exec.Command("tar", "-xf", BlobPath(digest), "-C", tmpPath).CombinedOutput(); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("untar layer %s error %v: %s", digest, err, out)
+	}
+	return os.Rename(tmpPath, layerPath)
+}
+
+func loadRepositories() (map[string]*Image, error) {
+	images := map[string]*Image{}
+	content, err := ioutil.ReadFile(path.Join(StoreRoot, RepositoriesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return images, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &images); err != nil {
+		return nil, fmt.Errorf("unmarshal %s error %v", RepositoriesFile, err)
+	}
+	return images, nil
+}
+
+func saveRepositories(images map[string]*Image) error {
+	content, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(StoreRoot, 0755); err != nil {
+		return err
+	}
+	tmpFile := path.Join(StoreRoot, RepositoriesFile+".tmp")
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path.Join(StoreRoot, RepositoriesFile))
+}
+
+func SaveImage(img *Image) error {
+	images, err := loadRepositories()
+	if err != nil {
+		return err
+	}
+	images[img.Name] = img
+	return saveRepositories(images)
+}
+
+// GetImage looks an image up by name, returns nil if it's not in the store
+func GetImage(name string) (*Image, error) {
+	images, err := loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	return images[NormalizeName(name)], nil
+}
+
+func ListImages() ([]*Image, error) {
+	images, err := loadRepositories()
+	if err != nil {
+		return nil, err
+	}
+	var list []*Image
+	for _, img := range images {
+		list = append(list, img)
+	}
+	return list, nil
+}
+
+// LayerDirs returns the extracted layers of an image, top-most first,
+// which is the order AUFS expects its branches in
+func LayerDirs(name string) ([]string, error) {
+	img, err := GetImage(name)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("image %s not found", name)
+	}
+	var dirs []string
+	for i := len(img.Layers) - 1; i >= 0; i-- {
+		if err := ExtractLayer(img.Layers[i]); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, LayerPath(img.Layers[i]))
+	}
+	return dirs, nil
+}
+
+func ReadImageConfig(img *Image) (*ImageConfig, error) {
+	content, err := ReadBlob(img.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal image config error %v", err)
+	}
+	return &config, nil
+}
+
+// ImportTar turns a plain rootfs tarball (the old RootUrl/<image>.tar format)
+// into a single layer image, so it can be pushed to a registry
+func ImportTar(name string, tarPath string, config *ContainerConfig) (*Image, error) {
+	src, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(path.Join(StoreRoot, "blobs", "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(path.Join(StoreRoot, "blobs", "sha256"), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	// diffID is the digest of the uncompressed tar, the blob digest of the gzipped one
+	var uncompressed io.Reader = src
+	if gz, err := gzip.NewReader(src); err == nil {
+		uncompressed = gz
+	} else if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	diffVerifier := newDigestVerifier()
+	blobVerifier := newDigestVerifier()
+	gzWriter := gzip.NewWriter(io.MultiWriter(tmp, blobVerifier))
+	if _, err := io.Copy(io.MultiWriter(gzWriter, diffVerifier), uncompressed); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("compress %s error %v", tarPath, err)
+	}
+	if err := gzWriter.Close(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	layerDigest := blobVerifier.Digest()
+	if err := os.Rename(tmp.Name(), BlobPath(layerDigest)); err != nil {
+		return nil, err
+	}
+	return NewImage(NormalizeName(name), []string{layerDigest}, []string{diffVerifier.Digest()}, config)
+}
+
+// NewImage writes a config and a manifest for the given layers and saves the image
+func NewImage(name string, layers []string, diffIDs []string, containerConfig *ContainerConfig) (*Image, error) {
+	created := time.Now().UTC().Format(time.RFC3339)
+	config := &ImageConfig{
+		Created:      created,
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		Config:       *containerConfig,
+		RootFS:       RootFS{Type: "layers", DiffIDs: diffIDs},
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configDigest, err := PutBlob(configBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        &Descriptor{MediaType: MediaTypeOCIConfig, Digest: configDigest, Size: int64(len(configBytes))},
+	}
+	for _, layer := range layers {
+		info, err := os.Stat(BlobPath(layer))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: MediaTypeOCILayer, Digest: layer, Size: info.Size()})
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	manifestDigest, err := PutBlob(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Name:      name,
+		Manifest:  manifestDigest,
+		MediaType: MediaTypeOCIManifest,
+		Config:    configDigest,
+		Layers:    layers,
+		Created:   created,
+	}
+	if err := SaveImage(img); err != nil {
+		return nil, err
+	}
+	log.Infof("Imported %s as %s", name, manifestDigest)
+	return img, nil
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
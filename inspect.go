@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+// containerInspect adds what only the running process can tell to the recorded info
+type containerInspect struct {
+	*container.ContainerInfo
+	EffectiveCapabilities []string `json:"effectiveCapabilities,omitempty"`
+}
+
+func inspectContainer(containerName string) {
+	containerInfo, err := state.Load(containerName)
+	if err != nil {
+		log.Errorf("Get container %s info error %v", containerName, err)
+		return
+	}
+
+	inspect := &containerInspect{ContainerInfo: containerInfo}
+	if containerInfo.Status == container.RUNNING && containerInfo.Pid != "" {
+		if caps, err := container.ProcessCapabilities(containerInfo.Pid, "CapEff"); err == nil {
+			inspect.EffectiveCapabilities = caps
+		} else {
+			log.Warnf("Read capabilities of %s error %v", containerInfo.Pid, err)
+		}
+	}
+
+	content, err := json.MarshalIndent(inspect, "", "    ")
+	if err != nil {
+		log.Errorf("Marshal container %s info error %v", containerName, err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(content))
+}
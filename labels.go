@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// labelsFromFlags collects --label-file first and --label after it, so
+// --label wins on duplicates. A bare key gets an empty value.
+func labelsFromFlags(context *cli.Context) (map[string]string, error) {
+	var specs []string
+	for _, labelFile := range context.StringSlice("label-file") {
+		// one key=value or key per line, like an env file
+		fileLabels, err := readEnvFile(labelFile)
+		if err != nil {
+			return nil, fmt.Errorf("read label file error %v", err)
+		}
+		specs = append(specs, fileLabels...)
+	}
+	specs = append(specs, context.StringSlice("label")...)
+
+	labels := map[string]string{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid label %q, expect key=value", spec)
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
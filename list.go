@@ -3,64 +3,401 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"./container"
+	"./state"
 	log "github.com/sirupsen/logrus"
 )
 
-func ListContainers() {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
-	dirURL = dirURL[:len(dirURL)-1]
-	files, err := ioutil.ReadDir(dirURL)
+// ListOptions are the flags of ps
+type ListOptions struct {
+	All     bool     // stopped and exited containers too
+	Quiet   bool     // only the IDs
+	Filters []string // key=value, see psFilterKeys
+	Format  string   // table, json or a Go template
+	NoTrunc bool
+	Size    bool // of the write layer, slow for big ones
+}
+
+// psRow is a line of ps, its fields are what --format templates can use
+type psRow struct {
+	ID         string
+	Names      string
+	Image      string
+	Command    string
+	CreatedAt  string
+	RunningFor string
+	Status     string
+	State      string
+	Pid        string
+	Size       string
+	Labels     string
+
+	labels map[string]string
+	header bool
+}
+
+// Label is the value of one label, {{.Label "team"}}
+func (r *psRow) Label(key string) string {
+	if r.header {
+		return strings.ToUpper(key)
+	}
+	return r.labels[key]
+}
+
+// psHeader names the columns of a "table ..." template
+var psHeader = &psRow{
+	ID:         "ID",
+	Names:      "NAME",
+	Image:      "IMAGE",
+	Command:    "COMMAND",
+	CreatedAt:  "CREATED AT",
+	RunningFor: "CREATED",
+	Status:     "STATUS",
+	State:      "STATE",
+	Pid:        "PID",
+	Size:       "SIZE",
+	Labels:     "LABELS",
+	header:     true,
+}
+
+const defaultPsFormat = "table {{.ID}}\t{{.Names}}\t{{.Image}}\t{{.Pid}}\t{{.Status}}\t{{.Command}}\t{{.RunningFor}}"
+
+// psFilterKeys are what --filter knows, the values of a key are or-ed and
+// the keys and-ed
+var psFilterKeys = map[string]bool{
+	"status":   true, // running, paused, stopped or exited
+	"name":     true, // part of the name
+	"label":    true, // key or key=value
+	"ancestor": true, // the image
+	"before":   true, // created before that container
+	"since":    true, // created after that container
+}
+
+var containerStatuses = []string{container.RUNNING, container.PAUSED, container.STOP, container.EXIT}
+
+func ListContainers(opts *ListOptions) error {
+	filters, err := parsePsFilters(opts.Filters)
+	if err != nil {
+		return err
+	}
+	containers, err := state.List()
 	if err != nil {
-		log.Errorf("Read dir %s error %v", dirURL, err)
-		return
+		return fmt.Errorf("list containers error %v", err)
+	}
+	if err := filters.resolve(containers); err != nil {
+		return err
 	}
 
-	var containers []*container.ContainerInfo
-	for _, file := range files {
-		tmpContainer, err := getContainerInfo(file)
+	// \t in a template given on the command line separates the columns
+	format := strings.Replace(opts.Format, `\t`, "\t", -1)
+	if format == "" || format == "table" {
+		format = defaultPsFormat
+		if opts.Size {
+			format += "\t{{.Size}}"
+		}
+	}
+	var tmpl *template.Template
+	if format != "json" {
+		tmpl, err = template.New("ps").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				content, err := json.Marshal(v)
+				return string(content), err
+			},
+			"join":  strings.Join,
+			"lower": strings.ToLower,
+			"upper": strings.ToUpper,
+		}).Parse(strings.TrimPrefix(format, "table "))
 		if err != nil {
-			log.Errorf("Get container info error %v", err)
+			return fmt.Errorf("invalid format %q: %v", opts.Format, err)
+		}
+	}
+	// a template may ask for the size without -s
+	withSize := opts.Size || strings.Contains(format, ".Size")
+
+	// newest first, like docker
+	sort.Slice(containers, func(i, j int) bool {
+		if containers[i].CreatedTime != containers[j].CreatedTime {
+			return containers[i].CreatedTime > containers[j].CreatedTime
+		}
+		return containers[i].Name < containers[j].Name
+	})
+	var rows []*psRow
+	for _, item := range containers {
+		// paused ones are up, like docker
+		running := item.Status == container.RUNNING || item.Status == container.PAUSED
+		if !opts.All && !running && len(filters["status"]) == 0 {
+			continue
+		}
+		if !filters.match(item) {
 			continue
 		}
-		containers = append(containers, tmpContainer)
+		rows = append(rows, newPsRow(item, opts.NoTrunc, withSize))
 	}
 
+	if opts.Quiet {
+		for _, row := range rows {
+			fmt.Fprintln(os.Stdout, row.ID)
+		}
+		return nil
+	}
+	if format == "json" {
+		for _, row := range rows {
+			content, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stdout, string(content))
+		}
+		return nil
+	}
+
+	// only tables get a header and aligned columns
+	if !strings.HasPrefix(format, "table ") {
+		return printPsRows(os.Stdout, tmpl, rows)
+	}
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	fmt.Fprint(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
-	for _, item := range containers {
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
-			item.Id,
-			item.Name,
-			item.Pid,
-			item.Status,
-			item.Command,
-			item.CreatedTime)
+	if err := printPsRows(w, tmpl, append([]*psRow{psHeader}, rows...)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func printPsRows(w io.Writer, tmpl *template.Template, rows []*psRow) error {
+	for _, row := range rows {
+		if err := tmpl.Execute(w, row); err != nil {
+			return fmt.Errorf("format container %s error %v", row.Names, err)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// findContainer finds a container by name or ID
+func findContainer(infos []*container.ContainerInfo, ref string) *container.ContainerInfo {
+	for _, info := range infos {
+		if info.Name == ref || info.Id == ref {
+			return info
+		}
+	}
+	return nil
+}
+
+type psFilters map[string][]string
+
+func parsePsFilters(specs []string) (psFilters, error) {
+	filters := psFilters{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid filter %q, expect key=value", spec)
+		}
+		key, value := parts[0], parts[1]
+		if !psFilterKeys[key] {
+			return nil, fmt.Errorf("unknown filter %q, it must be status, name, label, ancestor, before or since", key)
+		}
+		if key == "status" && !containsString(containerStatuses, value) {
+			return nil, fmt.Errorf("invalid status %q, it must be one of %s", value, strings.Join(containerStatuses, ", "))
+		}
+		filters[key] = append(filters[key], value)
+	}
+	return filters, nil
+}
+
+// resolve turns the containers of before and since into when they were created
+func (f psFilters) resolve(infos []*container.ContainerInfo) error {
+	for _, key := range []string{"before", "since"} {
+		for i, ref := range f[key] {
+			refInfo := findContainer(infos, ref)
+			if refInfo == nil {
+				return fmt.Errorf("no such container %s for filter %s", ref, key)
+			}
+			f[key][i] = refInfo.CreatedTime
+		}
 	}
-	if err := w.Flush(); err != nil {
-		log.Errorf("Flush error %v", err)
-		return
+	return nil
+}
+
+func (f psFilters) match(info *container.ContainerInfo) bool {
+	for key, values := range f {
+		matched := false
+		for _, value := range values {
+			if matchPsFilter(key, value, info) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
 	}
+	return true
 }
 
-func getContainerInfo(file os.FileInfo) (*container.ContainerInfo, error) {
-	containerName := file.Name()
-	configFileDir := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFileDir = configFileDir + container.ConfigName
-	content, err := ioutil.ReadFile(configFileDir)
+// matchPsFilter checks one key=value, before and since have been turned into
+// creation times
+func matchPsFilter(key string, value string, info *container.ContainerInfo) bool {
+	switch key {
+	case "status":
+		return info.Status == value
+	case "name":
+		return strings.Contains(info.Name, value)
+	case "label":
+		parts := strings.SplitN(value, "=", 2)
+		labelValue, ok := info.Labels[parts[0]]
+		return ok && (len(parts) == 1 || labelValue == parts[1])
+	case "ancestor":
+		return imageRef(info.Image) == imageRef(value)
+	case "before":
+		return info.CreatedTime < value
+	case "since":
+		return info.CreatedTime > value
+	}
+	return false
+}
+
+// imageRef adds the latest tag an image name implies
+func imageRef(name string) string {
+	if strings.LastIndex(name, ":") <= strings.LastIndex(name, "/") {
+		return name + ":latest"
+	}
+	return name
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newPsRow(info *container.ContainerInfo, noTrunc bool, withSize bool) *psRow {
+	row := &psRow{
+		ID:        info.Id,
+		Names:     info.Name,
+		Image:     info.Image,
+		Command:   info.Command,
+		CreatedAt: info.CreatedTime,
+		Status:    psStatus(info),
+		State:     info.Status,
+		Pid:       info.Pid,
+		labels:    info.Labels,
+	}
+	if !noTrunc {
+		row.Command = truncate(row.Command, 20)
+	}
+	if created, err := parseStateTime(info.CreatedTime); err == nil {
+		row.RunningFor = humanDuration(time.Since(created)) + " ago"
+	}
+	var labels []string
+	for k, v := range row.labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	row.Labels = strings.Join(labels, ",")
+	if withSize {
+		row.Size = containerSize(info)
+	}
+	return row
+}
+
+// psStatus is the status with how long it has been up
+func psStatus(info *container.ContainerInfo) string {
+	var status string
+	switch info.Status {
+	case container.RUNNING, container.PAUSED:
+		startedAt := info.StartedAt
+		if startedAt == "" {
+			startedAt = info.CreatedTime
+		}
+		status = "Up"
+		if started, err := parseStateTime(startedAt); err == nil {
+			status += " " + humanDuration(time.Since(started))
+		}
+		if info.Status == container.PAUSED {
+			status += " (Paused)"
+		}
+	case container.STOP:
+		status = "Stopped"
+	case container.EXIT:
+		status = "Exited"
+	default:
+		status = info.Status
+	}
+	if info.OOMKilled {
+		status += " (OOMKilled)"
+	}
+	return status
+}
+
+// containerSize is the size of the write layer, and with the image's layers
+func containerSize(info *container.ContainerInfo) string {
+	size, err := container.WriteLayerSize(info.Name)
 	if err != nil {
-		log.Errorf("Read file %s error %v", configFileDir, err)
-		return nil, err
+		log.Warnf("Get size of container %s error %v", info.Name, err)
+		return "-"
 	}
-	var containerInfo container.ContainerInfo
-	if err := json.Unmarshal(content, &containerInfo); err != nil {
-		log.Errorf("Json unmarshal error %v", err)
-		return nil, err
+	imageSize, err := container.ImageSize(info.Image)
+	if err != nil {
+		log.Warnf("Get size of image %s error %v", info.Image, err)
+		return humanSize(size)
 	}
+	return fmt.Sprintf("%s (virtual %s)", humanSize(size), humanSize(size+imageSize))
+}
 
-	return &containerInfo, nil
+// parseStateTime parses the times the state records, in local time
+func parseStateTime(value string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+}
+
+// humanDuration says how long, roughly, "3 minutes"
+func humanDuration(d time.Duration) string {
+	seconds := int(d.Seconds())
+	switch {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	minutes := int(d.Minutes())
+	switch {
+	case minutes == 1:
+		return "About a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	hours := int(d.Hours() + 0.5)
+	switch {
+	case hours == 1:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	case hours < 24*7*2:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours < 24*30*2:
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	case hours < 24*365*2:
+		return fmt.Sprintf("%d months", hours/24/30)
+	}
+	return fmt.Sprintf("%d years", hours/24/365)
+}
+
+// truncate shortens s to n characters, ending with an ellipsis
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
 }
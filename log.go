@@ -6,12 +6,16 @@ import (
 	"os"
 
 	"./container"
+	"./state"
 	log "github.com/sirupsen/logrus"
 )
 
 func logContianer(containerName string) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	logFileLocation := dirURL + container.ContainerLogFile
+	if _, err := state.Load(containerName); err != nil {
+		log.Errorf("Get container %s info error %v", containerName, err)
+		return
+	}
+	logFileLocation := state.Dir(containerName) + container.ContainerLogFile
 
 	// Open log files
 	file, err := os.Open(logFileLocation)
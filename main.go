@@ -2,7 +2,10 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 
+	"./container"
+	"./state"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -15,19 +18,69 @@ func main() {
 	app.Usage = Usage
 
 	app.Commands = []*cli.Command{
-		initCommand,   // docker init
-		runCommand,    // docker run
-		commitCommand, // docker commit
-		listCommand,   // docker ps
-		logCommand,    // docker log
-		execCommand,   // docker exec
-		stopCommand,   // docker stop
-		removeCommand, //docker rm
+		initCommand,        // docker init
+		runCommand,         // docker run
+		commitCommand,      // docker commit
+		listCommand,        // docker ps
+		topCommand,         // docker top
+		statsCommand,       // docker stats
+		logCommand,         // docker log
+		execCommand,        // docker exec
+		execInitCommand,    // docker exec helper
+		execMonitorCommand, // detached docker exec
+		stopCommand,        // docker stop
+		startCommand,       // docker start
+		pauseCommand,       // docker pause
+		unpauseCommand,     // docker unpause
+		updateCommand,      // docker update
+		eventsCommand,      // docker events
+		monitorCommand,     // OOM watcher of a container
+		systemCommand,      // docker system
+		removeCommand,      //docker rm
+		pruneCommand,       // docker container prune
+		pullCommand,        // docker pull
+		pushCommand,        // docker push
+		inspectCommand,     // docker inspect
+		copyCommand,        // docker cp
+		copyHelperCommand,  // docker cp helper
+	}
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "root",
+			Usage:   "directory of the images, layers and container state",
+			EnvVars: []string{"MYDOCKER_ROOT"},
+		},
 	}
 
 	app.Before = func(context *cli.Context) error {
 		log.SetFormatter(&log.JSONFormatter{})
 		log.SetOutput(os.Stdout)
+		// Unprivileged users get rootless mode with their own state and images
+		if os.Geteuid() != 0 {
+			container.UseRootlessPaths()
+		}
+		if root := context.String("root"); root != "" {
+			root, err := filepath.Abs(root)
+			if err != nil {
+				return err
+			}
+			container.UseRoot(root)
+			// the init, monitors and restarts we run find it there
+			os.Setenv("MYDOCKER_ROOT", root)
+		}
+		// the helpers we run ourselves don't, they'd race the command that did
+		switch context.Args().First() {
+		case "", "init", "exec-init", "exec-monitor", "monitor", "cp-helper":
+		default:
+			// their layers are under the default root, so only it takes them
+			if context.String("root") == "" {
+				if err := state.MoveFrom(container.OldInfoLocation()); err != nil {
+					log.Warnf("Move containers from %s error %v", container.OldInfoLocation(), err)
+				}
+			}
+			reconcileContainers()
+		}
 		return nil
 	}
 
@@ -2,23 +2,45 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 
+	"./cgroups"
+	"./cgroups/subsystems"
 	"./container"
+	"./image"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 var removeCommand = &cli.Command{
 	Name:  "rm",
-	Usage: "remove a stopped container",
+	Usage: "remove stopped containers",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "also remove the stopped containers matching it, like ps --filter label=key=value",
+		},
+	},
 	Action: func(context *cli.Context) error {
-		if context.NArg() < 1 {
+		if context.NArg() < 1 && len(context.StringSlice("filter")) == 0 {
 			return fmt.Errorf("Missing container's Name ")
 		}
-		containerName := context.Args().Get(0)
-		removeContainer(containerName)
-		return nil
+		return removeContainers(context.Args().Slice(), context.StringSlice("filter"))
+	},
+}
+
+var pruneCommand = &cli.Command{
+	Name:  "prune",
+	Usage: "remove all stopped containers",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "only the ones matching it, like ps --filter label=key=value",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return pruneContainers(context.StringSlice("filter"))
 	},
 }
 
@@ -35,19 +57,59 @@ var stopCommand = &cli.Command{
 	},
 }
 
+var startCommand = &cli.Command{
+	Name:  "start",
+	Usage: "start a stopped container again",
+	Flags: []cli.Flag{
+		// a restart policy starting it, backing off one that keeps dying
+		&cli.DurationFlag{
+			Name:   "restart-delay",
+			Hidden: true,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container's Name ")
+		}
+		return startContainer(context.Args().Get(0), context.IsSet("restart-delay"), context.Duration("restart-delay"))
+	},
+}
+
 // mydocker exec
 var execCommand = &cli.Command{
 	Name:  "exec",
 	Usage: "exec a command into container",
+	Subcommands: []*cli.Command{
+		execListCommand,
+		execInspectCommand,
+	},
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "e",
+			Usage: "set environment, KEY=VAL or KEY to pass the host's value",
+		},
+		&cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "read environment variables from a file",
+		},
+		&cli.StringFlag{
+			Name:  "u",
+			Usage: "username or uid (format: <name|uid>[:<group|gid>]), defaults to the container's user",
+		},
+		&cli.StringFlag{
+			Name:  "w",
+			Usage: "working directory inside the container, defaults to the container's",
+		},
+		&cli.BoolFlag{
+			Name:  "ti",
+			Usage: "enable tty",
+		},
+		&cli.BoolFlag{
+			Name:  "d",
+			Usage: "detach, run the command in the background",
+		},
+	},
 	Action: func(context *cli.Context) error {
-		// For callback
-		// The second time we will enter the if branch which means the env has been set and the Cgo code has been executed
-		if os.Getenv(ENV_EXEC_PID) != "" {
-			log.Infof("pid callback pid %d", os.Getgid())
-			return nil
-		}
-
-		// The first time we will pass the if, and try to exec the Cgo code
 		if context.NArg() < 2 {
 			return fmt.Errorf("Misssing container name or command")
 		}
@@ -56,11 +118,127 @@ var execCommand = &cli.Command{
 		for _, arg := range context.Args().Tail() {
 			commandArray = append(commandArray, arg)
 		}
-		ExecContainer(containerName, commandArray)
+		envSlice, err := envFromFlags(context)
+		if err != nil {
+			return err
+		}
+		if context.Bool("ti") && context.Bool("d") {
+			return fmt.Errorf("-d and -ti cannot set together")
+		}
+		// input written to the pty before the command reads it may be lost
+		if context.Bool("ti") && !container.IsTerminal(os.Stdin) {
+			return fmt.Errorf("-ti needs a terminal, the input device is not a TTY")
+		}
+		exitCode, err := ExecContainer(containerName, commandArray, &ExecOptions{
+			Tty:     context.Bool("ti"),
+			Detach:  context.Bool("d"),
+			Env:     envSlice,
+			User:    context.String("u"),
+			Workdir: context.String("w"),
+		})
+		if err != nil {
+			return err
+		}
+		// like docker exec, we exit with the command's status
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+		return nil
+	},
+}
+
+// mydocker exec ls
+var execListCommand = &cli.Command{
+	Name:  "ls",
+	Usage: "List the exec sessions of a container",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Please Input your container's Name")
+		}
+		ListExecSessions(context.Args().Get(0))
+		return nil
+	},
+}
+
+// mydocker exec inspect
+var execInspectCommand = &cli.Command{
+	Name:  "inspect",
+	Usage: "Show the details of an exec session",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 2 {
+			return fmt.Errorf("Missing container name or exec id")
+		}
+		inspectExecSession(context.Args().Get(0), context.Args().Get(1))
 		return nil
 	},
 }
 
+// mydocker exec-monitor, waits for a detached exec to record its exit status
+var execMonitorCommand = &cli.Command{
+	Name:   "exec-monitor",
+	Usage:  "Wait for a detached exec session. Do not call it outside",
+	Hidden: true,
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 2 {
+			return fmt.Errorf("Missing container name or exec id")
+		}
+		// our output is the session's log, keep it for the command
+		log.SetLevel(log.WarnLevel)
+		return RunExecMonitor(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+// mydocker exec-init, nsenter already moved us into the container
+var execInitCommand = &cli.Command{
+	Name:   "exec-init",
+	Usage:  "Run the command of mydocker exec in the container. Do not call it outside",
+	Hidden: true,
+	Action: func(context *cli.Context) error {
+		// our stdout is the command's, keep it clean
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.WarnLevel)
+		return exitOnExecError(container.RunExecInitProcess())
+	},
+}
+
+// exitOnExecError exits with the status of a command that could not be
+// executed, which is what the container or the exec session exits with
+func exitOnExecError(err error) error {
+	if execErr, ok := err.(*container.ExecError); ok {
+		log.Error(execErr)
+		os.Exit(execErr.Code)
+	}
+	return err
+}
+
+// mydocker cp
+var copyCommand = &cli.Command{
+	Name: "cp",
+	Usage: `Copy files between a container and the host, ownership and permissions kept
+			mydocker cp container:src dst, mydocker cp src container:dst; - is a tar on stdin or stdout`,
+	Action: func(context *cli.Context) error {
+		if context.NArg() != 2 {
+			return fmt.Errorf("cp needs a source and a destination")
+		}
+		// stdout may be the tar
+		log.SetOutput(os.Stderr)
+		return copyFiles(context.Args().Get(0), context.Args().Get(1))
+	},
+}
+
+// mydocker cp-helper, reads or writes the files in the container
+var copyHelperCommand = &cli.Command{
+	Name:   "cp-helper",
+	Usage:  "Archive or extract files in a container for mydocker cp. Do not call it outside",
+	Hidden: true,
+	Action: func(context *cli.Context) error {
+		// our stdout is the tar
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.WarnLevel)
+		return container.RunCopyHelper()
+	},
+}
+
 // mydocker log
 var logCommand = &cli.Command{
 	Name:  "log",
@@ -88,16 +266,236 @@ var initCommand = &cli.Command{
 		// log.Infof("Command: %s", cmd)
 		log.Infof("******* Container Initializing *******")
 		err := container.RunContainerInitProcess()
-		return err
+		return exitOnExecError(err)
+	},
+}
+
+// mydocker inspect
+var inspectCommand = &cli.Command{
+	Name:  "inspect",
+	Usage: "Show the details of a container",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container's Name ")
+		}
+		inspectContainer(context.Args().Get(0))
+		return nil
+	},
+}
+
+// mydocker pause
+var pauseCommand = &cli.Command{
+	Name:  "pause",
+	Usage: "Pause all processes within a container",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container's Name ")
+		}
+		return pauseContainer(context.Args().Get(0))
+	},
+}
+
+// mydocker unpause
+var unpauseCommand = &cli.Command{
+	Name:  "unpause",
+	Usage: "Unpause all processes within a container",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container's Name ")
+		}
+		return unpauseContainer(context.Args().Get(0))
+	},
+}
+
+// mydocker update
+var updateCommand = &cli.Command{
+	Name:  "update",
+	Usage: "Update the resource limits of a running container",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "memory",
+			Aliases: []string{"m"},
+			Usage:   "memory limit, e.g. 512m",
+		},
+		&cli.StringFlag{
+			Name:  "memory-swap",
+			Usage: "memory plus swap limit, -1 for unlimited swap",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-shares",
+			Usage: "cpu shares, relative weight",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-period",
+			Usage: "cpu cfs period in microseconds",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-quota",
+			Usage: "cpu cfs quota in microseconds per period, -1 for unlimited",
+		},
+		&cli.StringFlag{
+			Name:  "cpuset-cpus",
+			Usage: "cpus the container may run on, e.g. 0-2,4",
+		},
+		&cli.StringFlag{
+			Name:  "pids-limit",
+			Usage: "maximum number of processes, 0 or -1 for unlimited",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container's Name ")
+		}
+		res := &subsystems.ResourceConfig{
+			MemoryLimit: context.String("memory"),
+			MemorySwap:  context.String("memory-swap"),
+			CpuShare:    context.String("cpu-shares"),
+			CpuPeriod:   context.String("cpu-period"),
+			CpuQuota:    context.String("cpu-quota"),
+			CpuSet:      context.String("cpuset-cpus"),
+			PidsLimit:   context.String("pids-limit"),
+		}
+		if context.NumFlags() == 0 {
+			return fmt.Errorf("you must provide one or more flags when using this command")
+		}
+		return updateContainer(context.Args().Get(0), res)
+	},
+}
+
+// mydocker system
+var systemCommand = &cli.Command{
+	Name:  "system",
+	Usage: "Manage mydocker itself",
+	Subcommands: []*cli.Command{
+		systemCheckCommand,
+	},
+}
+
+// mydocker system check
+var systemCheckCommand = &cli.Command{
+	Name:  "check",
+	Usage: "Look for cgroups of removed containers and processes left in stopped ones",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "clean",
+			Usage: "remove the cgroups of removed containers and kill the processes of stopped ones",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return checkCgroups(context.Bool("clean"))
+	},
+}
+
+// mydocker events
+var eventsCommand = &cli.Command{
+	Name:  "events",
+	Usage: "Get real time events of containers",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "also show the events since a time, RFC3339 or a duration like 10m",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "stream events until a time, RFC3339 or a duration like 10m",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "json for one JSON object per event",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return StreamEvents(context.String("since"), context.String("until"), context.String("format"))
+	},
+}
+
+// mydocker monitor, watches a container's cgroup for OOM events
+var monitorCommand = &cli.Command{
+	Name:   "monitor",
+	Usage:  "Watch a container for OOM events. Do not call it outside",
+	Hidden: true,
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return RunContainerMonitor(context.Args().Get(0))
+	},
+}
+
+// mydocker top
+var topCommand = &cli.Command{
+	Name:  "top",
+	Usage: "Display the running processes of a container",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing container's Name ")
+		}
+		topContainer(context.Args().Get(0))
+		return nil
+	},
+}
+
+// mydocker stats
+var statsCommand = &cli.Command{
+	Name:  "stats",
+	Usage: "Display a live stream of container(s) resource usage statistics",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "no-stream",
+			Usage: "print a single sample and exit",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "table, or json for one object per container and sample",
+		},
+		&cli.BoolFlag{
+			Name:  "by-parent",
+			Usage: "add up the containers of each cgroup parent, memory against the parent's limit",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		return StatsContainers(context.Args().Slice(), context.Bool("no-stream"), context.String("format"), context.Bool("by-parent"))
 	},
 }
 
 var listCommand = &cli.Command{
 	Name:  "ps",
-	Usage: "List all the container",
+	Usage: "List the running containers",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "a",
+			Usage: "show all containers, not only the running ones",
+		},
+		&cli.BoolFlag{
+			Name:  "q",
+			Usage: "only print the IDs",
+		},
+		&cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "status=, name=, label=, ancestor=, before= or since=; the same key twice matches either",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "table, json for one object per container, or a Go template like \"table {{.ID}}\\t{{.Status}}\"",
+		},
+		&cli.BoolFlag{
+			Name:  "no-trunc",
+			Usage: "don't truncate the command",
+		},
+		&cli.BoolFlag{
+			Name:  "s",
+			Usage: "show the size of the write layer, and with the image",
+		},
+	},
 	Action: func(context *cli.Context) error {
-		ListContainers()
-		return nil
+		return ListContainers(&ListOptions{
+			All:     context.Bool("a"),
+			Quiet:   context.Bool("q"),
+			Filters: context.StringSlice("filter"),
+			Format:  context.String("format"),
+			NoTrunc: context.Bool("no-trunc"),
+			Size:    context.Bool("s"),
+		})
 	},
 }
 
@@ -105,7 +503,7 @@ var listCommand = &cli.Command{
 var runCommand = &cli.Command{
 	Name: "run",
 	Usage: `Create a container with namespace and cgroups limit
-			mydocker run -ti [command]`,
+			mydocker run -ti image [command]`,
 
 	/*
 		目前的命令
@@ -117,7 +515,11 @@ var runCommand = &cli.Command{
 	Flags: []cli.Flag{
 		&cli.StringSliceFlag{
 			Name:  "e",
-			Usage: "set environment",
+			Usage: "set environment, KEY=VAL or KEY to pass the host's value",
+		},
+		&cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "read environment variables from a file",
 		},
 		// -ti tty
 		&cli.BoolFlag{
@@ -136,9 +538,86 @@ var runCommand = &cli.Command{
 		},
 		// -name Specify the container's name
 		&cli.StringFlag{
-			Name:  "name ",
+			Name:  "name",
 			Usage: "container name ",
 		},
+		// --entrypoint overwrite the image's entrypoint
+		&cli.StringFlag{
+			Name:  "entrypoint",
+			Usage: "overwrite the default entrypoint of the image",
+		},
+		// -w working directory
+		&cli.StringFlag{
+			Name:  "w",
+			Usage: "working directory inside the container",
+		},
+		// -u user
+		&cli.StringFlag{
+			Name:  "u",
+			Usage: "username or uid (format: <name|uid>[:<group|gid>])",
+		},
+		// --userns-remap map root of the container onto a user's subordinate ids
+		&cli.StringFlag{
+			Name:  "userns-remap",
+			Usage: "run in a user namespace mapped onto the subuid/subgid ranges of user[:group]",
+		},
+		&cli.StringSliceFlag{
+			Name:  "uidmap",
+			Usage: "uid map of the user namespace, containerID:hostID:size",
+		},
+		&cli.StringSliceFlag{
+			Name:  "gidmap",
+			Usage: "gid map of the user namespace, containerID:hostID:size (defaults to uidmap)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cap-add",
+			Usage: "add a Linux capability, or ALL",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Usage: "drop a Linux capability, or ALL",
+		},
+		&cli.BoolFlag{
+			Name:  "privileged",
+			Usage: "give all capabilities to the container and run it unconfined",
+		},
+		&cli.StringSliceFlag{
+			Name:  "security-opt",
+			Usage: "seccomp=<profile.json|unconfined>, no-new-privileges=<true|false> (default true)",
+		},
+		&cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "mount the container's root filesystem read-only",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tmpfs",
+			Usage: "mount a tmpfs, path[:options] like /tmp:size=64m,mode=1777",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device",
+			Usage: "add a host device, hostPath[:containerPath][:permissions] like /dev/sdc:/dev/xvdc:rwm",
+		},
+		&cli.StringFlag{
+			Name:  "hostname",
+			Usage: "container host name, defaults to the container ID",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "set a DNS server",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "set a DNS search domain, . for none",
+		},
+		&cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "add a host to /etc/hosts, host:ip",
+		},
+		&cli.StringFlag{
+			Name:  "shm-size",
+			Usage: "size of /dev/shm",
+			Value: container.DefaultShmSize,
+		},
 		&cli.StringFlag{
 			Name:  "m",
 			Usage: "memory limit",
@@ -151,11 +630,85 @@ var runCommand = &cli.Command{
 			Name:  "cpuset",
 			Usage: "cpuset limit",
 		},
+		&cli.StringFlag{
+			Name:  "memory-swap",
+			Usage: "memory plus swap limit, -1 for unlimited swap",
+		},
+		&cli.StringFlag{
+			Name:  "memory-reservation",
+			Usage: "memory soft limit, e.g. 256m",
+		},
+		&cli.BoolFlag{
+			Name:  "oom-kill-disable",
+			Usage: "disable the OOM killer, set a memory limit with it",
+		},
+		&cli.StringFlag{
+			Name:  "pids-limit",
+			Usage: "maximum number of processes, 0 or -1 for unlimited",
+		},
+		&cli.StringFlag{
+			Name:  "cpus",
+			Usage: "number of cpus, e.g. 1.5",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-period",
+			Usage: "cpu cfs period in microseconds",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-quota",
+			Usage: "cpu cfs quota in microseconds per period",
+		},
+		&cli.StringFlag{
+			Name:  "blkio-weight",
+			Usage: "block IO relative weight, between 10 and 1000",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device-read-bps",
+			Usage: "limit read rate from a device, e.g. /dev/sda:1mb",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device-write-bps",
+			Usage: "limit write rate to a device, e.g. /dev/sda:1mb",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device-read-iops",
+			Usage: "limit read operations per second from a device, e.g. /dev/sda:1000",
+		},
+		&cli.StringSliceFlag{
+			Name:  "device-write-iops",
+			Usage: "limit write operations per second to a device, e.g. /dev/sda:1000",
+		},
+		&cli.StringSliceFlag{
+			Name:  "hugetlb-limit",
+			Usage: "limit hugepage usage, pagesize:limit e.g. 2MB:1g",
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-driver",
+			Usage: "cgroupfs writes the cgroups directly, systemd runs the container in a transient scope",
+			Value: cgroups.CgroupfsDriver,
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-parent",
+			Usage: "cgroup to put the container's in, e.g. tenants/a, or tenant-a.slice for systemd; missing levels are created and removed once empty",
+		},
+		&cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "set a label, key=value, on top of the image's",
+		},
+		&cli.StringSliceFlag{
+			Name:  "label-file",
+			Usage: "read labels from a file of key=value lines",
+		},
+		&cli.StringFlag{
+			Name:  "restart",
+			Usage: "restart policy when the container exits or the host reboots: no, always or unless-stopped",
+			Value: RestartNo,
+		},
 	},
 	Action: func(context *cli.Context) error {
 		// 检查run时的参数个数
 		if context.NArg() < 1 {
-			return fmt.Errorf("[runCommand] Missing container command ??????")
+			return fmt.Errorf("[runCommand] Missing image name")
 		}
 
 		args := context.Args()
@@ -164,7 +717,7 @@ var runCommand = &cli.Command{
 			cmdArray[index] = cmd
 		}
 
-		// Get the image name
+		// Get the image name, the rest overwrite the image's default command
 		imageName := cmdArray[0]
 		cmdArray = cmdArray[1:]
 		// 检验是否使用tty交互模式
@@ -177,8 +730,29 @@ var runCommand = &cli.Command{
 		// Get the name of container
 		contianerName := context.String("name")
 
-		//
-		envSlice := context.StringSlice("e")
+		envSlice, err := envFromFlags(context)
+		if err != nil {
+			return err
+		}
+		labels, err := labelsFromFlags(context)
+		if err != nil {
+			return err
+		}
+
+		// Flags overwriting the image's config
+		runConfig := &image.ContainerConfig{
+			Cmd:        cmdArray,
+			Env:        envSlice,
+			WorkingDir: context.String("w"),
+			User:       context.String("u"),
+			Labels:     labels,
+		}
+		if context.IsSet("entrypoint") {
+			runConfig.Entrypoint = []string{}
+			if entrypoint := context.String("entrypoint"); entrypoint != "" {
+				runConfig.Entrypoint = []string{entrypoint}
+			}
+		}
 
 		/*
 
@@ -188,19 +762,114 @@ var runCommand = &cli.Command{
 		if createTty && detach {
 			return fmt.Errorf("!!!!   -d and -t cannot set together   !!!!")
 		}
+		restart := context.String("restart")
+		if restart != RestartNo && restart != RestartAlways && restart != RestartUnlessStopped {
+			return fmt.Errorf("unknown restart policy %q, it must be no, always or unless-stopped", restart)
+		}
+		if createTty && restart != RestartNo {
+			return fmt.Errorf("a container with a tty can't be restarted, --restart needs -d")
+		}
 
-		/*
-			resConf := &subsystems.ResourceConfig{
-				MemoryLimit: context.String("m"),
-				CpuSet:      context.String("cpuset"),
-				CpuShare:    context.String("cpushare"),
-			}
+		userns, err := userNSFromFlags(context)
+		if err != nil {
+			return err
+		}
 
-			Run(tty, cmdArray, resConf)
-		*/
+		resConf, err := resourcesFromFlags(context)
+		if err != nil {
+			return err
+		}
+		cgroupDriver := context.String("cgroup-driver")
+		if cgroupDriver != cgroups.CgroupfsDriver && cgroupDriver != cgroups.SystemdDriver {
+			return fmt.Errorf("unknown cgroup driver %q, it must be cgroupfs or systemd", cgroupDriver)
+		}
+		if container.Rootless && (context.IsSet("cgroup-driver") || context.IsSet("cgroup-parent")) {
+			return fmt.Errorf("rootless containers have no cgroups, --cgroup-driver and --cgroup-parent need root")
+		}
+		cgroupParent, err := cgroups.CleanParent(cgroupDriver, context.String("cgroup-parent"))
+		if err != nil {
+			return err
+		}
+		var devices []container.Device
+		for _, spec := range context.StringSlice("device") {
+			device, err := container.ParseDevice(spec)
+			if err != nil {
+				return err
+			}
+			devices = append(devices, device)
+		}
+		if err := container.ValidateShmSize(context.String("shm-size")); err != nil {
+			return err
+		}
+		if context.IsSet("hostname") {
+			if err := container.ValidateHostname(context.String("hostname")); err != nil {
+				return err
+			}
+		}
+		for _, spec := range context.StringSlice("add-host") {
+			if _, _, err := container.ParseExtraHost(spec); err != nil {
+				return err
+			}
+		}
+		for _, ns := range context.StringSlice("dns") {
+			if net.ParseIP(ns) == nil {
+				return fmt.Errorf("invalid --dns %q, expect an IP address", ns)
+			}
+		}
 
 		//log.Infof("createTty %v", createTty)
-		Run(createTty, cmdArray, volume, contianerName, imageName, envSlice)
+		capabilities, err := container.TweakCapabilities(context.StringSlice("cap-add"), context.StringSlice("cap-drop"), context.Bool("privileged"))
+		if err != nil {
+			return err
+		}
+		security, err := container.ParseSecurityOpts(context.StringSlice("security-opt"))
+		if err != nil {
+			return err
+		}
+		seccomp, seccompName, err := container.ResolveSeccomp(security.Seccomp, context.Bool("privileged"))
+		if err != nil {
+			return err
+		}
+		var tmpfs []container.Mount
+		for _, spec := range context.StringSlice("tmpfs") {
+			m, err := container.ParseTmpfs(spec)
+			if err != nil {
+				return err
+			}
+			tmpfs = append(tmpfs, m)
+		}
+
+		Run(&RunOptions{
+			Tty:           createTty,
+			Volume:        volume,
+			ContainerName: contianerName,
+			ImageName:     imageName,
+			Config:        runConfig,
+			UserNS:        userns,
+			Capabilities:  capabilities,
+			Seccomp:       seccomp,
+			SeccompName:   seccompName,
+
+			Privileged:      context.Bool("privileged"),
+			NoNewPrivileges: security.NoNewPrivileges,
+			ReadonlyRootfs:  context.Bool("read-only"),
+			Tmpfs:           tmpfs,
+
+			Resources:    resConf,
+			CgroupDriver: cgroupDriver,
+			CgroupParent: cgroupParent,
+			Devices:      devices,
+			ShmSize:      context.String("shm-size"),
+
+			Hostname: context.String("hostname"),
+			DNS: &container.DNSConfig{
+				Nameservers: context.StringSlice("dns"),
+				Search:      context.StringSlice("dns-search"),
+			},
+			ExtraHosts: context.StringSlice("add-host"),
+
+			RestartPolicy: restart,
+		})
 		return nil
 	},
 }
@@ -225,3 +894,33 @@ var commitCommand = &cli.Command{
 		return nil
 	},
 }
+
+// mydocker pull
+var pullCommand = &cli.Command{
+	Name:  "pull",
+	Usage: "Pull an image from a registry, e.g. mydocker pull busybox:latest",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "mirror",
+			Usage: "registry mirror to try first",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing image name")
+		}
+		return pullImage(context.Args().Get(0), context.StringSlice("mirror"))
+	},
+}
+
+// mydocker push
+var pushCommand = &cli.Command{
+	Name:  "push",
+	Usage: "Push an image to a registry, e.g. mydocker push myimage localhost:5000/myimage:v1",
+	Action: func(context *cli.Context) error {
+		if context.NArg() < 1 {
+			return fmt.Errorf("Missing image name")
+		}
+		return pushImage(context.Args().Get(0), context.Args().Get(1))
+	},
+}
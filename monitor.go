@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"./cgroups"
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+// startContainerMonitor runs "mydocker monitor" in the background, it watches
+// the container's memory cgroup for OOM events until the container is gone.
+// It returns once the monitor is subscribed.
+func startContainerMonitor(containerName string) error {
+	readPipe, writePipe, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readPipe.Close()
+	cmd := exec.Command("/proc/self/exe", "monitor", containerName)
+	cmd.ExtraFiles = []*os.File{writePipe}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		writePipe.Close()
+		return err
+	}
+	writePipe.Close()
+	// the monitor closes the pipe once subscribed, or when it failed to
+	ready := make([]byte, 1)
+	if n, _ := readPipe.Read(ready); n != 1 {
+		return fmt.Errorf("monitor of container %s failed to start", containerName)
+	}
+	return nil
+}
+
+// RunContainerMonitor is the monitor of a container
+func RunContainerMonitor(containerName string) error {
+	ready := os.NewFile(uintptr(3), "pipe")
+	defer ready.Close()
+	containerInfo, err := state.Load(containerName)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.Atoi(containerInfo.Pid); err != nil {
+		return fmt.Errorf("container %s has no pid", containerName)
+	}
+	manager, err := containerCgroupManager(containerInfo)
+	if err != nil {
+		return err
+	}
+	oom, err := manager.NotifyOOM()
+	if err != nil {
+		return fmt.Errorf("subscribe to oom events of %s error %v", containerName, err)
+	}
+	ready.Write([]byte{1})
+	ready.Close()
+
+	// the cgroup outlives a container whose init died, check on the init too
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-oom:
+			if !ok {
+				return nil
+			}
+			recordOOM(containerName, manager)
+		case <-ticker.C:
+			if !container.InitAlive(containerInfo) {
+				reconcileContainer(containerName)
+				return nil
+			}
+		}
+	}
+}
+
+// recordOOM reports an OOM event and marks the container when the kernel
+// killed one of its processes, with --oom-kill-disable they wait instead
+func recordOOM(containerName string, manager cgroups.Manager) {
+	containerInfo, err := state.Load(containerName)
+	if err != nil {
+		return
+	}
+	container.LogEvent("oom", containerInfo)
+	if count, ok := manager.OOMKillCount(); ok && count == 0 {
+		return
+	}
+	if !containerInfo.OOMKilled {
+		err := state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+			containerInfo.OOMKilled = true
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Update container %s info error %v", containerName, err)
+		}
+	}
+}
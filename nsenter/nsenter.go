@@ -3,65 +3,120 @@ package nsenter
 /*
 #define _GNU_SOURCE
 #include <errno.h>
+#include <fcntl.h>
 #include <sched.h>
+#include <signal.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
-#include <fcntl.h>
 #include <unistd.h>
+#include <sys/stat.h>
+#include <sys/wait.h>
 
+#ifndef CLONE_NEWCGROUP
+#define CLONE_NEWCGROUP 0x02000000
+#endif
 
-__attribute__( (constructor) ) void enter_namespace(void) {
-
+// The exec helper is started with the pid of the container's init in this
+// variable. Joining a user or mount namespace needs a single threaded process,
+// so it has to happen here, before the Go runtime starts its threads.
+#define ENV_NSENTER_PID "_MYDOCKER_NSENTER_PID"
+// mydocker exec writes one byte to this fd once the helper is in the container's cgroups
+#define SYNC_FD 3
 
-    char *mydocker_pid ;
-    mydocker_pid = getenv("mydocker_pid");
-    if(mydocker_pid){
-
-    }else{
-		fprintf(stdout, "missing mydocker_pid env skip nsenter");
-        return;
-    }
-    char *mydocker_cmd;
-    mydocker_cmd = getenv("mydocker_cmd");
-  if (mydocker_cmd) {
-		//fprintf(stdout, "got mydocker_cmd=%s\n", mydocker_cmd);
-	} else {
-		fprintf(stdout, "missing mydocker_cmd env skip nsenter");
-		return;
-	}
+static pid_t child_pid;
 
-    int i;
-    char nspath[0x1000];
-    char *namespace[] = {
-        "ipc",
-        "uts",
-        "net",
-		"pid",
-        "mnt",
+static void bail(const char *what, const char *ns) {
+    fprintf(stderr, "nsenter: %s %s: %s\n", what, ns, strerror(errno));
+    exit(255);
+}
 
-    };
+// A namespace is only joined when it differs from ours, setns on our own
+// user namespace fails and a container without a cgroup namespace shares ours
+static int same_namespace(const char *pid, const char *ns) {
+    char path[64];
+    struct stat self_ns, target_ns;
 
-    for( i=0 ; i<5;i++){
+    snprintf(path, sizeof(path), "/proc/self/ns/%s", ns);
+    if (stat(path, &self_ns) == -1) {
+        return 1; // the kernel doesn't have it
+    }
+    snprintf(path, sizeof(path), "/proc/%s/ns/%s", pid, ns);
+    if (stat(path, &target_ns) == -1) {
+        bail("stat namespace", ns);
+    }
+    return self_ns.st_ino == target_ns.st_ino && self_ns.st_dev == target_ns.st_dev;
+}
 
-        // Open and Setns the namespace one by one
-        sprintf(nspath , "/proc/%s/ns/%s" , mydocker_pid , namespace[i]);
-        int fd = open(nspath , O_RDONLY);
+static void forward_signal(int sig) {
+    if (child_pid > 0) {
+        kill(child_pid, sig);
+    }
+}
 
+__attribute__((constructor)) static void nsenter(void) {
+    // the user namespace first, it owns all the others. mnt is last because
+    // /proc/<pid> can't be found from inside the container's mount namespace.
+    static const char *namespaces[] = { "user", "cgroup", "ipc", "uts", "net", "pid", "mnt" };
+    static const int types[] = { CLONE_NEWUSER, CLONE_NEWCGROUP, CLONE_NEWIPC, CLONE_NEWUTS, CLONE_NEWNET, CLONE_NEWPID, CLONE_NEWNS };
+    int fds[7];
+    int i, n = sizeof(fds) / sizeof(fds[0]);
+    int status;
+    char sync, path[64];
+    const char *pid = getenv(ENV_NSENTER_PID);
 
-		if (setns(fd, 0) == -1) {
-			fprintf(stderr, "setns on %s namespace failed: %s\n", namespace[i], strerror(errno));
-		} else {
-			fprintf(stdout, "switch namespace [%s] succeeded\n", namespace[i]);
-		};
-        close(fd);
+    if (!pid) {
+        return;
+    }
+    if (read(SYNC_FD, &sync, 1) != 1) {
+        bail("read sync", "pipe");
     }
 
-    // After we enter the namespace, we execute the command in the target namespace.
-    int ret = system(mydocker_cmd);
-    exit(0);
-    return ;
+    // open them all while /proc/<pid> is still reachable
+    for (i = 0; i < n; i++) {
+        fds[i] = -1;
+        if (same_namespace(pid, namespaces[i])) {
+            continue;
+        }
+        snprintf(path, sizeof(path), "/proc/%s/ns/%s", pid, namespaces[i]);
+        if ((fds[i] = open(path, O_RDONLY | O_CLOEXEC)) == -1) {
+            bail("open namespace", namespaces[i]);
+        }
+    }
+    for (i = 0; i < n; i++) {
+        if (fds[i] != -1 && setns(fds[i], types[i]) == -1) {
+            bail("setns", namespaces[i]);
+        }
+        if (fds[i] != -1) {
+            close(fds[i]);
+        }
+    }
 
+    // only our children are in the pid namespace we joined: the child goes on
+    // into the Go runtime, we stay to pass signals and its exit status along
+    child_pid = fork();
+    if (child_pid == -1) {
+        bail("fork", "exec process");
+    }
+    if (child_pid == 0) {
+        return;
+    }
+    signal(SIGINT, forward_signal);
+    signal(SIGTERM, forward_signal);
+    signal(SIGHUP, forward_signal);
+    signal(SIGQUIT, forward_signal);
+    signal(SIGUSR1, forward_signal);
+    signal(SIGUSR2, forward_signal);
+    signal(SIGWINCH, forward_signal);
+    while (waitpid(child_pid, &status, 0) == -1) {
+        if (errno != EINTR) {
+            bail("wait", "exec process");
+        }
+    }
+    if (WIFSIGNALED(status)) {
+        exit(128 + WTERMSIG(status));
+    }
+    exit(WEXITSTATUS(status));
 }
 */
 import "C"
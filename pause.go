@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"./cgroups/subsystems"
+	"./container"
+	"./state"
+)
+
+// pauseContainer freezes every process of a running container
+func pauseContainer(containerName string) error {
+	var paused *container.ContainerInfo
+	err := state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+		if containerInfo.Status == container.PAUSED {
+			return fmt.Errorf("container %s is already paused", containerName)
+		}
+		if containerInfo.Status != container.RUNNING {
+			return fmt.Errorf("container %s is not running", containerName)
+		}
+		if containerInfo.CgroupPath == "" {
+			return fmt.Errorf("container %s has no cgroup to freeze, rootless containers can't be paused", containerName)
+		}
+		cgroupManager, err := containerCgroupManager(containerInfo)
+		if err != nil {
+			return err
+		}
+		if err := cgroupManager.Freeze(subsystems.Frozen); err != nil {
+			return fmt.Errorf("freeze container %s error %v", containerName, err)
+		}
+		containerInfo.Status = container.PAUSED
+		paused = containerInfo
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	container.LogEvent("pause", paused)
+	return nil
+}
+
+// unpauseContainer thaws a paused container
+func unpauseContainer(containerName string) error {
+	var unpaused *container.ContainerInfo
+	err := state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+		if containerInfo.Status != container.PAUSED {
+			return fmt.Errorf("container %s is not paused", containerName)
+		}
+		cgroupManager, err := containerCgroupManager(containerInfo)
+		if err != nil {
+			return err
+		}
+		if err := cgroupManager.Freeze(subsystems.Thawed); err != nil {
+			return fmt.Errorf("thaw container %s error %v", containerName, err)
+		}
+		containerInfo.Status = container.RUNNING
+		unpaused = containerInfo
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	container.LogEvent("unpause", unpaused)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+// stoppedContainers are the stopped and exited containers the filters match,
+// they take the keys of ps --filter
+func stoppedContainers(filterSpecs []string) ([]*container.ContainerInfo, error) {
+	filters, err := parsePsFilters(filterSpecs)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := state.List()
+	if err != nil {
+		return nil, err
+	}
+	if err := filters.resolve(infos); err != nil {
+		return nil, err
+	}
+	var stopped []*container.ContainerInfo
+	for _, info := range infos {
+		if (info.Status == container.STOP || info.Status == container.EXIT) && filters.match(info) {
+			stopped = append(stopped, info)
+		}
+	}
+	return stopped, nil
+}
+
+// pruneContainers removes the stopped containers, and tells how much of the
+// disk their write layers gave back
+func pruneContainers(filterSpecs []string) error {
+	infos, err := stoppedContainers(filterSpecs)
+	if err != nil {
+		return err
+	}
+	var reclaimed uint64
+	var deleted []string
+	failed := 0
+	for _, info := range infos {
+		size, err := container.WriteLayerSize(info.Name)
+		if err != nil {
+			log.Warnf("Get size of container %s error %v", info.Name, err)
+		}
+		if err := removeContainer(info.Name); err != nil {
+			log.Errorf("Remove container %s error %v", info.Name, err)
+			failed++
+			continue
+		}
+		reclaimed += size
+		deleted = append(deleted, info.Id)
+	}
+	if len(deleted) > 0 {
+		fmt.Fprintln(os.Stdout, "Deleted Containers:")
+		for _, id := range deleted {
+			fmt.Fprintln(os.Stdout, id)
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+	fmt.Fprintf(os.Stdout, "Total reclaimed space: %s\n", humanSize(reclaimed))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d containers could not be removed", failed, len(infos))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"./container"
+	"./image"
+)
+
+func newRegistryClient(mirrors []string, registry string) (*image.Client, error) {
+	config, err := image.LoadRegistryConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(mirrors) > 0 {
+		config.Mirrors[registry] = append(mirrors, config.Mirrors[registry]...)
+	}
+	return image.NewClient(config), nil
+}
+
+func pullImage(imageName string, mirrors []string) error {
+	ref, err := image.ParseReference(imageName)
+	if err != nil {
+		return fmt.Errorf("parse image %s error %v", imageName, err)
+	}
+	client, err := newRegistryClient(mirrors, ref.Registry)
+	if err != nil {
+		return fmt.Errorf("load registry config error %v", err)
+	}
+	img, err := client.Pull(ref)
+	if err != nil {
+		return fmt.Errorf("pull %s error %v", ref, err)
+	}
+	fmt.Fprintf(os.Stdout, "%s: downloaded %s\n", img.Name, img.Manifest)
+	return nil
+}
+
+func pushImage(imageName string, target string) error {
+	img, err := image.GetImage(imageName)
+	if err != nil {
+		return fmt.Errorf("get image %s error %v", imageName, err)
+	}
+	// Images made by commit are plain tarballs, turn them into a layered image first
+	if img == nil {
+		imageTar := container.RootUrl + "/" + imageName + ".tar"
+		if exist, _ := container.PathExists(imageTar); !exist {
+			return fmt.Errorf("image %s not found", imageName)
+		}
+		config, err := container.GetImageConfig(imageName)
+		if err != nil {
+			return fmt.Errorf("get image %s config error %v", imageName, err)
+		}
+		if img, err = image.ImportTar(imageName, imageTar, config); err != nil {
+			return fmt.Errorf("import %s error %v", imageTar, err)
+		}
+	}
+
+	if target == "" {
+		target = imageName
+	}
+	ref, err := image.ParseReference(target)
+	if err != nil {
+		return fmt.Errorf("parse image %s error %v", target, err)
+	}
+	client, err := newRegistryClient(nil, ref.Registry)
+	if err != nil {
+		return fmt.Errorf("load registry config error %v", err)
+	}
+	if err := client.Push(img, ref); err != nil {
+		return fmt.Errorf("push %s error %v", ref, err)
+	}
+	return nil
+}
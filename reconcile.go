@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+// errNothingToDo tells reconcileContainer the container is as recorded
+var errNothingToDo = errors.New("nothing to do")
+
+// reconcileContainers brings the recorded state in line with the host, after
+// a reboot or a crash of the mydocker that ran them: running containers whose
+// init is gone are marked exited, and started again by their restart policy
+func reconcileContainers() {
+	infos, err := state.List()
+	if err != nil {
+		log.Warnf("List containers error %v", err)
+		return
+	}
+	for _, info := range infos {
+		if needsReconcile(info) {
+			reconcileContainer(info.Name)
+		}
+	}
+}
+
+// needsReconcile tells if the container died without anyone noticing, or is
+// an "always" one stopped before the host rebooted
+func needsReconcile(info *container.ContainerInfo) bool {
+	if info.Status == container.RUNNING || info.Status == container.PAUSED {
+		return !container.InitAlive(info)
+	}
+	return info.Status == container.STOP && info.RestartPolicy == RestartAlways &&
+		info.BootID != "" && info.BootID != container.BootID()
+}
+
+// reconcileContainer marks a container exited once its init is gone. Only
+// the mydocker that does so under the container's lock goes on to clean up
+// its rootfs mount, or to start it again with a restart policy.
+func reconcileContainer(containerName string) {
+	var dead *container.ContainerInfo
+	var delay time.Duration
+	restart := false
+	err := state.Update(containerName, func(info *container.ContainerInfo) error {
+		if !needsReconcile(info) {
+			return errNothingToDo
+		}
+		// a stopped one is an always one, that comes back once after a reboot
+		if info.Status != container.STOP {
+			dead = info
+		}
+		info.Status = container.EXIT
+		info.Pid = ""
+		restart = info.RestartPolicy == RestartAlways || info.RestartPolicy == RestartUnlessStopped
+		if restart {
+			delay = restartDelay(info)
+			info.RestartCount++
+			info.BootID = container.BootID()
+		}
+		return nil
+	})
+	if err != nil {
+		if err != errNothingToDo {
+			log.Warnf("Update container %s info error %v", containerName, err)
+		}
+		return
+	}
+	if dead != nil {
+		container.LogEvent("die", dead)
+	}
+
+	if restart {
+		// start ends up in Run which exits, so it gets a process of its own
+		cmd := exec.Command("/proc/self/exe", "start", "--restart-delay", delay.String(), containerName)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if err := cmd.Start(); err != nil {
+			log.Errorf("Restart container %s error %v", containerName, err)
+		}
+		return
+	}
+	// a crash leaves the rootfs mounted, start mounts it again
+	if !container.Rootless {
+		if err := container.UnmountWorkSpace(dead.Volume, containerName); err != nil {
+			log.Warnf("Unmount rootfs of container %s error %v", containerName, err)
+		}
+	}
+}
+
+// restartDelay backs off a container that keeps dying right after it
+// started, from 100ms doubling up to about a minute
+func restartDelay(info *container.ContainerInfo) time.Duration {
+	started, err := parseStateTime(info.StartedAt)
+	if err == nil && time.Since(started) > 10*time.Second {
+		return 0
+	}
+	shift := info.RestartCount
+	if shift > 9 {
+		shift = 9
+	}
+	return 100 * time.Millisecond << uint(shift)
+}
+
+// startContainer runs a stopped or exited container again, on its write
+// layer and with the options it was run with and the limits update gave it.
+// A restart waits delay first, and gives up if the container was stopped or
+// started by then.
+func startContainer(containerName string, restart bool, delay time.Duration) error {
+	time.Sleep(delay)
+	info, err := state.Load(containerName)
+	if err != nil {
+		return fmt.Errorf("get container %s info error %v", containerName, err)
+	}
+	if restart && info.Status != container.EXIT {
+		return nil
+	}
+	if (info.Status == container.RUNNING || info.Status == container.PAUSED) && container.InitAlive(info) {
+		return fmt.Errorf("container %s is already running", containerName)
+	}
+	opts := &RunOptions{}
+	if err := state.ReadJSON(containerName, RunOptionsName, opts); err != nil {
+		return fmt.Errorf("container %s was run without its options recorded, it can't be started: %v", containerName, err)
+	}
+	opts.ContainerID = info.Id
+	opts.ContainerName = info.Name
+	opts.Tty = false
+	if info.Resources != nil {
+		opts.Resources = info.Resources
+	}
+	Run(opts)
+	return nil
+}
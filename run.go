@@ -5,28 +5,103 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/exec"
 
 	"strconv"
 	"strings"
 	"time"
 
+	"./cgroups"
+	"./cgroups/subsystems"
 	"./container"
+	"./image"
+	"./state"
 	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// RunOptions carries the flags of mydocker run
+type RunOptions struct {
+	Tty           bool
+	Volume        string
+	ContainerName string
+	ImageName     string
+	Config        *image.ContainerConfig  // flags overwriting the image's config
+	UserNS        *container.UserNSConfig // nil when the container shares our user namespace
+	Capabilities  []string
+	Seccomp       *container.SeccompProfile // nil runs unconfined
+	SeccompName   string                    // what --security-opt seccomp resolved to, for inspect
+
+	Privileged      bool // also leaves /proc and /sys unmasked and writable
+	NoNewPrivileges bool
+	ReadonlyRootfs  bool
+	Tmpfs           []container.Mount
+
+	Resources    *subsystems.ResourceConfig
+	CgroupDriver string             // cgroupfs or systemd
+	CgroupParent string             // cleaned by cgroups.CleanParent
+	Devices      []container.Device // --device, on top of container.DefaultDevices
+	ShmSize      string
+
+	Hostname   string // defaults to the container's ID
+	DNS        *container.DNSConfig
+	ExtraHosts []string // --add-host host:ip
+
+	RestartPolicy string // no, always or unless-stopped
+	// ContainerID is set by start, which runs a container with these options
+	// again under its ID and name and on its write layer
+	ContainerID string
+}
+
+// RunOptionsName is the file of a container's RunOptions in the state store
+const RunOptionsName = "run.json"
+
+// Restart policies
+const (
+	RestartNo            = "no"
+	RestartAlways        = "always"
+	RestartUnlessStopped = "unless-stopped"
 )
 
 // func Run(tty bool, comArray []string, res *subsystems.ResourceConfig) {
-func Run(tty bool, comArray []string, volume string, containerName string, imageName string, envSlice []string) {
+func Run(opts *RunOptions) {
+	tty, volume, containerName, imageName := opts.Tty, opts.Volume, opts.ContainerName, opts.ImageName
+	userns := opts.UserNS
 
-	containerID := randStringBytes(10)
-	if containerName == "" {
-		containerName = containerID
+	containerID := opts.ContainerID
+	if containerID == "" {
+		containerID = randStringBytes(10)
+		if containerName == "" {
+			containerName = containerID
+		}
+		// before the workspace of the container of that name is touched
+		if state.Exists(containerName) {
+			log.Errorf("Container name %s is already in use", containerName)
+			return
+		}
+	}
+	if opts.Hostname == "" {
+		opts.Hostname = containerID
+	}
+
+	// Merge the image's defaults with the flags given to run
+	imageConfig, err := container.GetImageConfig(imageName)
+	if err != nil {
+		log.Errorf("Get image %s config error %v", imageName, err)
+		return
+	}
+	config := imageConfig.Merge(opts.Config)
+	comArray := config.Args()
+	if len(comArray) == 0 {
+		log.Errorf("No command specified and image %s has no default command", imageName)
+		return
 	}
 
 	//NewParentProcess 负责构建隔离的newspace 其中包含了docker init
 	//NewParentProcess 返回构建好的命令
 
 	/* parent, writePipe := container.NewParentProcess(tty) */
-	parent, writePipe := container.NewParentProcess(tty, volume, containerName, imageName, envSlice)
+	parent, writePipe, mounts := container.NewParentProcess(tty, volume, containerName, imageName, config.Env, userns)
 
 	if parent == nil {
 		log.Errorf("[Run] new parent process error")
@@ -35,31 +110,115 @@ func Run(tty bool, comArray []string, volume string, containerName string, image
 	//运行对应的命令并等待结束
 	if err := parent.Start(); err != nil {
 		log.Error(err)
+		return
+	}
+
+	// The init process waits on the pipe, so its id maps are in place before it goes on
+	if userns != nil {
+		if err := container.WriteIDMaps(parent.Process.Pid, userns); err != nil {
+			log.Errorf("Write id maps error %v", err)
+			abortRun(parent, opts, containerName, false)
+			return
+		}
 	}
 
 	// Add the recordContainerInfo to recored the container information
-	containerName, err := recordContainerInfo(parent.Process.Pid, comArray, containerName, containerID, volume)
-	if err != nil {
+	if _, err := recordContainerInfo(parent.Process.Pid, comArray, containerName, containerID, opts, config); err != nil {
 		log.Errorf("Record container info error: %v", err)
+		if opts.ContainerID == "" && !state.Exists(containerName) {
+			abortRun(parent, opts, containerName, false)
+		} else {
+			// the name is another run's or start's now, so is the workspace
+			parent.Process.Kill()
+		}
 		return
-
 	}
+	etcMounts, err := container.WriteEtcFiles(containerName, opts.Hostname, opts.ExtraHosts, opts.DNS)
+	if err != nil {
+		log.Errorf("Write hosts and resolv.conf error %v", err)
+		abortRun(parent, opts, containerName, true)
+		return
+	}
+	mounts = append(mounts, etcMounts...)
 
-	/*
-
-		//创建cgroup manager
-		cgroupManager := cgroups.NewCgroupManager("mydocker-cgroup")
-		defer cgroupManager.Destroy()
-		cgroupManager.Set(res)
+	//创建cgroup manager, init is still waiting on the pipe so the command starts in its cgroups
+	devices := append(append([]container.Device{}, container.DefaultDevices...), opts.Devices...)
+	var cgroupManager cgroups.Manager
+	if !container.Rootless {
+		res := opts.Resources
+		if !opts.Privileged {
+			res.Devices = append([]string{}, container.DefaultDeviceRules...)
+			for _, device := range devices {
+				res.Devices = append(res.Devices, device.CgroupRule())
+			}
+		}
+		cgroupManager, err = cgroups.NewManager(opts.CgroupDriver, containerCgroupPath(containerID, opts.CgroupDriver, opts.CgroupParent))
+		if err != nil {
+			log.Errorf("Create cgroup manager error %v", err)
+			abortRun(parent, opts, containerName, true)
+			return
+		}
+		if err := cgroupManager.Set(res); err != nil {
+			log.Errorf("Set cgroup error %v", err)
+			abortRun(parent, opts, containerName, true)
+			cgroupManager.Destroy()
+			return
+		}
 		//将容器进程加入对应的各个subsystem的cgroup中
-		cgroupManager.Apply(parent.Process.Pid)
+		if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+			log.Errorf("Apply cgroup error %v", err)
+			abortRun(parent, opts, containerName, true)
+			cgroupManager.Destroy()
+			return
+		}
+	}
+
+	initConfig := &container.InitConfig{
+		ProcessConfig: container.ProcessConfig{
+			Args:            comArray,
+			Cwd:             config.WorkingDir,
+			User:            config.User,
+			Capabilities:    opts.Capabilities,
+			Seccomp:         opts.Seccomp,
+			NoNewPrivileges: opts.NoNewPrivileges,
+		},
+		Mounts: append(mounts, opts.Tmpfs...),
+		Reexec: userns != nil && userns.Helper,
 
-	*/
+		ReadonlyRootfs: opts.ReadonlyRootfs,
+		Privileged:     opts.Privileged,
 
-	sendInitCommand(comArray, writePipe)
+		Devices:     devices,
+		BindDevices: userns != nil,
+		ShmSize:     opts.ShmSize,
+		Hostname:    opts.Hostname,
+	}
+	if !opts.Privileged {
+		initConfig.MaskedPaths = container.DefaultMaskedPaths
+		initConfig.ReadonlyPaths = container.DefaultReadonlyPaths
+	}
+	// watch for OOM before the command can use any memory
+	if cgroupManager != nil {
+		if err := startContainerMonitor(containerName); err != nil {
+			log.Warnf("Start monitor of container %s error %v", containerName, err)
+		}
+	}
+	sendInitCommand(initConfig, writePipe)
+	info, err := state.Load(containerName)
+	if err == nil {
+		container.LogEvent("start", info)
+	}
 
 	if tty {
 		parent.Wait()
+		if info != nil {
+			container.LogEvent("die", info)
+		}
+		if cgroupManager != nil {
+			if err := cgroupManager.Destroy(); err != nil {
+				log.Warnf("Destroy cgroup of container %s error %v", containerName, err)
+			}
+		}
 		deleteContainerInfo(containerName)
 		container.DeleteWorkSpace(volume, containerName)
 	}
@@ -75,17 +234,164 @@ func Run(tty bool, comArray []string, volume string, containerName string, image
 	os.Exit(-1)
 }
 
+// abortRun undoes a run whose init is started but the container couldn't be
+// set up. The init is killed; a new container's state and workspace go, a
+// container being started again is left exited with its write layer.
+func abortRun(parent *exec.Cmd, opts *RunOptions, containerName string, recorded bool) {
+	parent.Process.Kill()
+	parent.Wait()
+	if opts.ContainerID == "" {
+		// the directory may hold the log of a detached container only
+		if err := state.Remove(containerName, nil); err != nil && err != state.ErrNotExist {
+			log.Errorf("Remove container %s error %v", containerName, err)
+		}
+		container.DeleteWorkSpace(opts.Volume, containerName)
+		return
+	}
+	if recorded {
+		err := state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+			containerInfo.Status = container.EXIT
+			containerInfo.Pid = ""
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Mark container %s exited error %v", containerName, err)
+		}
+	}
+	if !container.Rootless {
+		container.UnmountWorkSpace(opts.Volume, containerName)
+	}
+}
+
+// containerCgroupPath is relative to the mount point of each subsystem,
+// systemd puts the container's scope in the parent slice
+func containerCgroupPath(containerID string, driver string, parent string) string {
+	if driver == cgroups.SystemdDriver {
+		return cgroups.SystemdScopePath(parent, "mydocker-"+containerID+".scope")
+	}
+	return parent + "/" + containerID
+}
+
+// containerCgroupManager returns the manager of the driver the container was run with
+func containerCgroupManager(containerInfo *container.ContainerInfo) (cgroups.Manager, error) {
+	if containerInfo.CgroupPath == "" {
+		return nil, fmt.Errorf("container %s has no cgroup", containerInfo.Name)
+	}
+	return cgroups.NewManager(containerInfo.CgroupDriver, containerInfo.CgroupPath)
+}
+
+// resourcesFromFlags collects the cgroup limits of run, sizes and rates are checked here
+func resourcesFromFlags(context *cli.Context) (*subsystems.ResourceConfig, error) {
+	res := &subsystems.ResourceConfig{
+		MemoryLimit:       context.String("m"),
+		MemorySwap:        context.String("memory-swap"),
+		MemoryReservation: context.String("memory-reservation"),
+		OomKillDisable:    context.Bool("oom-kill-disable"),
+		CpuShare:          context.String("cpushare"),
+		CpuSet:            context.String("cpuset"),
+		CpuPeriod:         context.String("cpu-period"),
+		CpuQuota:          context.String("cpu-quota"),
+		PidsLimit:         context.String("pids-limit"),
+		BlkioWeight:       context.String("blkio-weight"),
+	}
+	if cpus := context.String("cpus"); cpus != "" {
+		if res.CpuPeriod != "" || res.CpuQuota != "" {
+			return nil, fmt.Errorf("--cpus conflicts with --cpu-period and --cpu-quota, set one or the other")
+		}
+		period, quota, err := subsystems.CpusToQuota(cpus)
+		if err != nil {
+			return nil, err
+		}
+		res.CpuPeriod, res.CpuQuota = period, quota
+	}
+	for _, throttle := range []struct {
+		flag  string
+		bps   bool
+		rules *[]string
+	}{
+		{"device-read-bps", true, &res.BlkioReadBps},
+		{"device-write-bps", true, &res.BlkioWriteBps},
+		{"device-read-iops", false, &res.BlkioReadIops},
+		{"device-write-iops", false, &res.BlkioWriteIops},
+	} {
+		for _, spec := range context.StringSlice(throttle.flag) {
+			rule, err := subsystems.ParseThrottleDevice(spec, throttle.bps)
+			if err != nil {
+				return nil, fmt.Errorf("--%s: %v", throttle.flag, err)
+			}
+			*throttle.rules = append(*throttle.rules, rule)
+		}
+	}
+	for _, spec := range context.StringSlice("hugetlb-limit") {
+		limit, err := subsystems.ParseHugetlbLimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		res.HugetlbLimits = append(res.HugetlbLimits, limit)
+	}
+	if res.OomKillDisable && res.MemoryLimit == "" {
+		log.Warnf("Disabling the OOM killer without a memory limit may hang the host")
+	}
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// userNSFromFlags decides the user namespace of the container, nil for none
+func userNSFromFlags(context *cli.Context) (*container.UserNSConfig, error) {
+	remap := context.String("userns-remap")
+	uidMaps, gidMaps := context.StringSlice("uidmap"), context.StringSlice("gidmap")
+	if container.Rootless {
+		if remap != "" || len(uidMaps) > 0 || len(gidMaps) > 0 {
+			return nil, fmt.Errorf("rootless mode maps the calling user, --userns-remap and id maps need root")
+		}
+		return container.RootlessConfig(), nil
+	}
+	if remap != "" {
+		return container.RemapConfig(remap)
+	}
+	if len(uidMaps) == 0 {
+		if len(gidMaps) > 0 {
+			return nil, fmt.Errorf("--gidmap needs --uidmap")
+		}
+		return nil, nil
+	}
+	if len(gidMaps) == 0 {
+		gidMaps = uidMaps
+	}
+	userns := &container.UserNSConfig{}
+	for _, spec := range uidMaps {
+		idMap, err := container.ParseIDMap(spec)
+		if err != nil {
+			return nil, err
+		}
+		userns.UidMap = append(userns.UidMap, idMap)
+	}
+	for _, spec := range gidMaps {
+		idMap, err := container.ParseIDMap(spec)
+		if err != nil {
+			return nil, err
+		}
+		userns.GidMap = append(userns.GidMap, idMap)
+	}
+	return userns, nil
+}
+
 func deleteContainerInfo(containerId string) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerId)
-	if err := os.RemoveAll(dirURL); err != nil {
-		log.Errorf("Remove dir %s error %v ", dirURL, err)
+	if err := state.Remove(containerId, nil); err != nil {
+		log.Errorf("Remove container %s error %v ", containerId, err)
 	}
 }
-func sendInitCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ")
+func sendInitCommand(initConfig *container.InitConfig, writePipe *os.File) {
+	defer writePipe.Close()
+	command, err := json.Marshal(initConfig)
+	if err != nil {
+		log.Errorf("Marshal init config error %v", err)
+		return
+	}
 	//log.Infof("[sendInitCommand] command all is %s", command)
-	writePipe.WriteString(command)
-	writePipe.Close()
+	writePipe.Write(command)
 }
 
 // Generate the container's ID
@@ -99,14 +405,40 @@ func randStringBytes(n int) string {
 	return string(b)
 }
 
-func recordContainerInfo(containerPID int, commandArray []string, containerName, id, volume string) (string, error) {
+func recordContainerInfo(containerPID int, commandArray []string, containerName, id string, opts *RunOptions, config *image.ContainerConfig) (string, error) {
 	// 1. Generate container's ID
 	createTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(commandArray, "")
+	command := strings.Join(commandArray, " ")
 
 	if containerName == "" {
 		containerName = id
 	}
+	startTime, err := container.ProcessStartTime(containerPID)
+	if err != nil {
+		return "", err
+	}
+
+	// start runs a recorded container again
+	if opts.ContainerID != "" {
+		err := state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+			// another start got there first
+			if container.InitAlive(containerInfo) {
+				return fmt.Errorf("container %s is already running", containerName)
+			}
+			containerInfo.Pid = strconv.Itoa(containerPID)
+			containerInfo.Status = container.RUNNING
+			containerInfo.PidStartTime = startTime
+			containerInfo.BootID = container.BootID()
+			containerInfo.StartedAt = createTime
+			containerInfo.OOMKilled = false
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Record containerInfo failed : %v", err)
+			return "", err
+		}
+		return containerName, nil
+	}
 
 	// 2. Create the containerInfo struct
 	containerInfo := &container.ContainerInfo{
@@ -116,40 +448,46 @@ func recordContainerInfo(containerPID int, commandArray []string, containerName,
 		CreatedTime: createTime,
 		Status:      container.RUNNING,
 		Id:          id,
-		Volume:      volume,
-	}
+		Volume:      opts.Volume,
+		Image:       opts.ImageName,
+		Hostname:    opts.Hostname,
+		Config:      config,
+		Labels:      config.Labels,
 
-	// 3. Json to string
-	jsonBytes, err := json.Marshal(containerInfo)
-	if err != nil {
-		log.Errorf("Record containerInfo failed : %v", err)
-		return "", err
-	}
-	jsonStr := string(jsonBytes)
+		Capabilities: opts.Capabilities,
+		Seccomp:      opts.SeccompName,
 
-	// 4. Format and generate the file path
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	// if the path doesn't exist, we create them.
-	if err := os.MkdirAll(dirURL, 0622); err != nil {
-		log.Errorf("Mkdir error: %v , dir: %s", err, dirURL)
-		return "", err
+		NoNewPrivileges: opts.NoNewPrivileges,
+		ReadonlyRootfs:  opts.ReadonlyRootfs,
+
+		PidStartTime:  startTime,
+		BootID:        container.BootID(),
+		StartedAt:     createTime,
+		RestartPolicy: opts.RestartPolicy,
+	}
+	if !container.Rootless {
+		containerInfo.CgroupPath = containerCgroupPath(id, opts.CgroupDriver, opts.CgroupParent)
+		containerInfo.CgroupDriver = opts.CgroupDriver
+		containerInfo.CgroupParent = opts.CgroupParent
+		containerInfo.Resources = opts.Resources
 	}
-	fileName := dirURL + "/" + container.ConfigName
-	//log.Infof("config")
 
-	// 5. Create the final config file
-	file, err := os.Create(fileName)
-	defer file.Close()
-	if err != nil {
-		log.Errorf("Create file: %s ; error: %v", fileName, err)
+	// 3. Write it to the state store
+	if err := state.Create(containerInfo); err != nil {
+		log.Errorf("Record containerInfo failed : %v", err)
 		return "", err
 	}
-	log.Infof("Configure File: %s", fileName)
-
-	// 6. Write the information to Configure file
-	if _, err := file.WriteString(jsonStr); err != nil {
-		log.Errorf("File Write string Error: %v", err)
+	if err := state.WriteJSON(containerName, RunOptionsName, opts); err != nil {
+		log.Errorf("Record run options failed : %v", err)
+		deleteContainerInfo(containerName)
 		return "", err
 	}
+	if opts.Seccomp != nil {
+		if err := container.SaveSeccompProfile(containerName, opts.Seccomp); err != nil {
+			log.Errorf("Save seccomp profile error %v", err)
+			deleteContainerInfo(containerName)
+			return "", err
+		}
+	}
 	return containerName, nil
 }
@@ -0,0 +1,164 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"../container"
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaVersion is the version of the config.json this mydocker writes. Files
+// from before the store have none, that is version 0.
+const SchemaVersion = 2
+
+// migrations[i] takes a config.json from version i to i+1, on the decoded
+// JSON so it can handle fields ContainerInfo no longer has
+var migrations = []func(doc map[string]interface{}) error{
+	// 0 -> 1: the cgroup driver and parent are always recorded, before they
+	// were all cgroupfs in the parent the path is in
+	func(doc map[string]interface{}) error {
+		cgroupPath, _ := doc["cgroupPath"].(string)
+		if cgroupPath == "" {
+			return nil
+		}
+		if driver, _ := doc["cgroupDriver"].(string); driver == "" {
+			doc["cgroupDriver"] = "cgroupfs"
+		}
+		if parent, _ := doc["cgroupParent"].(string); parent == "" {
+			doc["cgroupParent"] = path.Dir(cgroupPath)
+		}
+		return nil
+	},
+	// 1 -> 2: labels are recorded with the container, before there were only
+	// the image's, in its config
+	func(doc map[string]interface{}) error {
+		if _, ok := doc["labels"]; ok {
+			return nil
+		}
+		config, _ := doc["config"].(map[string]interface{})
+		if labels, _ := config["Labels"].(map[string]interface{}); len(labels) > 0 {
+			doc["labels"] = labels
+		}
+		return nil
+	},
+}
+
+// migrate brings a config.json up to SchemaVersion
+func migrate(content []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("unmarshal state error %v", err)
+	}
+	version := 0
+	if v, ok := doc["schemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("state is schema version %d, this mydocker knows up to %d", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return content, nil
+	}
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version](doc); err != nil {
+			return nil, fmt.Errorf("migrate state from version %d error %v", version, err)
+		}
+	}
+	doc["schemaVersion"] = SchemaVersion
+	return json.Marshal(doc)
+}
+
+// MoveFrom moves the containers kept under location, an old
+// container.DefaultInfoLocation, into the store. A name the store has already
+// stays where it is.
+func MoveFrom(location string) error {
+	oldRoot := path.Dir(path.Clean(fmt.Sprintf(location, "x")))
+	newRoot := path.Dir(path.Clean(Dir("x")))
+	if oldRoot == newRoot {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(oldRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(newRoot, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			if name == container.EventsLogName {
+				moveEventsLog(path.Join(oldRoot, name), path.Join(newRoot, name))
+			}
+			continue
+		}
+		if _, err := os.Stat(path.Join(oldRoot, name, container.ConfigName)); err != nil {
+			continue
+		}
+		if Exists(name) {
+			log.Warnf("Container %s is in %s and %s, keeping the one in %s", name, oldRoot, newRoot, newRoot)
+			continue
+		}
+		if err := moveDir(path.Join(oldRoot, name), Dir(name)); err != nil {
+			return fmt.Errorf("move container %s from %s error %v", name, oldRoot, err)
+		}
+		log.Infof("Moved container %s from %s to %s", name, oldRoot, newRoot)
+	}
+	// only removed once empty, what is left there is not ours
+	os.Remove(oldRoot)
+	return nil
+}
+
+// moveDir moves a container's directory, holding its lock like a writer.
+// The old location is usually a tmpfs, then it is copied.
+func moveDir(oldDir string, newDir string) error {
+	lock, err := os.Open(oldDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	err = os.Rename(oldDir, path.Clean(newDir))
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(container.WriteTar(writer, oldDir))
+	}()
+	err = container.ExtractTar(reader, newDir)
+	reader.Close()
+	if err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// moveEventsLog keeps the old events log unless there is a new one already
+func moveEventsLog(oldFile string, newFile string) {
+	if _, err := os.Stat(newFile); err == nil {
+		return
+	}
+	content, err := ioutil.ReadFile(oldFile)
+	if err != nil {
+		log.Warnf("Read events log %s error %v", oldFile, err)
+		return
+	}
+	if err := ioutil.WriteFile(newFile, content, 0644); err != nil {
+		log.Warnf("Write events log %s error %v", newFile, err)
+		return
+	}
+	os.Remove(oldFile)
+}
@@ -0,0 +1,251 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"../container"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Container state store
+
+container.DefaultInfoLocation/
+└── <name>/
+    ├── config.json     the ContainerInfo, replaced as a whole on each write
+    ├── run.json        what it was run with, start runs it again with that
+    └── ...             logs, exec sessions and the like of the container
+
+Readers take a shared flock on the container's directory, writers an
+exclusive one, so stop, rm and the monitor don't overwrite each other. A
+write goes to a temporary file that is synced and renamed over config.json,
+a crash leaves the old or the new state, never half of one.
+*/
+
+// ErrNotExist is returned for a container that has no state
+var ErrNotExist = fmt.Errorf("no such container")
+
+// Dir is the container's directory in the store
+func Dir(name string) string {
+	return fmt.Sprintf(container.DefaultInfoLocation, name)
+}
+
+func configPath(name string) string {
+	return path.Join(Dir(name), container.ConfigName)
+}
+
+// Exists tells if a container has state under name
+func Exists(name string) bool {
+	_, err := os.Stat(configPath(name))
+	return err == nil
+}
+
+// Load reads the state of a container, migrated to the current schema
+func Load(name string) (*container.ContainerInfo, error) {
+	lock, err := lockDir(name, syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	return read(name)
+}
+
+// List loads every container, the ones that fail to load are logged and skipped
+func List() ([]*container.ContainerInfo, error) {
+	root := Dir("")
+	entries, err := ioutil.ReadDir(root[:len(root)-1])
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var infos []*container.ContainerInfo
+	for _, entry := range entries {
+		// the events log lives next to the containers
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := Load(entry.Name())
+		if err != nil {
+			// run makes the directory for the log before it records the container
+			if err != ErrNotExist {
+				log.Warnf("Load container %s error %v", entry.Name(), err)
+			}
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Create records a new container, it fails if the name is taken
+func Create(info *container.ContainerInfo) error {
+	// the directory may be there already with the container's log
+	if err := os.MkdirAll(Dir(info.Name), 0755); err != nil {
+		return err
+	}
+	lock, err := lockDir(info.Name, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if Exists(info.Name) {
+		return fmt.Errorf("container name %s is already in use", info.Name)
+	}
+	return write(info)
+}
+
+// Update loads a container, lets change modify it and writes it back, all
+// under the container's lock. Nothing is written when change fails.
+func Update(name string, change func(info *container.ContainerInfo) error) error {
+	lock, err := lockDir(name, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	info, err := read(name)
+	if err != nil {
+		return err
+	}
+	if err := change(info); err != nil {
+		return err
+	}
+	return write(info)
+}
+
+// Remove deletes the container's directory once check, if not nil, accepts
+// its state. A writer waiting for the lock finds the container gone.
+func Remove(name string, check func(info *container.ContainerInfo) error) error {
+	lock, err := lockDir(name, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if check != nil {
+		info, err := read(name)
+		if err != nil {
+			return err
+		}
+		if err := check(info); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(Dir(name))
+}
+
+// lockDir flocks the container's directory, closing the file unlocks it
+func lockDir(name string, how int) (*os.File, error) {
+	dir, err := os.Open(Dir(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	if err := syscall.Flock(int(dir.Fd()), how); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("lock container %s error %v", name, err)
+	}
+	return dir, nil
+}
+
+func read(name string) (*container.ContainerInfo, error) {
+	content, err := ioutil.ReadFile(configPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	content, err = migrate(content)
+	if err != nil {
+		return nil, fmt.Errorf("container %s: %v", name, err)
+	}
+	var info container.ContainerInfo
+	if err := json.Unmarshal(content, &info); err != nil {
+		return nil, fmt.Errorf("container %s: unmarshal state error %v", name, err)
+	}
+	return &info, nil
+}
+
+// write replaces config.json with info, the caller holds the exclusive lock
+func write(info *container.ContainerInfo) error {
+	info.SchemaVersion = SchemaVersion
+	return writeJSON(Dir(info.Name), container.ConfigName, info)
+}
+
+// WriteJSON stores v as file in the container's directory, replaced
+// atomically like its state. The container must exist.
+func WriteJSON(name string, file string, v interface{}) error {
+	lock, err := lockDir(name, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	return writeJSON(Dir(name), file, v)
+}
+
+// ReadJSON reads a file WriteJSON stored into v
+func ReadJSON(name string, file string, v interface{}) error {
+	lock, err := lockDir(name, syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	content, err := ioutil.ReadFile(path.Join(Dir(name), file))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func writeJSON(dir string, file string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-"+file)
+	if err != nil {
+		return err
+	}
+	if err := writeSynced(tmp, content); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path.Join(dir, file)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// the rename is only durable once the directory is
+	return syncDir(dir)
+}
+
+// writeSynced writes content to f and closes it once it is on disk
+func writeSynced(f *os.File, content []byte) error {
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"./cgroups"
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+// containerStats is one sample of mydocker stats
+type containerStats struct {
+	Id          string  `json:"id"`
+	Name        string  `json:"name"`
+	CpuPercent  float64 `json:"cpuPercent"` // of one cpu, like docker it goes past 100 on several
+	MemoryUsage uint64  `json:"memoryUsage"`
+	MemoryLimit uint64  `json:"memoryLimit"`
+	Pids        int     `json:"pids"`
+	BlockRead   uint64  `json:"blockRead"`
+	BlockWrite  uint64  `json:"blockWrite"`
+	NetRx       uint64  `json:"netRx"`
+	NetTx       uint64  `json:"netTx"`
+
+	cpuUsage uint64 // nanoseconds
+	sampled  time.Time
+}
+
+// parentStats adds up the containers of a cgroup parent
+type parentStats struct {
+	Parent      string  `json:"parent"`
+	Containers  int     `json:"containers"`
+	CpuPercent  float64 `json:"cpuPercent"`
+	MemoryUsage uint64  `json:"memoryUsage"` // of the parent cgroup, with what is charged to it directly
+	MemoryLimit uint64  `json:"memoryLimit"` // the parent's own, the aggregate limit of its containers
+	Pids        int     `json:"pids"`
+	BlockRead   uint64  `json:"blockRead"`
+	BlockWrite  uint64  `json:"blockWrite"`
+	NetRx       uint64  `json:"netRx"`
+	NetTx       uint64  `json:"netTx"`
+}
+
+const statsInterval = time.Second
+
+// StatsContainers prints the resource usage of the named containers, or of all
+// the running ones, every second. noStream prints a single sample, byParent
+// one line per cgroup parent instead of one per container.
+func StatsContainers(names []string, noStream bool, format string, byParent bool) error {
+	if format != "" && format != "json" && format != "table" {
+		return fmt.Errorf("unknown format %q, it must be table or json", format)
+	}
+	previous := map[string]*containerStats{}
+	for {
+		infos, err := statsTargets(names)
+		if err != nil {
+			return err
+		}
+		// cpu usage is counted between two samples, new containers get a first one now
+		fresh := false
+		for _, info := range infos {
+			if _, ok := previous[info.Id]; ok {
+				continue
+			}
+			if sample, err := sampleContainer(info); err == nil {
+				previous[info.Id] = sample
+				fresh = true
+			}
+		}
+		if fresh {
+			time.Sleep(statsInterval / 2)
+		}
+
+		var samples []*containerStats
+		for _, info := range infos {
+			sample, err := sampleContainer(info)
+			if err != nil {
+				log.Warnf("Get stats of container %s error %v", info.Name, err)
+				continue
+			}
+			if last, ok := previous[info.Id]; ok {
+				sample.CpuPercent = cpuPercent(last, sample)
+			}
+			previous[info.Id] = sample
+			samples = append(samples, sample)
+		}
+
+		// json prints either kind of row the same way
+		var rows []interface{}
+		var parents []*parentStats
+		if byParent {
+			parents = aggregateByParent(infos, samples)
+			for _, parent := range parents {
+				rows = append(rows, parent)
+			}
+		} else {
+			for _, sample := range samples {
+				rows = append(rows, sample)
+			}
+		}
+
+		if format == "json" {
+			for _, row := range rows {
+				content, err := json.Marshal(row)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(os.Stdout, string(content))
+			}
+		} else {
+			if !noStream {
+				// redraw in place like top
+				fmt.Fprint(os.Stdout, "\033[2J\033[H")
+			}
+			if byParent {
+				printParentStatsTable(parents)
+			} else {
+				printStatsTable(samples)
+			}
+		}
+		if noStream {
+			return nil
+		}
+		time.Sleep(statsInterval)
+	}
+}
+
+// statsTargets is the named containers, which must be running, or all the running ones.
+// Paused ones count as running.
+func statsTargets(names []string) ([]*container.ContainerInfo, error) {
+	var infos []*container.ContainerInfo
+	if len(names) == 0 {
+		all, err := state.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range all {
+			if info.Status == container.RUNNING || info.Status == container.PAUSED {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	}
+	for _, name := range names {
+		info, err := state.Load(name)
+		if err != nil {
+			return nil, fmt.Errorf("no such container %s", name)
+		}
+		if info.Status != container.RUNNING && info.Status != container.PAUSED {
+			return nil, fmt.Errorf("container %s is not running", name)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// sampleContainer reads cpu, memory and block I/O from the container's cgroup
+// when it has one. Rootless containers add up their processes instead, which
+// misses what exited processes used.
+func sampleContainer(info *container.ContainerInfo) (*containerStats, error) {
+	processes, err := container.NamespaceProcesses(info.Pid)
+	if err != nil {
+		return nil, err
+	}
+	sample := &containerStats{Id: info.Id, Name: info.Name, Pids: len(processes), sampled: time.Now()}
+	for _, process := range processes {
+		sample.cpuUsage += process.CpuTicks * uint64(time.Second) / container.ClockTicks
+		sample.MemoryUsage += process.RssBytes
+		sample.BlockRead += process.ReadBytes
+		sample.BlockWrite += process.WriteBytes
+	}
+
+	hostMemory, err := container.HostMemory()
+	if err != nil {
+		return nil, err
+	}
+	sample.MemoryLimit = hostMemory
+	if info.CgroupPath != "" {
+		if manager, err := containerCgroupManager(info); err != nil {
+			return nil, err
+		} else {
+			if usage, limit, err := manager.MemoryUsage(); err == nil {
+				sample.MemoryUsage = usage
+				// no limit reads as a huge number
+				if limit < hostMemory {
+					sample.MemoryLimit = limit
+				}
+			}
+			if usage, err := manager.CpuUsage(); err == nil {
+				sample.cpuUsage = usage
+			}
+			if read, write, err := manager.IoUsage(); err == nil {
+				sample.BlockRead, sample.BlockWrite = read, write
+			}
+		}
+	}
+	if sample.NetRx, sample.NetTx, err = container.NetworkStats(info.Pid); err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// aggregateByParent sums the samples of containers with a cgroup per parent.
+// Memory is read from the parent cgroup, which holds the aggregate limit.
+func aggregateByParent(infos []*container.ContainerInfo, samples []*containerStats) []*parentStats {
+	parentPaths := map[string]string{}
+	parents := map[string]*parentStats{}
+	for _, info := range infos {
+		if info.CgroupPath == "" {
+			continue
+		}
+		name := info.CgroupParent
+		parentPaths[info.Id] = name
+		if _, ok := parents[name]; ok {
+			continue
+		}
+		parent := &parentStats{Parent: name}
+		if usage, limit, err := cgroups.NewCgroupManager(path.Dir(info.CgroupPath)).MemoryUsage(); err == nil {
+			parent.MemoryUsage, parent.MemoryLimit = usage, limit
+		}
+		if hostMemory, err := container.HostMemory(); err == nil && (parent.MemoryLimit == 0 || parent.MemoryLimit > hostMemory) {
+			parent.MemoryLimit = hostMemory
+		}
+		parents[name] = parent
+	}
+	for _, sample := range samples {
+		parent, ok := parents[parentPaths[sample.Id]]
+		if !ok {
+			continue
+		}
+		parent.Containers++
+		parent.CpuPercent += sample.CpuPercent
+		parent.Pids += sample.Pids
+		parent.BlockRead += sample.BlockRead
+		parent.BlockWrite += sample.BlockWrite
+		parent.NetRx += sample.NetRx
+		parent.NetTx += sample.NetTx
+	}
+	var result []*parentStats
+	for _, parent := range parents {
+		if parent.Containers > 0 {
+			result = append(result, parent)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Parent < result[j].Parent
+	})
+	return result
+}
+
+func cpuPercent(last *containerStats, sample *containerStats) float64 {
+	elapsed := sample.sampled.Sub(last.sampled).Seconds()
+	if elapsed <= 0 || sample.cpuUsage < last.cpuUsage {
+		return 0
+	}
+	return float64(sample.cpuUsage-last.cpuUsage) / float64(time.Second) / elapsed * 100
+}
+
+func printStatsTable(samples []*containerStats) {
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tNAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\tPIDS\n")
+	for _, item := range samples {
+		memPercent := 0.0
+		if item.MemoryLimit > 0 {
+			memPercent = float64(item.MemoryUsage) / float64(item.MemoryLimit) * 100
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2f%%\t%s / %s\t%.2f%%\t%s / %s\t%s / %s\t%d\n",
+			item.Id,
+			item.Name,
+			item.CpuPercent,
+			humanSize(item.MemoryUsage), humanSize(item.MemoryLimit),
+			memPercent,
+			humanSize(item.NetRx), humanSize(item.NetTx),
+			humanSize(item.BlockRead), humanSize(item.BlockWrite),
+			item.Pids)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+}
+
+func printParentStatsTable(parents []*parentStats) {
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "PARENT\tCONTAINERS\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\tPIDS\n")
+	for _, item := range parents {
+		memPercent := 0.0
+		if item.MemoryLimit > 0 {
+			memPercent = float64(item.MemoryUsage) / float64(item.MemoryLimit) * 100
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%s / %s\t%.2f%%\t%s / %s\t%s / %s\t%d\n",
+			item.Parent,
+			item.Containers,
+			item.CpuPercent,
+			humanSize(item.MemoryUsage), humanSize(item.MemoryLimit),
+			memPercent,
+			humanSize(item.NetRx), humanSize(item.NetTx),
+			humanSize(item.BlockRead), humanSize(item.BlockWrite),
+			item.Pids)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+}
+
+// humanSize prints bytes in binary units, 1.5MiB
+func humanSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(fmt.Sprintf("%.2f", value), "0"), ".0") + units[i]
+}
@@ -1,92 +1,154 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strconv"
 	"syscall"
+	"time"
 
+	"./cgroups/subsystems"
 	"./container"
+	"./state"
 	log "github.com/sirupsen/logrus"
 )
 
+// stopTimeout is how long stop waits for a container to exit on SIGTERM
+// before it kills it, like docker stop
+const stopTimeout = 10 * time.Second
+
 func stopContainer(containerName string) {
-	pid, err := getContainerPidByName(containerName)
-	if err != nil {
-		log.Errorf("[ExecContainer] Get Name: %s , error: %v", containerName, err)
-		return
-	}
+	var stopped *container.ContainerInfo
+	err := state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+		// an exited one may be waiting to be restarted, stopping it cancels that
+		if containerInfo.Status == container.EXIT && containerInfo.RestartPolicy != "" && containerInfo.RestartPolicy != RestartNo {
+			containerInfo.Status = container.STOP
+			stopped = containerInfo
+			return nil
+		}
+		if containerInfo.Status != container.RUNNING && containerInfo.Status != container.PAUSED {
+			return fmt.Errorf("container is not running")
+		}
+		pidInt, err := strconv.Atoi(containerInfo.Pid)
+		if err != nil {
+			return fmt.Errorf("convert pid to int error: %v", err)
+		}
 
-	pidInt, err := strconv.Atoi(pid)
-	if err != nil {
-		log.Error("Convert pid to int error: %v", err)
-		return
-	}
+		// Sent SIGTERM to target process ( Same like kill <pid> ), one that is gone already is stopped.
+		// After a reboot the pid may be some other process's.
+		if container.InitAlive(containerInfo) {
+			if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+				return err
+			}
+		}
 
-	// Sent SIGTERM to target process ( Same like kill <pid> )
-	if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil {
-		log.Errorf("Stop container: %s ; error: %v", containerName, err)
-		return
-	}
+		// a frozen init only sees the SIGTERM once thawed
+		if containerInfo.Status == container.PAUSED {
+			cgroupManager, err := containerCgroupManager(containerInfo)
+			if err == nil {
+				err = cgroupManager.Freeze(subsystems.Thawed)
+			}
+			if err != nil {
+				log.Errorf("Thaw container %s error %v", containerName, err)
+			}
+		}
 
-	// Get containerInfo OBJ
-	containerInfo, err := getContainerInfoByName(containerName)
+		// the init is pid 1 of its namespace, a signal it has no handler for does nothing
+		if !waitInitExit(containerInfo, stopTimeout) {
+			log.Warnf("Container %s did not exit in %v, killing it", containerName, stopTimeout)
+			if err := syscall.Kill(pidInt, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return err
+			}
+			// the rest of its pid namespace dies with it
+			if !waitInitExit(containerInfo, stopTimeout) {
+				return fmt.Errorf("container init %d did not die", pidInt)
+			}
+		}
+
+		// Change the container's Status
+		containerInfo.Status = container.STOP
+		containerInfo.Pid = ""
+		stopped = containerInfo
+		return nil
+	})
 	if err != nil {
-		log.Errorf("getContainerInfoByName: %s ; error: %v", containerName, err)
+		log.Errorf("Stop container: %s ; error: %v", containerName, err)
 		return
 	}
+	container.LogEvent("stop", stopped)
+}
 
-	// Change the container's Status
-	containerInfo.Status = container.STOP
-	containerInfo.Pid = ""
-
-	// Write the new info to configure file
-	newContentBytes, err := json.Marshal(containerInfo)
-	if err != nil {
-		log.Errorf("Seriliaze the newInfo failed: %v", err)
+// removeContainers removes the named containers and the stopped ones the
+// filters match, it goes on past the ones that fail
+func removeContainers(names []string, filterSpecs []string) error {
+	if len(filterSpecs) > 0 {
+		matched, err := stoppedContainers(filterSpecs)
+		if err != nil {
+			return err
+		}
+		named := map[string]bool{}
+		for _, name := range names {
+			named[name] = true
+		}
+		for _, info := range matched {
+			if !named[info.Name] {
+				names = append(names, info.Name)
+			}
+		}
+	}
+	failed := 0
+	for _, containerName := range names {
+		if err := removeContainer(containerName); err != nil {
+			log.Errorf("Remove container %s error %v", containerName, err)
+			failed++
+		}
 	}
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	if err := ioutil.WriteFile(configFilePath, newContentBytes, 0622); err != nil {
-		log.Errorf("Write file %s error", configFilePath, err)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d containers could not be removed", failed, len(names))
 	}
+	return nil
 }
 
-func getContainerInfoByName(containerName string) (*container.ContainerInfo, error) {
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	contentBytes, err := ioutil.ReadFile(configFilePath)
-	if err != nil {
-		log.Errorf("Read file %s error %v", configFilePath, err)
-		return nil, err
-	}
-	var containerInfo container.ContainerInfo
-	if err := json.Unmarshal(contentBytes, &containerInfo); err != nil {
-		log.Errorf("GetContainerInfoByName unmarshal error %v", err)
-		return nil, err
+// waitInitExit waits up to timeout for the container's init to be gone
+func waitInitExit(info *container.ContainerInfo, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for container.InitAlive(info) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	return &containerInfo, nil
+	return true
 }
 
-func removeContainer(containerName string) {
-	containerInfo, err := getContainerInfoByName(containerName)
+// removeContainer tears the container down before its state goes: the
+// processes left in its cgroup first, then the rootfs they may still use. A
+// container whose teardown failed keeps its state, rm can be run again.
+func removeContainer(containerName string) error {
+	var containerInfo *container.ContainerInfo
+	err := state.Remove(containerName, func(info *container.ContainerInfo) error {
+		// Ensure container is stopped, or exited on its own
+		if info.Status != container.STOP && info.Status != container.EXIT {
+			return fmt.Errorf("couldn't remove running container")
+		}
+		if info.CgroupPath != "" {
+			cgroupManager, err := containerCgroupManager(info)
+			if err != nil {
+				return err
+			}
+			// kills what is left in it
+			if err := cgroupManager.Destroy(); err != nil {
+				return fmt.Errorf("destroy cgroup error %v", err)
+			}
+		}
+		if err := container.DeleteWorkSpace(info.Volume, containerName); err != nil {
+			return fmt.Errorf("delete workspace error %v", err)
+		}
+		containerInfo = info
+		return nil
+	})
 	if err != nil {
-		log.Errorf("Get container %s info error %v", containerName, err)
-		return
+		return err
 	}
-
-	// Ensure container is stopped
-	if containerInfo.Status != container.STOP {
-		log.Errorf("Couldn't remove running container")
-		return
-	}
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	if err := os.RemoveAll(dirURL); err != nil {
-		log.Errorf("Remove file %s error %v", dirURL, err)
-		return
-	}
-
-	container.DeleteWorkSpace(containerInfo.Volume, containerName)
+	container.LogEvent("destroy", containerInfo)
+	return nil
 }
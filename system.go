@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"./cgroups"
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	containerIDPattern = regexp.MustCompile(`^[a-z0-9]{10}$`)
+	scopePattern       = regexp.MustCompile(`^mydocker-[a-z0-9]{10}\.scope$`)
+)
+
+// leftoverCgroup is a container cgroup that should not be there, or not hold processes
+type leftoverCgroup struct {
+	Path      string
+	Driver    string
+	Container string // empty when no container has it
+	Pids      []int
+	Problem   string
+}
+
+// checkCgroups looks for the cgroups of removed containers and for processes
+// left in the cgroups of stopped ones, in every hierarchy. clean removes the
+// first and kills the second.
+func checkCgroups(clean bool) error {
+	infos, err := state.List()
+	if err != nil {
+		return err
+	}
+	byPath := map[string]*container.ContainerInfo{}
+	for _, info := range infos {
+		if info.CgroupPath != "" {
+			byPath[info.CgroupPath] = info
+		}
+	}
+
+	drivers, err := findContainerCgroups()
+	if err != nil {
+		return err
+	}
+	var leftovers []*leftoverCgroup
+	for cgroupPath, driver := range drivers {
+		pids, err := (&cgroups.CgroupManager{Path: cgroupPath}).Pids()
+		if err != nil {
+			log.Warnf("Read processes of cgroup %s error %v", cgroupPath, err)
+		}
+		leftover := &leftoverCgroup{Path: cgroupPath, Driver: driver, Pids: pids}
+		info, ok := byPath[cgroupPath]
+		switch {
+		case !ok:
+			leftover.Problem = "no container"
+		case (info.Status == container.STOP || info.Status == container.EXIT) && len(pids) > 0:
+			leftover.Container = info.Name
+			leftover.Problem = "stopped container has processes"
+		default:
+			continue
+		}
+		leftovers = append(leftovers, leftover)
+	}
+	sort.Slice(leftovers, func(i, j int) bool {
+		return leftovers[i].Path < leftovers[j].Path
+	})
+	if len(leftovers) == 0 {
+		fmt.Println("No leftover cgroups")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "CGROUP\tCONTAINER\tPROCESSES\tPROBLEM\n")
+	for _, item := range leftovers {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", item.Path, item.Container, len(item.Pids), item.Problem)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+	if !clean {
+		return fmt.Errorf("found %d leftover cgroups, --clean removes them", len(leftovers))
+	}
+
+	failed, skipped := 0, 0
+	for _, item := range leftovers {
+		if item.Container == "" && hasContainer(item.Path) {
+			// a run recorded it since we listed the containers
+			log.Infof("Cgroup %s has a container now, leaving it", item.Path)
+			skipped++
+			continue
+		}
+		if item.Container != "" {
+			// rm removes the cgroup of a stopped container, only empty it
+			err = (&cgroups.CgroupManager{Path: item.Path}).KillTasks()
+		} else if manager, managerErr := cgroups.NewManager(item.Driver, item.Path); managerErr != nil {
+			err = managerErr
+		} else {
+			err = manager.Destroy()
+		}
+		if err != nil {
+			log.Errorf("Clean cgroup %s error %v", item.Path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d leftover cgroups could not be cleaned", failed, len(leftovers))
+	}
+	fmt.Printf("Cleaned %d leftover cgroups\n", len(leftovers)-skipped)
+	return nil
+}
+
+// hasContainer tells if a container has the cgroup at cgroupPath now: one is
+// recorded with it, or one is being recorded under its ID. run records the
+// container before it makes the cgroup.
+func hasContainer(cgroupPath string) bool {
+	id := strings.TrimSuffix(strings.TrimPrefix(path.Base(cgroupPath), "mydocker-"), ".scope")
+	if _, err := os.Stat(state.Dir(id)); err == nil {
+		return true
+	}
+	infos, err := state.List()
+	if err != nil {
+		// can't tell, keep it
+		return true
+	}
+	for _, info := range infos {
+		if info.CgroupPath == cgroupPath || info.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// findContainerCgroups finds what looks like a container cgroup anywhere in
+// any hierarchy: an ID, under whatever --cgroup-parent the containers of
+// cgroupfs had, or a mydocker scope of systemd. It maps their paths to the
+// driver that made them.
+func findContainerCgroups() (map[string]string, error) {
+	found := map[string]string{}
+	for _, root := range cgroups.Hierarchies() {
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				// cgroups come and go while we walk
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			// what is below a container's cgroup is the container's
+			if scopePattern.MatchString(info.Name()) {
+				found[strings.TrimPrefix(file, root+"/")] = cgroups.SystemdDriver
+				return filepath.SkipDir
+			}
+			if file != root && containerIDPattern.MatchString(info.Name()) {
+				found[strings.TrimPrefix(file, root+"/")] = cgroups.CgroupfsDriver
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"./container"
+	"./state"
+	log "github.com/sirupsen/logrus"
+)
+
+// topContainer lists the processes in a container, with their pid on the host and in the container
+func topContainer(containerName string) {
+	containerInfo, err := state.Load(containerName)
+	if err != nil {
+		log.Errorf("Get container %s info error %v", containerName, err)
+		return
+	}
+	if containerInfo.Status != container.RUNNING && containerInfo.Status != container.PAUSED {
+		log.Errorf("Container %s is not running", containerName)
+		return
+	}
+	processes, err := container.NamespaceProcesses(containerInfo.Pid)
+	if err != nil {
+		log.Errorf("List processes of container %s error %v", containerName, err)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 8, 1, 3, ' ', 0)
+	fmt.Fprint(w, "UID\tPID\tCPID\tPPID\tSTAT\tTIME\tCMD\n")
+	for _, item := range processes {
+		seconds := item.CpuTicks / container.ClockTicks
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\t%d:%02d\t%s\n",
+			item.Uid,
+			item.Pid,
+			item.ContainerPid,
+			item.PPid,
+			item.State,
+			seconds/60, seconds%60,
+			item.Command)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+		return
+	}
+}
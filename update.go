@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"./cgroups/subsystems"
+	"./container"
+	"./state"
+)
+
+// updateContainer changes the limits of a running container in its cgroup.
+// Only the limits set in res are written, the others keep their value.
+func updateContainer(containerName string, res *subsystems.ResourceConfig) error {
+	return state.Update(containerName, func(containerInfo *container.ContainerInfo) error {
+		if containerInfo.Status != container.RUNNING && containerInfo.Status != container.PAUSED {
+			return fmt.Errorf("container %s is not running", containerName)
+		}
+		if containerInfo.CgroupPath == "" {
+			return fmt.Errorf("container %s has no cgroup, rootless containers can't be updated", containerName)
+		}
+		// check the new limits together with the ones they don't replace, swap against memory
+		merged := containerInfo.Resources.Merge(res)
+		if err := merged.Validate(); err != nil {
+			return err
+		}
+		// a quota is in the container's period, systemd wants it per second
+		if res.CpuQuota != "" && res.CpuPeriod == "" {
+			res.CpuPeriod = merged.CpuPeriod
+		}
+		cgroupManager, err := containerCgroupManager(containerInfo)
+		if err != nil {
+			return err
+		}
+		if err := cgroupManager.Set(res); err != nil {
+			return fmt.Errorf("update container %s error %v", containerName, err)
+		}
+		containerInfo.Resources = merged
+		return nil
+	})
+}